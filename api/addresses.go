@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"slices"
+)
+
+// addressTranslation maps between the addresses of the device and the ones assigned by the server.
+type addressTranslation struct {
+	// toAssigned replaces source addresses of packets sent to the server.
+	toAssigned map[netip.Addr]netip.Addr
+	// toLocal replaces destination addresses of packets received from the server.
+	toLocal map[netip.Addr]netip.Addr
+}
+
+// newAddressTranslation builds the translation between the local addresses of the device and the
+// addresses assigned by the server.
+//
+// Parameters:
+//   - local: []netip.Addr - The addresses of the device.
+//   - assigned: []netip.Prefix - The addresses assigned by the server.
+//
+// Returns:
+//   - *addressTranslation: The translation, nil if every local address is also assigned.
+func newAddressTranslation(local []netip.Addr, assigned []netip.Prefix) *addressTranslation {
+	var tr *addressTranslation
+	for _, addr := range local {
+		replacement, ok := assignedAddress(addr, assigned)
+		if !ok {
+			continue
+		}
+		if tr == nil {
+			tr = &addressTranslation{
+				toAssigned: make(map[netip.Addr]netip.Addr),
+				toLocal:    make(map[netip.Addr]netip.Addr),
+			}
+		}
+		tr.toAssigned[addr] = replacement
+		tr.toLocal[replacement] = addr
+	}
+	return tr
+}
+
+// assignedAddress finds the address assigned by the server that replaces addr.
+//
+// Parameters:
+//   - addr: netip.Addr - An address of the device.
+//   - assigned: []netip.Prefix - The addresses assigned by the server.
+//
+// Returns:
+//   - netip.Addr: The first assigned address of the same family.
+//   - bool: Whether addr has to be replaced, false if it is within an assigned prefix or no
+//     address of its family was assigned.
+func assignedAddress(addr netip.Addr, assigned []netip.Prefix) (netip.Addr, bool) {
+	for _, prefix := range assigned {
+		if prefix.Addr().Is4() != addr.Is4() {
+			continue
+		}
+		if prefix.Contains(addr) {
+			return netip.Addr{}, false
+		}
+		return prefix.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// watchAddresses follows the ADDRESS_ASSIGN capsules of session until it is closed.
+func (t *Tunnel) watchAddresses(session *tunnelSession) {
+	for {
+		// Closing the session unblocks the call
+		prefixes, err := session.ipConn.LocalPrefixes(context.Background())
+		if err != nil {
+			return
+		}
+		t.setAssignedAddresses(prefixes)
+	}
+}
+
+// watchRoutes follows the ROUTE_ADVERTISEMENT capsules of session until it is closed.
+func (t *Tunnel) watchRoutes(session *tunnelSession) {
+	for {
+		ranges, err := session.ipConn.Routes(context.Background())
+		if err != nil {
+			return
+		}
+		var routes []netip.Prefix
+		for _, r := range ranges {
+			routes = append(routes, r.Prefixes()...)
+		}
+		t.setRoutes(routes)
+	}
+}
+
+// setAssignedAddresses records the addresses assigned by the server, updates the translation of
+// LocalAddresses and tells OnAddressAssign if they changed.
+func (t *Tunnel) setAssignedAddresses(prefixes []netip.Prefix) {
+	t.addrMu.Lock()
+	if t.assigned != nil && slices.Equal(t.assigned, prefixes) {
+		t.addrMu.Unlock()
+		return
+	}
+	t.assigned = slices.Clone(prefixes)
+	if t.assigned == nil {
+		t.assigned = []netip.Prefix{}
+	}
+	tr := newAddressTranslation(t.config.LocalAddresses, prefixes)
+	t.translation.Store(tr)
+	t.addrMu.Unlock()
+
+	log.Printf("Server assigned addresses %v", prefixes)
+	if tr != nil {
+		for local, assigned := range tr.toAssigned {
+			log.Printf("Translating address %s to %s", local, assigned)
+		}
+	}
+	if t.config.OnAddressAssign != nil {
+		t.config.OnAddressAssign(slices.Clone(prefixes))
+	}
+}
+
+// setRoutes records the routes advertised by the server and tells OnRouteAdvertisement if they changed.
+func (t *Tunnel) setRoutes(routes []netip.Prefix) {
+	t.addrMu.Lock()
+	if t.routes != nil && slices.Equal(t.routes, routes) {
+		t.addrMu.Unlock()
+		return
+	}
+	t.routes = slices.Clone(routes)
+	if t.routes == nil {
+		t.routes = []netip.Prefix{}
+	}
+	t.addrMu.Unlock()
+
+	log.Printf("Server advertised routes %v", routes)
+	if t.config.OnRouteAdvertisement != nil {
+		t.config.OnRouteAdvertisement(slices.Clone(routes))
+	}
+}
+
+// sourceAddress returns the address packets from src have to be sent from: the address of the same
+// family assigned by the server if it differs from src, src otherwise.
+func (t *Tunnel) sourceAddress(src netip.Addr) netip.Addr {
+	t.addrMu.Lock()
+	defer t.addrMu.Unlock()
+	if addr, ok := assignedAddress(src, t.assigned); ok {
+		return addr
+	}
+	return src
+}
+
+// translate replaces a local source address of a packet sent to the server by the assigned one,
+// or an assigned destination address of a packet received from the server by the local one.
+//
+// Parameters:
+//   - pkt: []byte - The IPv4 or IPv6 packet, modified in place.
+//   - outgoing: bool - Whether pkt is sent to the server.
+func (t *Tunnel) translate(pkt []byte, outgoing bool) {
+	tr := t.translation.Load()
+	if tr == nil {
+		return
+	}
+	if outgoing {
+		rewriteAddress(pkt, true, tr.toAssigned)
+	} else {
+		rewriteAddress(pkt, false, tr.toLocal)
+	}
+}
+
+// rewriteAddress replaces the source or destination address of a packet if addrs has a replacement
+// for it. The checksums of the IPv4 header and of TCP, UDP and ICMPv6, which cover the addresses
+// through their pseudo header, are updated accordingly. Non-first fragments only carry the IPv4
+// header, and the transport checksum of IPv6 packets with extension headers is left alone.
+//
+// ICMP and ICMPv6 errors quote the packet they are about, which went the other way: its opposite
+// address is the one replaced in the packet carrying the error. It is replaced as well, along with
+// the checksums inside the quote, so the error matches the flow it belongs to on either side.
+//
+// Parameters:
+//   - pkt: []byte - The IPv4 or IPv6 packet, modified in place.
+//   - source: bool - Whether to replace the source address rather than the destination address.
+//   - addrs: map[netip.Addr]netip.Addr - The replacements by address.
+func rewriteAddress(pkt []byte, source bool, addrs map[netip.Addr]netip.Addr) {
+	payload, proto, ok := rewriteHeader(pkt, source, addrs)
+	if !ok {
+		return
+	}
+
+	switch {
+	case proto == 1 && len(payload) >= 8 && isICMPError(payload[0]):
+	case proto == 58 && len(payload) >= 8 && payload[0] < 128: // ICMPv6 errors
+	default:
+		return
+	}
+	quote := payload[8:]
+	before := slices.Clone(quote)
+	if _, _, ok := rewriteHeader(quote, !source, addrs); !ok {
+		return
+	}
+	// The ICMP checksum covers the quote, which starts at an even offset
+	for i := 0; i < len(quote); i += 2 {
+		old, new := uint16(before[i])<<8, uint16(quote[i])<<8
+		if i+1 < len(quote) {
+			old, new = old|uint16(before[i+1]), new|uint16(quote[i+1])
+		}
+		if old != new {
+			updateChecksum(payload[2:4], 0, old, new)
+		}
+	}
+}
+
+// isICMPError reports whether an ICMP message of type typ quotes the packet it is about:
+// destination unreachable, source quench, redirect, time exceeded and parameter problem.
+func isICMPError(typ byte) bool {
+	switch typ {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
+
+// rewriteHeader is rewriteAddress without looking into ICMP errors. It copes with packets cut short,
+// like the ones quoted by ICMP errors, by leaving alone what they don't carry.
+//
+// Returns:
+//   - []byte: The payload of the packet, nil for non-first fragments.
+//   - byte: The protocol of the payload.
+//   - bool: Whether the address was replaced.
+func rewriteHeader(pkt []byte, source bool, addrs map[netip.Addr]netip.Addr) ([]byte, byte, bool) {
+	var field, payload []byte
+	var proto byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return nil, 0, false
+		}
+		field = pkt[16:20]
+		if source {
+			field = pkt[12:16]
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+			payload, proto = pkt[ihl:], pkt[9]
+		}
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		field = pkt[24:40]
+		if source {
+			field = pkt[8:24]
+		}
+		payload, proto = pkt[40:], pkt[6]
+	default:
+		return nil, 0, false
+	}
+
+	old, _ := netip.AddrFromSlice(field)
+	replacement, ok := addrs[old]
+	if !ok {
+		return nil, 0, false
+	}
+	var addr []byte
+	if replacement.Is4() {
+		a := replacement.As4()
+		addr = a[:]
+	} else {
+		a := replacement.As16()
+		addr = a[:]
+	}
+
+	var checksums [2][]byte
+	if pkt[0]>>4 == 4 {
+		checksums[0] = pkt[10:12]
+	}
+	var udp bool
+	switch {
+	case proto == 6 && len(payload) >= 20: // TCP
+		checksums[1] = payload[16:18]
+	case proto == 17 && len(payload) >= 8 && binary.BigEndian.Uint16(payload[6:]) != 0: // UDP, zero means none
+		checksums[1], udp = payload[6:8], true
+	case proto == 58 && len(payload) >= 4: // ICMPv6
+		checksums[1] = payload[2:4]
+	}
+	for _, cs := range checksums {
+		if cs == nil {
+			continue
+		}
+		for i := 0; i < len(field); i += 2 {
+			updateChecksum(cs, 0, binary.BigEndian.Uint16(field[i:]), binary.BigEndian.Uint16(addr[i:]))
+		}
+	}
+	if udp && binary.BigEndian.Uint16(checksums[1]) == 0 {
+		// A computed UDP checksum of zero is sent as all ones (RFC 768)
+		binary.BigEndian.PutUint16(checksums[1], 0xffff)
+	}
+	copy(field, addr)
+	return payload, proto, true
+}
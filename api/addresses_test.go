@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipPacket builds an IPv4 or IPv6 packet from src to dst carrying payload, with a valid IPv4 header
+// checksum. The checksum of the payload is left to the caller.
+func ipPacket(src, dst netip.Addr, proto byte, payload []byte) []byte {
+	if src.Is4() {
+		pkt := make([]byte, 20, 20+len(payload))
+		pkt[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(pkt[2:], uint16(20+len(payload)))
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src.AsSlice())
+		copy(pkt[16:20], dst.AsSlice())
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt, 0))
+		return append(pkt, payload...)
+	}
+	pkt := make([]byte, 40, 40+len(payload))
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(payload)))
+	pkt[6] = proto
+	pkt[7] = 64
+	copy(pkt[8:24], src.AsSlice())
+	copy(pkt[24:40], dst.AsSlice())
+	return append(pkt, payload...)
+}
+
+// headerLen returns the length of the IP header of pkt, which has no options or extension headers.
+func headerLen(pkt []byte) int {
+	if pkt[0]>>4 == 4 {
+		return 20
+	}
+	return 40
+}
+
+// udpChecksum computes the checksum the UDP packet pkt has to carry.
+func udpChecksum(pkt []byte) uint16 {
+	hdr := headerLen(pkt)
+	addrs := pkt[12:20]
+	if hdr == 40 {
+		addrs = pkt[8:40]
+	}
+	udp := bytes.Clone(pkt[hdr:])
+	binary.BigEndian.PutUint16(udp[6:], 0)
+	sum := checksum(udp, uint32(^checksum(addrs, 0))+uint32(len(udp))+17)
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
+
+// udpPacket builds a UDP packet from src to dst with a valid checksum.
+func udpPacket(src, dst netip.Addr) []byte {
+	udp := make([]byte, 8, 20)
+	binary.BigEndian.PutUint16(udp[0:], 1234)
+	binary.BigEndian.PutUint16(udp[2:], 5678)
+	binary.BigEndian.PutUint16(udp[4:], 20)
+	udp = append(udp, "hello, world"...)
+	pkt := ipPacket(src, dst, 17, udp)
+	binary.BigEndian.PutUint16(pkt[headerLen(pkt)+6:], udpChecksum(pkt))
+	return pkt
+}
+
+// icmpError builds an ICMP Fragmentation Needed or ICMPv6 Packet Too Big error from src to dst
+// quoting quote, with valid checksums.
+func icmpError(src, dst netip.Addr, quote []byte) []byte {
+	if src.Is4() {
+		icmp := append([]byte{3, 4, 0, 0, 0, 0, 0x05, 0x00}, quote...)
+		binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+		return ipPacket(src, dst, 1, icmp)
+	}
+	pkt := ipPacket(src, dst, 58, append([]byte{2, 0, 0, 0, 0, 0, 0x05, 0x00}, quote...))
+	binary.BigEndian.PutUint16(pkt[42:], icmpv6Checksum(pkt))
+	return pkt
+}
+
+// TestRewriteAddressICMPError checks that the packets quoted by ICMP errors are translated along
+// with the errors, and that every checksum matches a full recompute afterwards.
+func TestRewriteAddressICMPError(t *testing.T) {
+	var (
+		local4    = netip.MustParseAddr("10.0.0.5")
+		assigned4 = netip.MustParseAddr("172.16.0.2")
+		remote4   = netip.MustParseAddr("1.1.1.1")
+		local6    = netip.MustParseAddr("fd00::5")
+		assigned6 = netip.MustParseAddr("2606:4700:110::2")
+		remote6   = netip.MustParseAddr("2606:4700:4700::1111")
+	)
+
+	tests := []struct {
+		name string
+		// errSrc and errDst are the addresses of the ICMP error, quoted the packet it quotes
+		errSrc, errDst netip.Addr
+		quoted         []byte
+		// quoteLen is how much of quoted the error quotes, 0 for all of it
+		quoteLen int
+		source   bool
+		from, to netip.Addr
+	}{
+		{
+			name:   "IPv4 error from the server",
+			quoted: udpPacket(assigned4, remote4),
+			errSrc: remote4, errDst: assigned4,
+			from: assigned4, to: local4,
+		},
+		{
+			name:     "IPv4 error from the server quoting 8 bytes",
+			quoted:   udpPacket(assigned4, remote4),
+			quoteLen: 28,
+			errSrc:   remote4, errDst: assigned4,
+			from: assigned4, to: local4,
+		},
+		{
+			name:   "IPv4 error to the server",
+			quoted: udpPacket(remote4, local4),
+			errSrc: local4, errDst: remote4,
+			source: true,
+			from:   local4, to: assigned4,
+		},
+		{
+			name:   "IPv6 error from the server",
+			quoted: udpPacket(assigned6, remote6),
+			errSrc: remote6, errDst: assigned6,
+			from: assigned6, to: local6,
+		},
+		{
+			name:   "IPv6 error to the server",
+			quoted: udpPacket(remote6, local6),
+			errSrc: local6, errDst: remote6,
+			source: true,
+			from:   local6, to: assigned6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote := tt.quoted
+			if tt.quoteLen > 0 {
+				quote = quote[:tt.quoteLen]
+			}
+			pkt := icmpError(tt.errSrc, tt.errDst, quote)
+
+			addrs := map[netip.Addr]netip.Addr{tt.from: tt.to}
+			rewriteAddress(pkt, tt.source, addrs)
+
+			// The quoted packet translated on its own is what the error has to quote
+			want := bytes.Clone(tt.quoted)
+			rewriteAddress(want, !tt.source, addrs)
+			if got := pkt[headerLen(pkt)+8:]; !bytes.Equal(got, want[:len(quote)]) {
+				t.Fatalf("quoted packet is\n%x, want\n%x", got, want[:len(quote)])
+			}
+			if binary.BigEndian.Uint16(want[headerLen(want)+6:]) != udpChecksum(want) {
+				t.Error("checksum of the quoted packet is wrong")
+			}
+			if headerLen(want) == 20 && checksum(want[:20], 0) != 0 {
+				t.Error("header checksum of the quoted packet is wrong")
+			}
+
+			if headerLen(pkt) == 20 {
+				if checksum(pkt[:20], 0) != 0 {
+					t.Error("header checksum of the error is wrong")
+				}
+				if checksum(pkt[20:], 0) != 0 {
+					t.Error("ICMP checksum of the error is wrong")
+				}
+			} else {
+				cs := binary.BigEndian.Uint16(pkt[42:])
+				binary.BigEndian.PutUint16(pkt[42:], 0)
+				if cs != icmpv6Checksum(pkt) {
+					t.Error("ICMPv6 checksum of the error is wrong")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// DefaultAttemptDelay is the delay between starting connection attempts to
+	// consecutive endpoint candidates, as recommended by RFC 8305.
+	DefaultAttemptDelay = 250 * time.Millisecond
+	// DefaultFailoverAttempts is the number of consecutive failed reconnect attempts
+	// after which the next endpoint candidate becomes the preferred one.
+	DefaultFailoverAttempts = 3
+)
+
+// dialSession establishes a MASQUE connection to a single endpoint.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the connection attempt.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - endpoint: *net.UDPAddr - The UDP address of the MASQUE server.
+//   - fwmark: uint32 - The firewall mark to set on the UDP socket, 0 for none.
+//
+// Returns:
+//   - *tunnelSession: The established session.
+//   - error: An error if the connection could not be established.
+func dialSession(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, endpoint *net.UDPAddr, fwmark uint32) (*tunnelSession, error) {
+	log.Printf("Establishing MASQUE connection to %s", endpoint)
+	start := time.Now()
+	udpConn, quicConn, tr, ipConn, rsp, err := connectTunnel(ctx, tlsConfig, quicConfig, internal.ConnectURI, endpoint, fwmark)
+	session := &tunnelSession{
+		endpoint: endpoint,
+		udpConn:  udpConn,
+		quicConn: quicConn,
+		tr:       tr,
+		ipConn:   ipConn,
+		response: rsp,
+		failed:   make(chan struct{}),
+	}
+	if err != nil {
+		session.close()
+		return nil, fmt.Errorf("failed to connect tunnel to %s: %w", endpoint, err)
+	}
+	if rsp.StatusCode != 200 {
+		session.close()
+		return nil, fmt.Errorf("tunnel connection to %s failed: %s", endpoint, rsp.Status)
+	}
+	session.connectTime = time.Since(start)
+	session.resumed = quicConn.ConnectionState().TLS.DidResume
+
+	return session, nil
+}
+
+// raceEndpoints connects to the given endpoints Happy Eyeballs style (RFC 8305).
+// Attempts are started in order, each one attemptDelay after the previous one or
+// immediately once the previous one failed. The first successful connection wins
+// and all other attempts are cancelled.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the connection attempts.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - endpoints: []*net.UDPAddr - The endpoint candidates in order of preference.
+//   - attemptDelay: time.Duration - The delay between starting consecutive attempts.
+//   - fwmark: uint32 - The firewall mark to set on the UDP sockets, 0 for none.
+//
+// Returns:
+//   - *tunnelSession: The session of the winning endpoint.
+//   - error: An error if none of the endpoints could be connected to.
+func raceEndpoints(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, endpoints []*net.UDPAddr, attemptDelay time.Duration, fwmark uint32) (*tunnelSession, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints to connect to")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		session *tunnelSession
+		err     error
+	}
+	results := make(chan result, len(endpoints))
+
+	var (
+		started int
+		pending int
+		lastErr error
+	)
+	startNext := func() {
+		endpoint := endpoints[started]
+		started++
+		pending++
+		go func() {
+			session, err := dialSession(ctx, tlsConfig, quicConfig, endpoint, fwmark)
+			results <- result{session: session, err: err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close sessions of attempts that succeed after we already have a winner
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if res := <-results; res.session != nil {
+							res.session.close()
+						}
+					}
+				}(pending)
+				return res.session, nil
+			}
+			lastErr = res.err
+			if started < len(endpoints) {
+				startNext()
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if started < len(endpoints) {
+				startNext()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+
+	if len(endpoints) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("all %d endpoints failed, last error: %w", len(endpoints), lastErr)
+}
+
+// preferEndpoint returns a copy of endpoints with the given endpoint moved to the front.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The endpoint candidates.
+//   - endpoint: *net.UDPAddr - The endpoint to prefer.
+//
+// Returns:
+//   - []*net.UDPAddr: The reordered endpoint candidates.
+func preferEndpoint(endpoints []*net.UDPAddr, endpoint *net.UDPAddr) []*net.UDPAddr {
+	reordered := make([]*net.UDPAddr, 0, len(endpoints))
+	reordered = append(reordered, endpoint)
+	for _, e := range endpoints {
+		if e != endpoint {
+			reordered = append(reordered, e)
+		}
+	}
+	return reordered
+}
+
+// rotateEndpoints returns a copy of endpoints with the first candidate moved to the back,
+// making the next candidate the preferred one.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The endpoint candidates.
+//
+// Returns:
+//   - []*net.UDPAddr: The rotated endpoint candidates.
+func rotateEndpoints(endpoints []*net.UDPAddr) []*net.UDPAddr {
+	if len(endpoints) < 2 {
+		return endpoints
+	}
+	rotated := make([]*net.UDPAddr, 0, len(endpoints))
+	rotated = append(rotated, endpoints[1:]...)
+	return append(rotated, endpoints[0])
+}
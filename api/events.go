@@ -0,0 +1,137 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrTunnelDown is returned when traffic is refused because the tunnel isn't connected.
+var ErrTunnelDown = errors.New("tunnel is down")
+
+// TunnelState describes what a Tunnel is currently doing.
+type TunnelState int32
+
+const (
+	// StateIdle means the tunnel hasn't been started yet.
+	StateIdle TunnelState = iota
+	// StateConnecting means the tunnel is establishing a connection.
+	StateConnecting
+	// StateConnected means the tunnel is connected and forwarding packets.
+	StateConnected
+	// StateDisconnected means an established connection was lost.
+	StateDisconnected
+	// StateReconnecting means the tunnel is waiting before the next connection attempt.
+	StateReconnecting
+	// StateStopped means the tunnel has shut down and won't reconnect anymore.
+	StateStopped
+)
+
+// String returns a human-readable name of the state.
+func (s TunnelState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// TunnelEvent is emitted by a Tunnel whenever its state changes.
+// Only the fields relevant to the state are set.
+type TunnelEvent struct {
+	// State is the state the tunnel entered.
+	State TunnelState
+	// Time is when the tunnel entered the state.
+	Time time.Time
+	// Attempt is the number of the connection attempt since the last successful connection,
+	// starting at 1. Set for StateConnecting and StateReconnecting.
+	Attempt int
+	// Delay is how long the tunnel waits before the next attempt. Set for StateReconnecting.
+	Delay time.Duration
+	// Endpoint is the endpoint the tunnel connected to. Set for StateConnected.
+	Endpoint *net.UDPAddr
+	// Response is the response of the server to the Connect-IP request. Set for StateConnected.
+	Response *http.Response
+	// ConnectTime is how long establishing the connection took, from the start of the winning
+	// attempt to the response of the server. Set for StateConnected.
+	ConnectTime time.Duration
+	// Resumed is whether the connection resumed an earlier TLS session instead of going through
+	// a full handshake. Set for StateConnected.
+	Resumed bool
+	// Err is the error that caused the state change. Set for StateDisconnected and StateReconnecting,
+	// and for StateStopped if the tunnel terminated because of an error.
+	Err error
+}
+
+// TunnelObserver is notified about the state changes of a Tunnel.
+type TunnelObserver interface {
+	// OnTunnelEvent is called synchronously from the tunnel's goroutine, which only carries on
+	// once every observer returned. A connection attempt therefore starts after the observers of
+	// its StateConnecting event are done, so they can prepare for it, e.g. by adding routes.
+	// Observers may block briefly, but every moment they take delays the tunnel, and they must
+	// not wait for the tunnel itself, e.g. by calling Stop or Wait.
+	OnTunnelEvent(event TunnelEvent)
+}
+
+// TunnelObserverFunc adapts a function to the TunnelObserver interface.
+type TunnelObserverFunc func(event TunnelEvent)
+
+// OnTunnelEvent calls f(event).
+func (f TunnelObserverFunc) OnTunnelEvent(event TunnelEvent) {
+	f(event)
+}
+
+// AddObserver registers an observer that is notified about every subsequent state change.
+//
+// Parameters:
+//   - observer: TunnelObserver - The observer to register.
+func (t *Tunnel) AddObserver(observer TunnelObserver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observers = append(t.observers, observer)
+}
+
+// State returns the current state of the tunnel.
+//
+// Returns:
+//   - TunnelState: The current state.
+func (t *Tunnel) State() TunnelState {
+	return TunnelState(t.state.Load())
+}
+
+// Connected reports whether the tunnel is currently connected and forwarding packets.
+//
+// Returns:
+//   - bool: True if connected, otherwise false.
+func (t *Tunnel) Connected() bool {
+	return t.State() == StateConnected
+}
+
+// emit updates the state of the tunnel and notifies the observers.
+//
+// Parameters:
+//   - event: TunnelEvent - The event describing the new state.
+func (t *Tunnel) emit(event TunnelEvent) {
+	event.Time = time.Now()
+	t.state.Store(int32(event.State))
+
+	t.mu.Lock()
+	observers := t.observers
+	t.mu.Unlock()
+
+	for _, observer := range observers {
+		observer.OnTunnelEvent(event)
+	}
+}
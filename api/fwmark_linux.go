@@ -0,0 +1,17 @@
+//go:build linux
+
+package api
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setFwMark sets the firewall mark (SO_MARK) of a socket, which policy routing rules can match on.
+// Requires CAP_NET_ADMIN.
+func setFwMark(fd uintptr, mark uint32) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+		return fmt.Errorf("failed to set fwmark: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package api
+
+import "errors"
+
+// setFwMark is only supported on Linux.
+func setFwMark(fd uintptr, mark uint32) error {
+	return errors.New("fwmark is only supported on Linux")
+}
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	// DefaultHealthCheckInterval is the time between two probes of a HealthCheck.
+	DefaultHealthCheckInterval = 10 * time.Second
+	// DefaultHealthCheckTimeout is how long a HealthCheck waits for a probe to succeed.
+	DefaultHealthCheckTimeout = 5 * time.Second
+	// DefaultHealthCheckFailures is the number of consecutive failed probes after which a
+	// HealthCheck reconnects the tunnel.
+	DefaultHealthCheckFailures = 3
+)
+
+// ErrHealthCheckFailed is the error a connection is torn down with when its health check failed
+// too many times in a row.
+var ErrHealthCheckFailed = errors.New("health check failed")
+
+// HealthProbe checks whether traffic passes through a tunnel.
+type HealthProbe interface {
+	// Probe sends something through the tunnel and waits for the answer. It returns nil if the
+	// answer arrived and an error if it didn't before ctx is done.
+	Probe(ctx context.Context, tunnel *Tunnel) error
+}
+
+// HealthCheck detects connections that look established but don't carry traffic anymore, e.g.
+// because the path to the server became a black hole. While connected, the tunnel runs Probe
+// every Interval and reconnects once Failures probes in a row have failed.
+type HealthCheck struct {
+	// Probe is the probe to run.
+	Probe HealthProbe
+	// Interval is the time between two probes. If zero, DefaultHealthCheckInterval is used.
+	Interval time.Duration
+	// Timeout is how long a probe may take. If zero, DefaultHealthCheckTimeout is used.
+	Timeout time.Duration
+	// Failures is the number of consecutive failed probes after which the tunnel reconnects.
+	// If zero, DefaultHealthCheckFailures is used.
+	Failures int
+}
+
+// ICMPProbe pings an address through the tunnel. The echo request is written straight to the
+// connection and the reply is taken out of the received packets, so neither goes through the
+// device and the probe works with every kind of device.
+type ICMPProbe struct {
+	// Source is the address of this side of the tunnel, of the same family as Destination.
+	// An address of that family assigned by the server takes precedence.
+	Source netip.Addr
+	// Destination is the address to ping.
+	Destination netip.Addr
+}
+
+// Probe implements HealthProbe.
+func (p *ICMPProbe) Probe(ctx context.Context, tunnel *Tunnel) error {
+	return tunnel.ping(ctx, p.Source, p.Destination)
+}
+
+// HTTPProbe sends a GET request through the tunnel and expects a 2xx response, e.g. the 204 of
+// https://cloudflareok.com/test. Every probe uses a new connection.
+type HTTPProbe struct {
+	// URL is the URL to request.
+	URL string
+	// DialContext dials connections through the tunnel, e.g. netstack.Net.DialContext.
+	// If nil, the default dialer is used, which only goes through the tunnel if it is routed there.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Probe implements HealthProbe.
+func (p *HTTPProbe) Probe(ctx context.Context, tunnel *Tunnel) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       p.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// checkHealth runs the health check of the tunnel on session until the session fails, and fails
+// the session with ErrHealthCheckFailed once too many probes in a row have failed.
+func (t *Tunnel) checkHealth(session *tunnelSession) {
+	check := t.config.HealthCheck
+	interval, timeout, maxFailures := check.Interval, check.Timeout, check.Failures
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	if maxFailures <= 0 {
+		maxFailures = DefaultHealthCheckFailures
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-session.failed:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		go func() {
+			// Stop probing as soon as the session is gone
+			select {
+			case <-session.failed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := check.Probe.Probe(ctx, t)
+		cancel()
+
+		select {
+		case <-session.failed:
+			return
+		default:
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		t.counters.healthCheckFailures.Add(1)
+		log.Printf("Health check failed (%d/%d): %v", failures, maxFailures, err)
+		if failures >= maxFailures {
+			session.fail(fmt.Errorf("%w: %v", ErrHealthCheckFailed, err))
+			return
+		}
+	}
+}
+
+// pingPayload is the payload of the echo requests sent by ping.
+var pingPayload = []byte("usque health check")
+
+// ping sends an ICMP echo request from src to dst through the current connection and waits for
+// the reply, which is not forwarded to the device.
+//
+// Parameters:
+//   - ctx: context.Context - The context bounding the wait for the reply.
+//   - src: netip.Addr - The source address of the request.
+//   - dst: netip.Addr - The address to ping.
+//
+// Returns:
+//   - error: An error if the request couldn't be sent or no reply arrived before ctx is done.
+func (t *Tunnel) ping(ctx context.Context, src, dst netip.Addr) error {
+	if src.Is4() != dst.Is4() {
+		return fmt.Errorf("source %s and destination %s are of different families", src, dst)
+	}
+	session := t.session.Load()
+	if session == nil {
+		return ErrTunnelDown
+	}
+
+	seq := uint16(t.pingSeq.Add(1))
+	reply := make(chan struct{})
+	t.pingMu.Lock()
+	t.pings[seq] = reply
+	t.pingMu.Unlock()
+	defer func() {
+		t.pingMu.Lock()
+		delete(t.pings, seq)
+		t.pingMu.Unlock()
+	}()
+
+	icmp, err := session.ipConn.WritePacket(echoRequest(t.sourceAddress(src), dst, t.pingID, seq))
+	if err != nil {
+		return fmt.Errorf("failed to send echo request: %v", err)
+	}
+	if len(icmp) > 0 {
+		return errors.New("echo request was rejected locally")
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-session.failed:
+		return ErrTunnelDown
+	case <-ctx.Done():
+		return fmt.Errorf("no echo reply from %s: %w", dst, ctx.Err())
+	}
+}
+
+// takePingReply checks whether pkt is the reply to an echo request sent by ping, and if so,
+// hands it over to ping.
+//
+// Returns:
+//   - bool: Whether pkt was a reply to ping, which must not be forwarded to the device.
+func (t *Tunnel) takePingReply(pkt []byte) bool {
+	var icmp []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4 && pkt[9] == 1:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < ihl+8 || pkt[ihl] != 0 { // Echo Reply
+			return false
+		}
+		icmp = pkt[ihl:]
+	case len(pkt) >= 40 && pkt[0]>>4 == 6 && pkt[6] == 58:
+		icmp = pkt[40:]
+		if len(icmp) < 8 || icmp[0] != 129 { // Echo Reply
+			return false
+		}
+	default:
+		return false
+	}
+	if binary.BigEndian.Uint16(icmp[4:]) != t.pingID {
+		return false
+	}
+
+	t.pingMu.Lock()
+	defer t.pingMu.Unlock()
+	reply, ok := t.pings[binary.BigEndian.Uint16(icmp[6:])]
+	if !ok {
+		return false
+	}
+	close(reply)
+	delete(t.pings, binary.BigEndian.Uint16(icmp[6:]))
+	return true
+}
+
+// echoRequest builds an ICMP or ICMPv6 echo request.
+//
+// Parameters:
+//   - src: netip.Addr - The source address.
+//   - dst: netip.Addr - The destination address, of the same family as src.
+//   - id: uint16 - The identifier of the request.
+//   - seq: uint16 - The sequence number of the request.
+//
+// Returns:
+//   - []byte: The IP packet.
+func echoRequest(src, dst netip.Addr, id, seq uint16) []byte {
+	if src.Is4() {
+		pkt := make([]byte, 20+8+len(pingPayload))
+		pkt[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8] = 64 // TTL
+		pkt[9] = 1  // ICMP
+		copy(pkt[12:16], src.AsSlice())
+		copy(pkt[16:20], dst.AsSlice())
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+
+		icmp := pkt[20:]
+		icmp[0] = 8 // Echo Request
+		binary.BigEndian.PutUint16(icmp[4:], id)
+		binary.BigEndian.PutUint16(icmp[6:], seq)
+		copy(icmp[8:], pingPayload)
+		binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+		return pkt
+	}
+
+	pkt := make([]byte, 40+8+len(pingPayload))
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:], uint16(8+len(pingPayload)))
+	pkt[6] = 58 // ICMPv6
+	pkt[7] = 64 // Hop limit
+	copy(pkt[8:24], src.AsSlice())
+	copy(pkt[24:40], dst.AsSlice())
+
+	icmp := pkt[40:]
+	icmp[0] = 128 // Echo Request
+	binary.BigEndian.PutUint16(icmp[4:], id)
+	binary.BigEndian.PutUint16(icmp[6:], seq)
+	copy(icmp[8:], pingPayload)
+	binary.BigEndian.PutUint16(icmp[2:], icmpv6Checksum(pkt))
+	return pkt
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"syscall"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
 	"github.com/quic-go/quic-go"
@@ -16,8 +17,12 @@ import (
 	"github.com/yosida95/uritemplate/v3"
 )
 
+// ErrLoginFailed is returned by ConnectTunnel when the server rejects our TLS key and certificate.
+var ErrLoginFailed = errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+
 // PrepareTlsConfig creates a TLS configuration using the provided certificate and SNI (Server Name Indication).
-// It also verifies the peer's public key against the provided public key.
+// It also verifies the peer's public key against the provided public key. Session tickets are kept in memory,
+// so that reconnects resume the TLS session; set ClientSessionCache to a FileSessionCache to keep them across restarts.
 //
 // Parameters:
 //   - privKey: *ecdsa.PrivateKey - The private key to use for TLS authentication.
@@ -36,8 +41,9 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 				PrivateKey:  privKey,
 			},
 		},
-		ServerName: sni,
-		NextProtos: []string{http3.NextProtoH3},
+		ServerName:         sni,
+		NextProtos:         []string{http3.NextProtoH3},
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
 		// WARN: SNI is usually not for the endpoint, so we must skip verification
 		InsecureSkipVerify: true,
 		// we pin to the endpoint public key
@@ -91,32 +97,29 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 //   - *http.Response: The response from the Connect-IP handshake.
 //   - error: An error if the connection setup fails.
 func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
-	var udpConn *net.UDPConn
-	var err error
-	if endpoint.IP.To4() == nil {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-	} else {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 0,
-		})
-	}
+	udpConn, _, tr, ipConn, rsp, err := connectTunnel(ctx, tlsConfig, quicConfig, connectUri, endpoint, 0)
+	return udpConn, tr, ipConn, rsp, err
+}
+
+// connectTunnel is ConnectTunnel with the firewall mark to set on the UDP socket, 0 for none.
+// It also returns the QUIC connection the Connect-IP connection runs on.
+func connectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr, fwmark uint32) (*net.UDPConn, *quic.Conn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	udpConn, err := listenUDP(endpoint, fwmark)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		return udpConn, nil, nil, nil, nil, err
 	}
 
-	conn, err := quic.Dial(
+	// Unlike quic.Dial, a transport of our own gives the connection IDs, without which
+	// the connection couldn't be migrated to another socket later
+	qtr := &quic.Transport{Conn: udpConn}
+	conn, err := qtr.Dial(
 		ctx,
-		udpConn,
 		endpoint,
 		tlsConfig,
 		quicConfig,
 	)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		return udpConn, nil, nil, nil, nil, err
 	}
 
 	tr := &http3.Transport{
@@ -141,10 +144,56 @@ func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.
 	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, "cf-connect-ip", additionalHeaders, true)
 	if err != nil {
 		if err.Error() == "CRYPTO_ERROR 0x131 (remote): tls: access denied" {
-			return udpConn, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+			return udpConn, nil, nil, nil, nil, ErrLoginFailed
 		}
-		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
+		return udpConn, nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
 	}
 
-	return udpConn, tr, ipConn, rsp, nil
+	return udpConn, conn, tr, ipConn, rsp, nil
+}
+
+// listenUDP opens the UDP socket of a MASQUE connection to endpoint.
+//
+// Parameters:
+//   - endpoint: *net.UDPAddr - The UDP address of the QUIC server, which decides the address family.
+//   - fwmark: uint32 - The firewall mark (SO_MARK) to set on the socket, 0 for none. Linux only.
+//
+// Returns:
+//   - *net.UDPConn: The opened socket.
+//   - error: An error if the socket can't be opened or marked.
+func listenUDP(endpoint *net.UDPAddr, fwmark uint32) (*net.UDPConn, error) {
+	laddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+	if endpoint.IP.To4() == nil {
+		laddr.IP = net.IPv6zero
+	}
+
+	lc := net.ListenConfig{Control: markSocket(fwmark)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// markSocket returns the Control function of a net.ListenConfig or net.Dialer that sets the
+// firewall mark of the socket.
+//
+// Parameters:
+//   - fwmark: uint32 - The firewall mark (SO_MARK) to set, 0 for none. Linux only.
+//
+// Returns:
+//   - func(string, string, syscall.RawConn) error: The Control function, nil if fwmark is 0.
+func markSocket(fwmark uint32) func(network, address string, c syscall.RawConn) error {
+	if fwmark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var markErr error
+		if err := c.Control(func(fd uintptr) {
+			markErr = setFwMark(fd, fwmark)
+		}); err != nil {
+			return err
+		}
+		return markErr
+	}
 }
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// testServer is a MASQUE server on the loopback interface.
+type testServer struct {
+	// endpoint is the address the server listens on.
+	endpoint *net.UDPAddr
+	// tlsConfig is a client TLS configuration pinned to the key of the server.
+	tlsConfig *tls.Config
+}
+
+// newTestServer starts a MASQUE server on the loopback interface that is stopped along with tb.
+// The packets it receives through connect-ip are sent to packets, or dropped if it is nil.
+func newTestServer(tb testing.TB, packets chan<- []byte) *testServer {
+	tb.Helper()
+	return startTestServer(tb, packets, nil, nil)
+}
+
+// newFloodingTestServer starts a MASQUE server like newTestServer that drops the packets it
+// receives, and sends copies of pkt through every connect-ip connection as fast as it can once
+// start is closed.
+func newFloodingTestServer(tb testing.TB, pkt []byte, start <-chan struct{}) *testServer {
+	tb.Helper()
+	return startTestServer(tb, nil, pkt, start)
+}
+
+// startTestServer starts the server of newTestServer and newFloodingTestServer.
+func startTestServer(tb testing.TB, packets chan<- []byte, flood []byte, start <-chan struct{}) *testServer {
+	tb.Helper()
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	clientCert, err := internal.GenerateCert(clientKey, &clientKey.PublicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tlsConfig, err := PrepareTlsConfig(clientKey, &serverKey.PublicKey, clientCert, internal.ConnectSNI)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	template := uritemplate.MustNew(internal.ConnectURI)
+	var proxy connectip.Proxy
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: serverCert, PrivateKey: serverKey}},
+		}),
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, err := connectip.ParseRequest(r, template, "cf-connect-ip")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			conn, err := proxy.Proxy(w, req)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if flood != nil {
+				go func() {
+					<-start
+					// WritePacket decrements the TTL in place
+					pkt := make([]byte, len(flood))
+					for {
+						copy(pkt, flood)
+						if _, err := conn.WritePacket(pkt); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			buf := make([]byte, 1<<16)
+			for {
+				n, err := conn.ReadPacket(buf, true)
+				if err != nil {
+					return
+				}
+				if packets != nil {
+					packets <- slices.Clone(buf[:n])
+				}
+			}
+		}),
+	}
+	go server.Serve(udpConn)
+	tb.Cleanup(func() {
+		server.Close()
+		udpConn.Close()
+	})
+
+	return &testServer{
+		endpoint:  udpConn.LocalAddr().(*net.UDPAddr),
+		tlsConfig: tlsConfig,
+	}
+}
+
+// testPacket builds an IPv4 UDP packet of size bytes from 10.0.0.1 to 10.0.0.2.
+func testPacket(size int) []byte {
+	pkt := make([]byte, size)
+	pkt[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(pkt[2:], uint16(size))
+	pkt[8] = 64 // TTL
+	pkt[9] = 17 // UDP
+	copy(pkt[12:16], []byte{10, 0, 0, 1})
+	copy(pkt[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+
+	udp := pkt[20:]
+	binary.BigEndian.PutUint16(udp[0:], 1234)
+	binary.BigEndian.PutUint16(udp[2:], 5678)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	return pkt
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// networkSettleDelay is how long to wait for further changes of the network after the first
+	// one before looking at the path to the server, changes usually come in bursts.
+	networkSettleDelay = 500 * time.Millisecond
+	// migrationTimeout is how long validating the new path to the server may take before the
+	// tunnel reconnects instead.
+	migrationTimeout = 5 * time.Second
+	// maxMigrations is how often a connection is migrated before the tunnel reconnects instead.
+	// The socket of an earlier path can't be closed without closing the connection, and every path
+	// takes up one of the connection IDs the server issued for good, so after a few migrations
+	// there is none left for the next one anyway. Reconnecting releases all of them.
+	maxMigrations = 2
+)
+
+// ErrMigrationFailed is the error a connection is torn down with when it couldn't be migrated to
+// the new network after the local address changed, or has been migrated too often already.
+var ErrMigrationFailed = errors.New("connection migration failed")
+
+// followNetwork migrates the QUIC connection of session to a new socket whenever the local address
+// used to reach the server changes, e.g. when switching to another Wi-Fi network, until the
+// session fails. If the migration fails, the session is failed with ErrMigrationFailed.
+func (t *Tunnel) followNetwork(session *tunnelSession) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-session.failed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// The sockets of earlier paths stay open, closing one closes the connection along with it.
+	// There are no more than maxMigrations of them.
+	var transports []*quic.Transport
+	defer func() {
+		for _, tr := range transports {
+			tr.Close()
+			tr.Conn.Close()
+		}
+	}()
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		if err := watchNetwork(ctx, changes); err != nil {
+			log.Printf("Failed to watch for network changes, the connection won't be migrated: %v", err)
+		}
+	}()
+
+	local, _ := routeSource(session.endpoint, t.config.FwMark)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		}
+		timer := time.NewTimer(networkSettleDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case <-changes:
+		default:
+		}
+
+		source, err := routeSource(session.endpoint, t.config.FwMark)
+		if err != nil || source == local || t.isTunnelAddress(source) {
+			// Without a route to the server there is nothing to migrate to yet, and a route
+			// through the tunnel itself is the routes of the device being set up
+			continue
+		}
+
+		if len(transports) >= maxMigrations {
+			session.fail(fmt.Errorf("%w: local address changed from %s to %s after %d migrations already", ErrMigrationFailed, local, source, len(transports)))
+			return
+		}
+
+		log.Printf("Local address changed from %s to %s, migrating connection to %s...", local, source, session.endpoint)
+		tr, err := t.migrate(ctx, session)
+		if err != nil {
+			if ctx.Err() == nil {
+				session.fail(fmt.Errorf("%w: %v", ErrMigrationFailed, err))
+			}
+			return
+		}
+		transports = append(transports, tr)
+		local = source
+		t.counters.migrations.Add(1)
+		log.Printf("Migrated connection to %s", session.endpoint)
+	}
+}
+
+// migrate moves the QUIC connection of session to a new socket: the path through the socket is
+// validated by the server before the connection switches to it.
+//
+// Parameters:
+//   - ctx: context.Context - The context bounding the migration.
+//   - session: *tunnelSession - The session to migrate.
+//
+// Returns:
+//   - *quic.Transport: The transport of the new socket, which must be closed with the session.
+//   - error: An error if the server doesn't allow migration or the new path couldn't be validated.
+func (t *Tunnel) migrate(ctx context.Context, session *tunnelSession) (*quic.Transport, error) {
+	udpConn, err := listenUDP(session.endpoint, t.config.FwMark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open socket: %v", err)
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	path, err := session.quicConn.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+	if err = path.Probe(ctx); err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		path.Close()
+		tr.Close()
+		udpConn.Close()
+		return nil, fmt.Errorf("failed to validate new path: %v", err)
+	}
+	return tr, nil
+}
+
+// isTunnelAddress reports whether addr is an address of the tunnel itself.
+func (t *Tunnel) isTunnelAddress(addr netip.Addr) bool {
+	t.addrMu.Lock()
+	defer t.addrMu.Unlock()
+	for _, prefix := range t.assigned {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, local := range t.config.LocalAddresses {
+		if local == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// routeSource returns the local address the host sends packets to endpoint from. Connecting a UDP
+// socket looks up the route without sending anything.
+//
+// Parameters:
+//   - endpoint: *net.UDPAddr - The address of the server.
+//   - fwmark: uint32 - The firewall mark of the MASQUE socket, which policy routing may depend on.
+//
+// Returns:
+//   - netip.Addr: The local address.
+//   - error: An error if there is no route to endpoint.
+func routeSource(endpoint *net.UDPAddr, fwmark uint32) (netip.Addr, error) {
+	dialer := net.Dialer{Control: markSocket(fwmark)}
+	conn, err := dialer.Dial("udp", endpoint.String())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
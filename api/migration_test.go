@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// TestMigrate migrates a loopback connection as often as followNetwork allows and checks that it
+// keeps working after every migration.
+func TestMigrate(t *testing.T) {
+	packets := make(chan []byte, 16)
+	server := newTestServer(t, packets)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	udpConn, quicConn, tr, ipConn, _, err := connectTunnel(ctx, server.tlsConfig, internal.DefaultQuicConfig(30*time.Second, 1242), internal.ConnectURI, server.endpoint, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &tunnelSession{endpoint: server.endpoint, udpConn: udpConn, quicConn: quicConn, tr: tr, ipConn: ipConn}
+	defer session.close()
+
+	tunnel := &Tunnel{}
+	for i := range maxMigrations {
+		tr, err := tunnel.migrate(ctx, session)
+		if err != nil {
+			t.Fatalf("migration %d failed: %v", i+1, err)
+		}
+		defer tr.Conn.Close()
+		defer tr.Close()
+
+		if _, err := ipConn.WritePacket(testPacket(100)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-packets:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no packet arrived after migration %d", i+1)
+		}
+	}
+}
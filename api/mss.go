@@ -0,0 +1,87 @@
+package api
+
+import "encoding/binary"
+
+const (
+	// tcpOptionMSS is the kind of the TCP maximum segment size option.
+	tcpOptionMSS = 2
+	// tcpFlagSYN is set on SYN and SYN-ACK packets.
+	tcpFlagSYN = 0x02
+)
+
+// clampMSS lowers the MSS option of a TCP SYN or SYN-ACK packet, so that neither side of the
+// connection sends segments that don't fit into the MTU. The TCP checksum is updated accordingly.
+// Other packets, fragments and IPv6 packets with extension headers are left alone.
+//
+// Parameters:
+//   - pkt: []byte - The IPv4 or IPv6 packet, modified in place.
+//   - mtu: int - The MTU the segments have to fit into.
+//
+// Returns:
+//   - bool: Whether the MSS was lowered.
+func clampMSS(pkt []byte, mtu int) bool {
+	var tcp []byte
+	var maxMSS int
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if pkt[9] != 6 || binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 || ihl < 20 || len(pkt) < ihl {
+			return false
+		}
+		tcp, maxMSS = pkt[ihl:], mtu-40
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		if pkt[6] != 6 {
+			return false
+		}
+		tcp, maxMSS = pkt[40:], mtu-60
+	default:
+		return false
+	}
+
+	if len(tcp) < 20 || tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return false
+	}
+
+	for i := 20; i < dataOffset; {
+		switch tcp[i] {
+		case 0: // End of option list
+			return false
+		case 1: // No-operation
+			i++
+			continue
+		}
+		if i+1 >= dataOffset || tcp[i+1] < 2 || i+int(tcp[i+1]) > dataOffset {
+			return false
+		}
+		if tcp[i] == tcpOptionMSS && tcp[i+1] == 4 {
+			at := i + 2
+			mss := binary.BigEndian.Uint16(tcp[at:])
+			if int(mss) <= maxMSS {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[at:], uint16(maxMSS))
+			updateChecksum(tcp[16:18], at, mss, uint16(maxMSS))
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// updateChecksum incrementally updates an internet checksum after a 16-bit field at offset
+// changed from old to new (RFC 1624). A field at an odd offset straddles two 16-bit words,
+// which adds up to its byte swapped value.
+func updateChecksum(checksum []byte, offset int, old, new uint16) {
+	if offset%2 != 0 {
+		old, new = old>>8|old<<8, new>>8|new<<8
+	}
+	sum := uint32(^binary.BigEndian.Uint16(checksum)) + uint32(^old) + uint32(new)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(checksum, ^uint16(sum))
+}
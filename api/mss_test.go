@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// tcpChecksum computes the checksum the TCP segment of pkt has to carry.
+func tcpChecksum(pkt []byte) uint16 {
+	hdr := headerLen(pkt)
+	addrs := pkt[12:20]
+	if hdr == 40 {
+		addrs = pkt[8:40]
+	}
+	tcp := bytes.Clone(pkt[hdr:])
+	binary.BigEndian.PutUint16(tcp[16:], 0)
+	return checksum(tcp, uint32(^checksum(addrs, 0))+uint32(len(tcp))+6)
+}
+
+// tcpPacket builds a TCP packet from src to dst with the given flags and options, which have to be
+// padded to a multiple of 4 bytes, and an odd-sized payload, with a valid checksum.
+func tcpPacket(src, dst netip.Addr, flags byte, options []byte) []byte {
+	tcp := make([]byte, 20, 20+len(options)+5)
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], 0x01020304)
+	tcp[12] = byte((20+len(options))/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 64240)
+	tcp = append(tcp, options...)
+	tcp = append(tcp, "hello"...)
+
+	pkt := ipPacket(src, dst, 6, tcp)
+	binary.BigEndian.PutUint16(pkt[headerLen(pkt)+16:], tcpChecksum(pkt))
+	return pkt
+}
+
+// TestClampMSS checks which packets get their MSS lowered, and that the checksum of those that do
+// matches a full recompute.
+func TestClampMSS(t *testing.T) {
+	var (
+		src4 = netip.MustParseAddr("10.0.0.1")
+		dst4 = netip.MustParseAddr("1.1.1.1")
+		src6 = netip.MustParseAddr("fd00::1")
+		dst6 = netip.MustParseAddr("2606:4700:4700::1111")
+	)
+	const (
+		syn    = tcpFlagSYN
+		synAck = tcpFlagSYN | 0x10
+		ack    = 0x10
+		mtu    = 1280
+	)
+	mss := func(v uint16) []byte { return binary.BigEndian.AppendUint16([]byte{tcpOptionMSS, 4}, v) }
+	opts := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		// wantMSS is the MSS after clamping, 0 if the packet has to be left alone
+		wantMSS uint16
+	}{
+		{name: "IPv4 SYN above the clamp", pkt: tcpPacket(src4, dst4, syn, mss(1460)), wantMSS: mtu - 40},
+		{name: "IPv4 SYN-ACK above the clamp", pkt: tcpPacket(dst4, src4, synAck, mss(1460)), wantMSS: mtu - 40},
+		{name: "IPv6 SYN above the clamp", pkt: tcpPacket(src6, dst6, syn, mss(1440)), wantMSS: mtu - 60},
+		{name: "IPv6 SYN-ACK above the clamp", pkt: tcpPacket(dst6, src6, synAck, mss(1440)), wantMSS: mtu - 60},
+		{
+			name:    "MSS at an odd offset after a no-operation",
+			pkt:     tcpPacket(src4, dst4, syn, opts([]byte{1}, mss(1460), []byte{1, 1, 0})),
+			wantMSS: mtu - 40,
+		},
+		{
+			name:    "MSS after window scale and SACK permitted",
+			pkt:     tcpPacket(src6, dst6, syn, opts([]byte{3, 3, 7, 4, 2}, mss(65535), []byte{0, 0, 0})),
+			wantMSS: mtu - 60,
+		},
+		{name: "IPv4 SYN below the clamp", pkt: tcpPacket(src4, dst4, syn, mss(1200))},
+		{name: "IPv4 SYN at the clamp", pkt: tcpPacket(src4, dst4, syn, mss(mtu-40))},
+		{name: "IPv6 SYN below the clamp", pkt: tcpPacket(src6, dst6, syn, mss(1200))},
+		{name: "IPv4 SYN without options", pkt: tcpPacket(src4, dst4, syn, nil)},
+		{name: "IPv6 SYN without MSS", pkt: tcpPacket(src6, dst6, syn, []byte{1, 1, 4, 2, 3, 3, 7, 0})},
+		{name: "MSS after the end of the option list", pkt: tcpPacket(src4, dst4, syn, opts([]byte{0, 1, 1, 1}, mss(1460)))},
+		{name: "not a SYN", pkt: tcpPacket(src4, dst4, ack, mss(1460))},
+		{name: "MSS option of the wrong length", pkt: tcpPacket(src4, dst4, syn, []byte{tcpOptionMSS, 3, 0x05, 0xb4})},
+		{name: "option of length zero", pkt: tcpPacket(src4, dst4, syn, opts([]byte{3, 0, 1, 1}, mss(1460)))},
+		{name: "MSS running past the options", pkt: tcpPacket(src4, dst4, syn, []byte{1, 1, 1, tcpOptionMSS})},
+		{
+			name: "options cut off by the end of the packet",
+			pkt:  tcpPacket(src4, dst4, syn, mss(1460))[:20+22],
+		},
+		{
+			name: "data offset below the header size",
+			pkt: func() []byte {
+				pkt := tcpPacket(src4, dst4, syn, mss(1460))
+				pkt[20+12] = 4 << 4
+				return pkt
+			}(),
+		},
+		{
+			name: "TCP header cut off",
+			pkt:  tcpPacket(src4, dst4, syn, mss(1460))[:20+19],
+		},
+		{
+			name: "IPv4 fragment",
+			pkt: func() []byte {
+				pkt := tcpPacket(src4, dst4, syn, mss(1460))
+				binary.BigEndian.PutUint16(pkt[6:], 185)
+				return pkt
+			}(),
+		},
+		{
+			name: "IPv6 extension header",
+			pkt: func() []byte {
+				pkt := tcpPacket(src6, dst6, syn, mss(1460))
+				pkt[6] = 0 // Hop-by-hop options
+				return pkt
+			}(),
+		},
+		{name: "UDP", pkt: udpPacket(src4, dst4)},
+		{name: "IPv4 header cut off", pkt: tcpPacket(src4, dst4, syn, mss(1460))[:19]},
+		{name: "IPv6 header cut off", pkt: tcpPacket(src6, dst6, syn, mss(1460))[:39]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := bytes.Clone(tt.pkt)
+			clamped := clampMSS(tt.pkt, mtu)
+
+			if tt.wantMSS == 0 {
+				if clamped {
+					t.Error("clampMSS reported a clamped MSS")
+				}
+				if !bytes.Equal(tt.pkt, orig) {
+					t.Errorf("packet changed from\n%x to\n%x", orig, tt.pkt)
+				}
+				return
+			}
+
+			if !clamped {
+				t.Fatal("clampMSS left the MSS alone")
+			}
+			// The options of the cases that get clamped hold no other kind 2, length 4 sequence
+			at := headerLen(orig) + 20 + bytes.Index(orig[headerLen(orig)+20:], []byte{tcpOptionMSS, 4}) + 2
+			if got := binary.BigEndian.Uint16(tt.pkt[at:]); got != tt.wantMSS {
+				t.Errorf("MSS is %d, want %d", got, tt.wantMSS)
+			}
+			if got, want := binary.BigEndian.Uint16(tt.pkt[headerLen(tt.pkt)+16:]), tcpChecksum(tt.pkt); got != want {
+				t.Errorf("checksum is %#04x, a full recompute gives %#04x", got, want)
+			}
+			want := bytes.Clone(tt.pkt)
+			copy(want[at:at+2], orig[at:at+2])
+			copy(want[headerLen(want)+16:], orig[headerLen(orig)+16:headerLen(orig)+18])
+			if !bytes.Equal(want, orig) {
+				t.Errorf("bytes other than the MSS and the checksum changed")
+			}
+		})
+	}
+}
+
+// TestUpdateChecksum checks the incremental update of a checksum after a 16-bit field changed,
+// at even and odd offsets, against a full recompute.
+func TestUpdateChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int
+		new    uint16
+	}{
+		{"even offset", []byte{0x45, 0x00, 0x05, 0xb4, 0x12, 0x34, 0xab, 0xcd}, 2, 0x04d8},
+		{"odd offset", []byte{0x01, 0x02, 0x04, 0x05, 0xb4, 0x01, 0x01, 0x00}, 3, 0x04d8},
+		{"odd offset at the end of an odd-sized buffer", []byte{0x01, 0x02, 0x03, 0xff, 0xff}, 3, 0x0001},
+		{"unchanged value", []byte{0x12, 0x34, 0x56, 0x78}, 0, 0x1234},
+		{"carry out of the sum", []byte{0xff, 0xff, 0xff, 0xfe, 0xff, 0xff}, 2, 0xffff},
+		{"to zero", []byte{0xff, 0xff, 0x00, 0x01, 0x80, 0x00}, 0, 0x0000},
+		{"from zero", []byte{0x00, 0x00, 0x00, 0x01, 0x80, 0x00}, 0, 0xffff},
+		{"everything zero", []byte{0x00, 0x00, 0x00, 0x00}, 2, 0x0001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Clone(tt.data)
+			cs := binary.BigEndian.AppendUint16(nil, checksum(data, 0))
+
+			old := binary.BigEndian.Uint16(data[tt.offset:])
+			binary.BigEndian.PutUint16(data[tt.offset:], tt.new)
+			updateChecksum(cs, tt.offset, old, tt.new)
+
+			if got, want := binary.BigEndian.Uint16(cs), checksum(data, 0); got != want {
+				t.Errorf("checksum is %#04x, a full recompute gives %#04x", got, want)
+			}
+		})
+	}
+}
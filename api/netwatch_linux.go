@@ -0,0 +1,64 @@
+//go:build linux
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// watchNetwork signals on changes whenever an address or a route of the host changes, until ctx is
+// done. Signals are dropped while one is pending.
+//
+// Parameters:
+//   - ctx: context.Context - The context controlling how long to watch.
+//   - changes: chan<- struct{} - The channel to signal on, buffered.
+//
+// Returns:
+//   - error: An error if the netlink subscriptions failed.
+func watchNetwork(ctx context.Context, changes chan<- struct{}) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	addrs := make(chan netlink.AddrUpdate)
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		return fmt.Errorf("failed to subscribe to address changes: %v", err)
+	}
+	defer drain(addrs)
+	routes := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(routes, done); err != nil {
+		return fmt.Errorf("failed to subscribe to route changes: %v", err)
+	}
+	defer drain(routes)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-addrs:
+			if !ok {
+				return errors.New("address subscription closed")
+			}
+		case _, ok := <-routes:
+			if !ok {
+				return errors.New("route subscription closed")
+			}
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// drain discards the updates of a netlink subscription in the background, which blocks on sending
+// them until it noticed that it was cancelled and closed ch.
+func drain[T any](ch <-chan T) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
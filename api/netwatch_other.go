@@ -0,0 +1,38 @@
+//go:build !linux
+
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// networkPollInterval is how often the path to the server is checked where changes of the network
+// can't be watched.
+const networkPollInterval = 5 * time.Second
+
+// watchNetwork signals on changes every networkPollInterval until ctx is done, there is no portable
+// way to watch for changes of the addresses and routes of the host. Signals are dropped while one
+// is pending.
+//
+// Parameters:
+//   - ctx: context.Context - The context controlling how long to watch.
+//   - changes: chan<- struct{} - The channel to signal on, buffered.
+//
+// Returns:
+//   - error: Always nil.
+func watchNetwork(ctx context.Context, changes chan<- struct{}) error {
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
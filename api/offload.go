@@ -0,0 +1,133 @@
+package api
+
+import (
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	// offloadHeadroom is the room left in front of written packets for the virtio net header.
+	offloadHeadroom = 10
+	// offloadBufferSize is the size of the buffers packets are coalesced in, the largest IP packet.
+	offloadBufferSize = 1<<16 - 1
+)
+
+// BatchTunnelDevice is a TunnelDevice that can move several packets per call.
+// The tunnel uses the batch methods whenever BatchSize is larger than 1.
+type BatchTunnelDevice interface {
+	TunnelDevice
+	// BatchSize returns the maximum number of packets read or written in a single call.
+	BatchSize() int
+	// ReadPackets reads one or more packets into bufs and stores their sizes in sizes.
+	// It returns the number of packets read. len(bufs) should be at least BatchSize.
+	ReadPackets(bufs [][]byte, sizes []int) (int, error)
+	// WritePackets writes packets to the device. len(pkts) must not exceed BatchSize.
+	WritePackets(pkts [][]byte) error
+}
+
+// OffloadAdapter wraps a tun.Device that exchanges packets with a virtio net header, like the
+// Linux TUN device of wireguard-go opened with IFF_VNET_HDR, to satisfy BatchTunnelDevice.
+// The kernel hands over TCP and UDP segments of a flow as one large packet (GSO), which reads
+// split into MTU sized packets again, and writes coalesce packets of a flow before handing
+// them to the kernel (GRO). Both cut down the number of syscalls by a lot.
+type OffloadAdapter struct {
+	dev tun.Device
+	mtu int
+
+	readMu    sync.Mutex
+	readBufs  [][]byte
+	readSizes []int
+	// next and count describe the packets of readBufs that ReadPacket hasn't returned yet.
+	next, count int
+
+	writeMu   sync.Mutex
+	writeBufs [][]byte
+}
+
+// NewOffloadAdapter creates a new OffloadAdapter.
+//
+// Parameters:
+//   - dev: tun.Device - The device, which must expect a virtio net header in front of written packets.
+//   - mtu: int - The MTU of the device.
+//
+// Returns:
+//   - BatchTunnelDevice: The adapter.
+func NewOffloadAdapter(dev tun.Device, mtu int) BatchTunnelDevice {
+	return &OffloadAdapter{dev: dev, mtu: mtu}
+}
+
+func (o *OffloadAdapter) BatchSize() int {
+	return o.dev.BatchSize()
+}
+
+// ReadPacket reads a single packet. The other packets of a split up large packet are kept
+// for the following calls.
+func (o *OffloadAdapter) ReadPacket(buf []byte) (int, error) {
+	o.readMu.Lock()
+	defer o.readMu.Unlock()
+
+	if o.readBufs == nil {
+		o.readBufs = make([][]byte, o.dev.BatchSize())
+		for i := range o.readBufs {
+			o.readBufs[i] = make([]byte, o.mtu)
+		}
+		o.readSizes = make([]int, len(o.readBufs))
+	}
+	for o.next == o.count {
+		n, err := o.dev.Read(o.readBufs, o.readSizes, 0)
+		if err != nil {
+			return 0, err
+		}
+		o.next, o.count = 0, n
+	}
+
+	n := copy(buf, o.readBufs[o.next][:o.readSizes[o.next]])
+	o.next++
+	return n, nil
+}
+
+func (o *OffloadAdapter) ReadPackets(bufs [][]byte, sizes []int) (int, error) {
+	o.readMu.Lock()
+	defer o.readMu.Unlock()
+
+	// Packets left over by ReadPacket come first
+	if o.next < o.count {
+		n := 0
+		for ; n < len(bufs) && o.next < o.count; n++ {
+			sizes[n] = copy(bufs[n], o.readBufs[o.next][:o.readSizes[o.next]])
+			o.next++
+		}
+		return n, nil
+	}
+
+	return o.dev.Read(bufs, sizes, 0)
+}
+
+// Close closes the wrapped device.
+func (o *OffloadAdapter) Close() error {
+	return o.dev.Close()
+}
+
+func (o *OffloadAdapter) WritePacket(pkt []byte) error {
+	return o.WritePackets([][]byte{pkt})
+}
+
+// WritePackets copies pkts into buffers with room for the virtio net header and for coalescing
+// them, then writes them.
+func (o *OffloadAdapter) WritePackets(pkts [][]byte) error {
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+
+	for len(o.writeBufs) < len(pkts) {
+		o.writeBufs = append(o.writeBufs, make([]byte, offloadHeadroom+offloadBufferSize))
+	}
+	bufs := o.writeBufs[:len(pkts)]
+	for i, pkt := range pkts {
+		bufs[i] = bufs[i][:cap(bufs[i])]
+		bufs[i] = bufs[i][:offloadHeadroom+copy(bufs[i][offloadHeadroom:], pkt)]
+	}
+
+	_, err := o.dev.Write(bufs, offloadHeadroom)
+	return err
+}
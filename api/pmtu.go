@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// minIPv6MTU is the smallest MTU an IPv6 link may have (RFC 8200).
+	minIPv6MTU = 1280
+	// datagramOverhead is what HTTP Datagrams of the Connect-IP request put in front of a packet:
+	// the quarter stream ID of the request stream, the first one of the connection, and the
+	// context ID, one byte each.
+	datagramOverhead = 2
+	// quicPacketOverhead is what a QUIC packet carrying nothing but a DATAGRAM frame adds to the
+	// frame's data: the short header with the longest possible connection ID and packet number,
+	// the AEAD tag, and the type and the length of the frame.
+	quicPacketOverhead = 1 + 20 + 4 + 16 + 1 + 2
+	// quicEstimateOverhead is what quic-go subtracts from the packet size for its initial estimate
+	// of the largest datagram: the header with the longest connection ID and the AEAD tag.
+	quicEstimateOverhead = 1 + 20 + 16
+	// quicDefaultPacketSize and quicMinPacketSize are the initial packet size quic-go uses if
+	// none is configured, and the smallest one it accepts.
+	quicDefaultPacketSize = 1280
+	quicMinPacketSize     = 1200
+	// pathMTUPollInterval is how often the datagram limit of a connection is checked while it
+	// may still grow.
+	pathMTUPollInterval = time.Second
+)
+
+// pathMTUProbe is larger than any QUIC packet, see datagramLimit.
+var pathMTUProbe = make([]byte, 1<<16)
+
+// datagramLimit returns the size of the largest packet that currently fits into a datagram of
+// conn. quic-go probes the path to the server for larger packet sizes (DPLPMTUD, RFC 8899) and
+// raises the limit whenever a probe is acknowledged. Asking it to send a datagram larger than any
+// packet makes it report the limit without sending anything.
+//
+// The limit quic-go reports is an estimate of the datagram size until a probe succeeded, but the
+// size of the whole QUIC packet afterwards, and its packer silently drops datagrams that don't
+// fit. So the reported limit is turned back into a packet size first, which is larger than the
+// initial one only once a probe succeeded, and the overhead of the packet is subtracted from it.
+//
+// Parameters:
+//   - conn: *quic.Conn - The QUIC connection of the session.
+//   - initialPacketSize: uint16 - The InitialPacketSize of the QUIC configuration of conn.
+//
+// Returns:
+//   - int: The largest packet that fits.
+//   - bool: Whether the limit is known, false if the connection doesn't support datagrams.
+func datagramLimit(conn *quic.Conn, initialPacketSize uint16) (int, bool) {
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(conn.SendDatagram(pathMTUProbe), &tooLarge) {
+		return 0, false
+	}
+
+	initial := int(initialPacketSize)
+	if initial == 0 {
+		initial = quicDefaultPacketSize
+	}
+	initial = max(initial, quicMinPacketSize)
+
+	reported := int(tooLarge.MaxDatagramPayloadSize)
+	packetSize := reported
+	if reported < initial {
+		packetSize = reported + quicEstimateOverhead
+	}
+	// The peer may allow even smaller datagrams than fit into a packet, which quic-go reports as is
+	return min(reported, packetSize-quicPacketOverhead) - datagramOverhead, true
+}
+
+// packetTooBig builds the ICMP Fragmentation Needed (IPv4) or Packet Too Big (IPv6) message
+// telling the sender of pkt to send packets of at most mtu bytes. Like the replies of
+// connect-ip-go, it appears to come from the destination of pkt.
+//
+// Parameters:
+//   - pkt: []byte - The IPv4 or IPv6 packet that is too big.
+//   - mtu: int - The MTU to report.
+//
+// Returns:
+//   - []byte: The ICMP packet, nil if pkt is no valid IP packet.
+func packetTooBig(pkt []byte, mtu int) []byte {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		// The IP header and the first 8 bytes of the payload are quoted (RFC 792)
+		quote := pkt[:min(len(pkt), int(pkt[0]&0x0f)*4+8)]
+		reply := make([]byte, 20+8+len(quote))
+		reply[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(reply[2:], uint16(len(reply)))
+		reply[8] = 64 // TTL
+		reply[9] = 1  // ICMP
+		copy(reply[12:16], pkt[16:20])
+		copy(reply[16:20], pkt[12:16])
+		binary.BigEndian.PutUint16(reply[10:], checksum(reply[:20], 0))
+
+		icmp := reply[20:]
+		icmp[0], icmp[1] = 3, 4 // Destination Unreachable, Fragmentation Needed
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+		return reply
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		// As much of the packet is quoted as fits into the minimum MTU (RFC 4443)
+		quote := pkt[:min(len(pkt), minIPv6MTU-40-8)]
+		reply := make([]byte, 40+8+len(quote))
+		reply[0] = 6 << 4
+		binary.BigEndian.PutUint16(reply[4:], uint16(8+len(quote)))
+		reply[6] = 58 // ICMPv6
+		reply[7] = 64 // Hop limit
+		copy(reply[8:24], pkt[24:40])
+		copy(reply[24:40], pkt[8:24])
+
+		icmp := reply[40:]
+		icmp[0] = 2 // Packet Too Big
+		binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:], icmpv6Checksum(reply))
+		return reply
+	}
+	return nil
+}
+
+// checksum computes the internet checksum (RFC 1071) of b.
+//
+// Parameters:
+//   - b: []byte - The data to sum up, with the checksum field zeroed.
+//   - initial: uint32 - A partial sum to start from, e.g. of a pseudo header.
+//
+// Returns:
+//   - uint16: The checksum.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// icmpv6Checksum computes the checksum of the ICMPv6 message following the fixed header of pkt,
+// which also covers a pseudo header of the addresses, the length and the next header (RFC 8200).
+//
+// Parameters:
+//   - pkt: []byte - The IPv6 packet, with the checksum field zeroed.
+//
+// Returns:
+//   - uint16: The checksum.
+func icmpv6Checksum(pkt []byte) uint16 {
+	pseudo := uint32(^checksum(pkt[8:40], 0)) + uint32(len(pkt)-40) + 58
+	return checksum(pkt[40:], pseudo)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// TestDatagramLimitFits sends packets of exactly the size datagramLimit reports through a loopback
+// connection, both before and after quic-go's path MTU discovery raised the limit.
+func TestDatagramLimitFits(t *testing.T) {
+	const initialPacketSize = 1242
+
+	packets := make(chan []byte, 16)
+	server := newTestServer(t, packets)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	udpConn, quicConn, tr, ipConn, _, err := connectTunnel(ctx, server.tlsConfig, internal.DefaultQuicConfig(30*time.Second, initialPacketSize), internal.ConnectURI, server.endpoint, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	defer tr.Close()
+	defer ipConn.Close()
+
+	send := func(size int) {
+		t.Helper()
+		icmp, err := ipConn.WritePacket(testPacket(size))
+		if err != nil {
+			t.Fatalf("failed to send packet of %d bytes: %v", size, err)
+		}
+		if icmp != nil {
+			t.Fatalf("packet of %d bytes was rejected as too large", size)
+		}
+		select {
+		case pkt := <-packets:
+			if len(pkt) != size {
+				t.Fatalf("server received %d bytes, sent %d", len(pkt), size)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("packet of %d bytes never arrived", size)
+		}
+	}
+
+	initial, ok := datagramLimit(quicConn, initialPacketSize)
+	if !ok {
+		t.Fatal("datagrams not supported")
+	}
+	send(initial)
+
+	limit := initial
+	for limit == initial {
+		select {
+		case <-ctx.Done():
+			t.Fatal("path MTU discovery never raised the limit")
+		case <-time.After(50 * time.Millisecond):
+		}
+		limit, _ = datagramLimit(quicConn, initialPacketSize)
+	}
+	send(limit)
+}
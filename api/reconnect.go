@@ -0,0 +1,101 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// ReconnectPolicy decides how long a Tunnel waits before reconnecting after a failure
+// and whether it should give up altogether.
+type ReconnectPolicy interface {
+	// NextDelay returns the delay before the given reconnect attempt.
+	// Attempts are counted from 1 and the count is reset whenever a connection succeeds.
+	// If ok is false, the tunnel stops reconnecting and terminates with err.
+	NextDelay(attempt int, err error) (delay time.Duration, ok bool)
+}
+
+// BackoffPolicy is a ReconnectPolicy that grows the delay exponentially between
+// consecutive failed attempts and randomizes it, so that many clients losing their
+// connection at the same time don't reconnect in lockstep.
+type BackoffPolicy struct {
+	// InitialDelay is the delay before the first reconnect attempt.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay. Zero means no cap.
+	MaxDelay time.Duration
+	// Multiplier is the factor the delay grows by after each failed attempt.
+	// Values below 1 are treated as 1, which results in a constant delay.
+	Multiplier float64
+	// Jitter is the fraction (0-1) of the delay that is randomly added or subtracted.
+	Jitter float64
+	// MaxAttempts is the number of consecutive failed attempts after which the policy gives up.
+	// Zero means never give up.
+	MaxAttempts int
+	// IsFatal reports whether an error should stop reconnecting immediately.
+	// If nil, IsFatalError is used.
+	IsFatal func(error) bool
+}
+
+// DefaultReconnectPolicy returns the reconnect policy used when a TunnelConfig doesn't specify one.
+//
+// Returns:
+//   - *BackoffPolicy: A policy starting at 1 second, doubling up to 1 minute with 20% jitter, never giving up.
+func DefaultReconnectPolicy() *BackoffPolicy {
+	return &BackoffPolicy{
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     1 * time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// NextDelay implements ReconnectPolicy.
+func (p *BackoffPolicy) NextDelay(attempt int, err error) (time.Duration, bool) {
+	isFatal := p.IsFatal
+	if isFatal == nil {
+		isFatal = IsFatalError
+	}
+	if isFatal(err) {
+		return 0, false
+	}
+	if p.MaxAttempts > 0 && attempt > p.MaxAttempts {
+		return 0, false
+	}
+
+	multiplier := p.Multiplier
+	if !(multiplier >= 1) { // NaN as well
+		multiplier = 1
+	}
+	delay := float64(max(p.InitialDelay, 0))
+	if delay > 0 && attempt > 1 {
+		delay *= math.Pow(multiplier, float64(attempt-1))
+	}
+	limit := float64(math.MaxInt64)
+	if p.MaxDelay > 0 {
+		limit = float64(p.MaxDelay)
+	}
+	delay = min(delay, limit)
+
+	if jitter := min(max(p.Jitter, 0), 1); jitter > 0 {
+		delay *= 1 + jitter*(2*rand.Float64()-1)
+	}
+
+	// Without a cap the delay outgrows a time.Duration after enough attempts
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64, true
+	}
+	return time.Duration(delay), true
+}
+
+// IsFatalError reports whether err is one that reconnecting can't fix,
+// such as the server rejecting our credentials.
+//
+// Parameters:
+//   - err: error - The error that caused the connection to fail.
+//
+// Returns:
+//   - bool: True if the error is fatal, otherwise false.
+func IsFatalError(err error) bool {
+	return errors.Is(err, ErrLoginFailed)
+}
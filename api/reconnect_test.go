@@ -0,0 +1,207 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestBackoffPolicyNextDelay checks the delays and the give-ups of BackoffPolicy, including the
+// range jitter spreads the delay over and out of range settings.
+func TestBackoffPolicyNextDelay(t *testing.T) {
+	errNetwork := errors.New("network is unreachable")
+	never := func(error) bool { return false }
+
+	tests := []struct {
+		name    string
+		policy  BackoffPolicy
+		attempt int
+		err     error
+		// wantOK is false if the policy has to give up
+		wantOK bool
+		// min and max bound the delay, they are equal without jitter
+		min, max time.Duration
+	}{
+		{
+			name:    "first attempt",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2},
+			attempt: 1, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "fourth attempt",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2},
+			attempt: 4, err: errNetwork, wantOK: true,
+			min: 8 * time.Second, max: 8 * time.Second,
+		},
+		{
+			name:    "capped",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2},
+			attempt: 7, err: errNetwork, wantOK: true,
+			min: time.Minute, max: time.Minute,
+		},
+		{
+			name:    "capped after many attempts",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2},
+			attempt: math.MaxInt, err: errNetwork, wantOK: true,
+			min: time.Minute, max: time.Minute,
+		},
+		{
+			name:    "no cap",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 3},
+			attempt: 11, err: errNetwork, wantOK: true,
+			min: 59049 * time.Second, max: 59049 * time.Second,
+		},
+		{
+			name:    "no cap after many attempts",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2},
+			attempt: 10000, err: errNetwork, wantOK: true,
+			min: math.MaxInt64, max: math.MaxInt64,
+		},
+		{
+			name:    "jitter",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2, Jitter: 0.25},
+			attempt: 3, err: errNetwork, wantOK: true,
+			min: 3 * time.Second, max: 5 * time.Second,
+		},
+		{
+			name:    "jitter on the cap",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2, Jitter: 0.5},
+			attempt: 20, err: errNetwork, wantOK: true,
+			min: 30 * time.Second, max: 90 * time.Second,
+		},
+		{
+			name:    "jitter without a cap after many attempts",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 0.5},
+			attempt: 10000, err: errNetwork, wantOK: true,
+			min: math.MaxInt64 / 2, max: math.MaxInt64,
+		},
+		{
+			name:    "jitter above 1",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 3},
+			attempt: 2, err: errNetwork, wantOK: true,
+			min: 0, max: 4 * time.Second,
+		},
+		{
+			name:    "negative jitter",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: -0.5},
+			attempt: 2, err: errNetwork, wantOK: true,
+			min: 2 * time.Second, max: 2 * time.Second,
+		},
+		{
+			name:    "NaN jitter",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: math.NaN()},
+			attempt: 2, err: errNetwork, wantOK: true,
+			min: 2 * time.Second, max: 2 * time.Second,
+		},
+		{
+			name:    "multiplier below 1",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 0.5},
+			attempt: 5, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "zero multiplier",
+			policy:  BackoffPolicy{InitialDelay: time.Second},
+			attempt: 5, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "NaN multiplier",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: math.NaN()},
+			attempt: 5, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "infinite multiplier",
+			policy:  BackoffPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: math.Inf(1)},
+			attempt: 2, err: errNetwork, wantOK: true,
+			min: time.Minute, max: time.Minute,
+		},
+		{
+			name:    "zero delay with an infinite multiplier",
+			policy:  BackoffPolicy{Multiplier: math.Inf(1)},
+			attempt: 3, err: errNetwork, wantOK: true,
+			min: 0, max: 0,
+		},
+		{
+			name:    "negative delay",
+			policy:  BackoffPolicy{InitialDelay: -time.Second, Multiplier: 2},
+			attempt: 3, err: errNetwork, wantOK: true,
+			min: 0, max: 0,
+		},
+		{
+			name:    "cap below the initial delay",
+			policy:  BackoffPolicy{InitialDelay: time.Minute, MaxDelay: time.Second, Multiplier: 2},
+			attempt: 1, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "attempt zero",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2},
+			attempt: 0, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "negative attempt",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2},
+			attempt: -3, err: errNetwork, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "last attempt",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2, MaxAttempts: 3},
+			attempt: 3, err: errNetwork, wantOK: true,
+			min: 4 * time.Second, max: 4 * time.Second,
+		},
+		{
+			name:    "too many attempts",
+			policy:  BackoffPolicy{InitialDelay: time.Second, Multiplier: 2, MaxAttempts: 3},
+			attempt: 4, err: errNetwork,
+		},
+		{
+			name:    "login failure",
+			policy:  BackoffPolicy{InitialDelay: time.Second},
+			attempt: 1, err: fmt.Errorf("failed to connect: %w", ErrLoginFailed),
+		},
+		{
+			name:    "login failure not fatal",
+			policy:  BackoffPolicy{InitialDelay: time.Second, IsFatal: never},
+			attempt: 1, err: ErrLoginFailed, wantOK: true,
+			min: time.Second, max: time.Second,
+		},
+		{
+			name:    "custom fatal error",
+			policy:  BackoffPolicy{InitialDelay: time.Second, IsFatal: func(err error) bool { return err == errNetwork }},
+			attempt: 1, err: errNetwork,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[time.Duration]bool{}
+			for range 1000 {
+				delay, ok := tt.policy.NextDelay(tt.attempt, tt.err)
+				if ok != tt.wantOK {
+					t.Fatalf("NextDelay returned ok %v, want %v", ok, tt.wantOK)
+				}
+				if !ok {
+					if delay != 0 {
+						t.Errorf("NextDelay gave up with a delay of %v", delay)
+					}
+					return
+				}
+				if delay < tt.min || delay > tt.max {
+					t.Fatalf("NextDelay returned %v, want it between %v and %v", delay, tt.min, tt.max)
+				}
+				seen[delay] = true
+			}
+			// Jitter has to actually spread the delays
+			if tt.min != tt.max && len(seen) < 100 {
+				t.Errorf("NextDelay returned only %d different delays", len(seen))
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSessionCache is a tls.ClientSessionCache that keeps the TLS session tickets in a file, so
+// that even the first connection after a restart can resume a session instead of going through a
+// full handshake with client authentication.
+//
+// The tickets are bound to the key they were obtained with and to the key of the server that issued
+// them, and are dropped when the cache is opened with other keys, e.g. after the key was rotated or
+// the server changed. The file holds the secrets of the sessions and
+// is only readable by its owner.
+type FileSessionCache struct {
+	path string
+	key  string
+
+	mu      sync.Mutex
+	entries map[string]sessionCacheEntry
+}
+
+// sessionCacheFile is the content of the file of a FileSessionCache.
+type sessionCacheFile struct {
+	// Key is the fingerprint of the public keys of the client and the server the sessions were
+	// established between.
+	Key string `json:"key"`
+	// Sessions are the sessions by cache key, usually the server name.
+	Sessions map[string]sessionCacheEntry `json:"sessions"`
+}
+
+// sessionCacheEntry is a session ticket along with the state needed to resume it.
+type sessionCacheEntry struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// NewFileSessionCache opens the session cache stored at path. A missing, unreadable or foreign
+// file results in an empty cache, which replaces the file on the first new session.
+//
+// Parameters:
+//   - path: string - The file to keep the tickets in.
+//   - key: crypto.PublicKey - The public key of the client certificate the sessions authenticate with.
+//   - peerKey: crypto.PublicKey - The public key the server is pinned to.
+//
+// Returns:
+//   - *FileSessionCache: The session cache.
+//   - error: An error if a key can't be marshaled.
+func NewFileSessionCache(path string, key, peerKey crypto.PublicKey) (*FileSessionCache, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	peerDer, err := x509.MarshalPKIXPublicKey(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal peer public key: %v", err)
+	}
+	// Both are DER sequences, so their concatenation is unambiguous
+	fingerprint := sha256.Sum256(append(der, peerDer...))
+
+	c := &FileSessionCache{
+		path:    path,
+		key:     hex.EncodeToString(fingerprint[:]),
+		entries: make(map[string]sessionCacheEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read session cache: %v", err)
+		}
+		return c, nil
+	}
+	var file sessionCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("Failed to parse session cache, starting with an empty one: %v", err)
+		return c, nil
+	}
+	if file.Key == c.key && file.Sessions != nil {
+		c.entries = file.Sessions
+	}
+	return c, nil
+}
+
+// Get implements tls.ClientSessionCache.
+func (c *FileSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[sessionKey]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	state, err := tls.ParseSessionState(entry.State)
+	if err != nil {
+		return nil, false
+	}
+	session, err := tls.NewResumptionState(entry.Ticket, state)
+	if err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+// Put implements tls.ClientSessionCache. A nil session removes the entry.
+func (c *FileSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cs == nil {
+		if _, ok := c.entries[sessionKey]; !ok {
+			return
+		}
+		delete(c.entries, sessionKey)
+	} else {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			return
+		}
+		stateBytes, err := state.Bytes()
+		if err != nil {
+			return
+		}
+		c.entries[sessionKey] = sessionCacheEntry{Ticket: ticket, State: stateBytes}
+	}
+
+	if err := c.save(); err != nil {
+		log.Printf("Failed to save session cache: %v", err)
+	}
+}
+
+// save writes the cache to its file, replacing it atomically. Must be called with c.mu held.
+func (c *FileSessionCache) save() error {
+	data, err := json.Marshal(sessionCacheFile{Key: c.key, Sessions: c.entries})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
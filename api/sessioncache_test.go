@@ -0,0 +1,55 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileSessionCacheKeys checks that the sessions of a cache file are only kept when it is opened
+// with the keys of both the client and the server it was written for.
+func TestFileSessionCacheKeys(t *testing.T) {
+	newKey := func() crypto.PublicKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &key.PublicKey
+	}
+	client, server, otherServer := newKey(), newKey(), newKey()
+
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	cache, err := NewFileSessionCache(path, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.entries["example.com"] = sessionCacheEntry{Ticket: []byte("ticket"), State: []byte("state")}
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		key, peerKey    crypto.PublicKey
+		wantKeptEntries int
+	}{
+		{"same keys", client, server, 1},
+		{"other server", client, otherServer, 0},
+		{"keys swapped", server, client, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := NewFileSessionCache(path, tt.key, tt.peerKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cache.entries) != tt.wantKeptEntries {
+				t.Errorf("cache has %d entries, want %d", len(cache.entries), tt.wantKeptEntries)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats is a snapshot of the traffic counters of a Tunnel.
+// All counters are cumulative over the lifetime of the tunnel.
+type TunnelStats struct {
+	// TxBytes is the number of bytes read from the device and sent through the tunnel.
+	TxBytes uint64
+	// TxPackets is the number of packets read from the device and sent through the tunnel.
+	TxPackets uint64
+	// RxBytes is the number of bytes received through the tunnel and written to the device.
+	RxBytes uint64
+	// RxPackets is the number of packets received through the tunnel and written to the device.
+	RxPackets uint64
+	// DroppedPackets is the number of packets read from the device that couldn't be sent,
+	// either because the tunnel was down or because the write failed.
+	DroppedPackets uint64
+	// ICMPPackets is the number of ICMP replies generated locally and written back to the device.
+	ICMPPackets uint64
+	// Connects is the number of successfully established connections.
+	Connects uint64
+	// Reconnects is the number of reconnect attempts scheduled after a failure.
+	Reconnects uint64
+	// HealthCheckFailures is the number of failed health check probes.
+	HealthCheckFailures uint64
+	// Migrations is the number of times a connection was moved to a new network.
+	Migrations uint64
+}
+
+// tunnelCounters holds the live counters behind TunnelStats.
+type tunnelCounters struct {
+	txBytes             atomic.Uint64
+	txPackets           atomic.Uint64
+	rxBytes             atomic.Uint64
+	rxPackets           atomic.Uint64
+	droppedPackets      atomic.Uint64
+	icmpPackets         atomic.Uint64
+	connects            atomic.Uint64
+	reconnects          atomic.Uint64
+	healthCheckFailures atomic.Uint64
+	migrations          atomic.Uint64
+}
+
+// Stats returns a snapshot of the traffic counters of the tunnel.
+// It is safe to call concurrently with the forwarding loops.
+//
+// Returns:
+//   - TunnelStats: The current counter values.
+func (t *Tunnel) Stats() TunnelStats {
+	return TunnelStats{
+		TxBytes:             t.counters.txBytes.Load(),
+		TxPackets:           t.counters.txPackets.Load(),
+		RxBytes:             t.counters.rxBytes.Load(),
+		RxPackets:           t.counters.rxPackets.Load(),
+		DroppedPackets:      t.counters.droppedPackets.Load(),
+		ICMPPackets:         t.counters.icmpPackets.Load(),
+		Connects:            t.counters.connects.Load(),
+		Reconnects:          t.counters.reconnects.Load(),
+		HealthCheckFailures: t.counters.healthCheckFailures.Load(),
+		Migrations:          t.counters.migrations.Load(),
+	}
+}
+
+// TunnelStatus is a snapshot of the state of a Tunnel.
+type TunnelStatus struct {
+	// State is the current state of the tunnel.
+	State TunnelState
+	// StartedAt is when the tunnel was started. Zero if it wasn't started yet.
+	StartedAt time.Time
+	// Endpoint is the endpoint of the current connection. Nil while not connected.
+	Endpoint *net.UDPAddr
+	// ConnectedAt is when the current connection was established. Zero while not connected.
+	ConnectedAt time.Time
+	// PathMTU is the MTU packets through the current connection have to fit into. Zero while not connected.
+	PathMTU int
+	// Addresses are the addresses last assigned by the server. Nil until it assigned any.
+	Addresses []netip.Prefix
+	// Routes are the prefixes the server last advertised routes to. Nil until it advertised any.
+	Routes []netip.Prefix
+	// Endpoints are the endpoint candidates, the preferred one first.
+	Endpoints []*net.UDPAddr
+	// Stats are the traffic counters of the tunnel.
+	Stats TunnelStats
+}
+
+// Status returns a snapshot of the state of the tunnel.
+//
+// Returns:
+//   - TunnelStatus: The current status.
+func (t *Tunnel) Status() TunnelStatus {
+	t.mu.Lock()
+	status := TunnelStatus{
+		State:     t.State(),
+		StartedAt: t.startedAt,
+		Endpoints: slices.Clone(t.endpoints),
+	}
+	t.mu.Unlock()
+
+	t.addrMu.Lock()
+	status.Addresses = slices.Clone(t.assigned)
+	status.Routes = slices.Clone(t.routes)
+	t.addrMu.Unlock()
+
+	if session := t.session.Load(); session != nil {
+		status.Endpoint = session.endpoint
+		status.ConnectedAt = session.connectedAt
+		status.PathMTU = t.mtu(session)
+	}
+	status.Stats = t.Stats()
+	return status
+}
@@ -5,13 +5,21 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
 	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/songgao/water"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -71,6 +79,7 @@ type NetstackAdapter struct {
 	dev             tun.Device
 	tunnelBufPool   sync.Pool
 	tunnelSizesPool sync.Pool
+	closeOnce       sync.Once
 }
 
 func (n *NetstackAdapter) ReadPacket(buf []byte) (int, error) {
@@ -100,8 +109,43 @@ func (n *NetstackAdapter) WritePacket(pkt []byte) error {
 	return err
 }
 
+func (n *NetstackAdapter) BatchSize() int {
+	return n.dev.BatchSize()
+}
+
+func (n *NetstackAdapter) ReadPackets(bufs [][]byte, sizes []int) (int, error) {
+	return n.dev.Read(bufs, sizes, 0)
+}
+
+func (n *NetstackAdapter) WritePackets(pkts [][]byte) error {
+	_, err := n.dev.Write(pkts, 0)
+	return err
+}
+
+// Close closes the wrapped device. Unlike the netstack device itself, it may be called more than once.
+func (n *NetstackAdapter) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		err = n.dev.Close()
+	})
+	return err
+}
+
 // NewNetstackAdapter creates a new NetstackAdapter.
+// The returned device is a BatchTunnelDevice.
 func NewNetstackAdapter(dev tun.Device) TunnelDevice {
+	return NewNetstackDevice(dev)
+}
+
+// NewNetstackDevice creates a new NetstackAdapter like NewNetstackAdapter, but returns the adapter
+// itself, whose Close can be called regardless of whether the tunnel already closed it.
+//
+// Parameters:
+//   - dev: tun.Device - The device to wrap.
+//
+// Returns:
+//   - *NetstackAdapter: The adapter wrapping dev.
+func NewNetstackDevice(dev tun.Device) *NetstackAdapter {
 	return &NetstackAdapter{
 		dev: dev,
 		tunnelBufPool: sync.Pool{
@@ -138,119 +182,845 @@ func (w *WaterAdapter) WritePacket(pkt []byte) error {
 	return err
 }
 
+// Close closes the wrapped interface.
+func (w *WaterAdapter) Close() error {
+	return w.iface.Close()
+}
+
 // NewWaterAdapter creates a new WaterAdapter.
 func NewWaterAdapter(iface *water.Interface) TunnelDevice {
 	return &WaterAdapter{iface: iface}
 }
 
-// MaintainTunnel continuously connects to the MASQUE server, then starts two
-// forwarding goroutines: one forwarding from the device to the IP connection (and handling
-// any ICMP reply), and the other forwarding from the IP connection to the device.
-// If an error occurs in either loop, the connection is closed and a reconnect is attempted.
+// TunnelConfig holds the parameters a Tunnel uses to connect to the MASQUE server
+// and to forward packets between the server and the device.
+type TunnelConfig struct {
+	// TLSConfig is the TLS configuration for secure communication.
+	TLSConfig *tls.Config
+	// KeepalivePeriod is the keepalive period for the QUIC connection.
+	KeepalivePeriod time.Duration
+	// InitialPacketSize is the initial packet size for the QUIC connection.
+	InitialPacketSize uint16
+	// Endpoints are the UDP addresses of the MASQUE server to connect to, in order of preference.
+	// They are raced Happy Eyeballs style on every (re)connect.
+	Endpoints []*net.UDPAddr
+	// AttemptDelay is the delay between starting connection attempts to consecutive endpoints.
+	// If zero, DefaultAttemptDelay is used.
+	AttemptDelay time.Duration
+	// FailoverAttempts is the number of consecutive failed reconnect attempts after which
+	// the next endpoint becomes the preferred one. If zero, DefaultFailoverAttempts is used.
+	FailoverAttempts int
+	// Device is the TUN device to forward packets to and from. When the tunnel shuts down, it
+	// closes the device if it implements io.Closer, like the adapters of this package do, to
+	// unblock the workers reading from it. Reads of other devices must return by themselves,
+	// Stop and Wait only return once every worker is done.
+	Device TunnelDevice
+	// Queues are additional queues of Device, e.g. of a multi-queue TUN device.
+	// Every queue, Device included, gets its own forwarding workers and is closed like Device.
+	Queues []TunnelDevice
+	// Workers is the number of goroutines forwarding packets in each direction for every queue.
+	// More workers spread the forwarding over more cores, but packets of a single flow may
+	// be reordered in the direction towards the device. The connection to the server is read by a
+	// single goroutine that hands the packets out to the workers. If zero, 1 is used.
+	Workers int
+	// MTU is the MTU of the TUN device. With PathMTUDiscovery, it is the upper bound of the path MTU.
+	MTU int
+	// PathMTUDiscovery makes the tunnel follow the size of the largest packet the path to the server
+	// can carry, as probed by quic-go, instead of assuming that packets of MTU bytes fit. Packets
+	// read from the device that are larger than the path MTU are answered with an ICMP Fragmentation
+	// Needed or Packet Too Big message carrying the path MTU.
+	PathMTUDiscovery bool
+	// OnPathMTUChange is called with the new path MTU whenever it changes, e.g. to adjust the MTU of
+	// the TUN device. It is called from the goroutine following the path MTU. Optional.
+	OnPathMTUChange func(mtu int)
+	// ClampMSS lowers the MSS option of TCP SYN and SYN-ACK packets in both directions to fit MTU
+	// (or the path MTU with PathMTUDiscovery), so that TCP connections through the device never
+	// send segments that are too large.
+	ClampMSS bool
+	// ReconnectPolicy decides the delay between reconnect attempts and when to give up.
+	// If nil, DefaultReconnectPolicy is used.
+	ReconnectPolicy ReconnectPolicy
+	// Migration moves the QUIC connection to a new socket when the local address used to reach the
+	// server changes, e.g. after switching networks, instead of waiting for it to fail. The tunnel
+	// only reconnects if the server doesn't allow migration or the new path doesn't work. Changes
+	// are watched through netlink on Linux and polled for elsewhere.
+	Migration bool
+	// FwMark is the firewall mark (SO_MARK) set on the UDP socket of the MASQUE connection,
+	// so that policy routing can keep it out of the tunnel. Zero disables it. Linux only.
+	FwMark uint32
+	// HealthCheck probes the tunnel while it is connected and reconnects if traffic stopped
+	// passing. If nil, the tunnel only reconnects once the connection is closed.
+	HealthCheck *HealthCheck
+	// LocalAddresses are the addresses of Device. If the server assigns other addresses (ADDRESS_ASSIGN
+	// capsules), the tunnel translates between them and the assigned address of the same family, so
+	// that devices whose addresses can't change while running, like netstack, keep working. Optional.
+	LocalAddresses []netip.Addr
+	// OnAddressAssign is called with the addresses assigned by the server once they are known and
+	// whenever they change, e.g. to update the addresses of the TUN device. It is called from the
+	// goroutine following the assignments. Optional.
+	OnAddressAssign func(addresses []netip.Prefix)
+	// OnRouteAdvertisement is called with the prefixes the server advertises routes to (ROUTE_ADVERTISEMENT
+	// capsules) once they are known and whenever they change. Optional.
+	OnRouteAdvertisement func(routes []netip.Prefix)
+}
+
+// tunnelSession holds the resources of a single MASQUE connection.
+type tunnelSession struct {
+	endpoint *net.UDPAddr
+	udpConn  *net.UDPConn
+	quicConn *quic.Conn
+	tr       *http3.Transport
+	ipConn   *connectip.Conn
+	response *http.Response
+	// connectedAt is when the session was established.
+	connectedAt time.Time
+	// connectTime is how long establishing the session took, resumed whether it resumed a TLS session.
+	connectTime time.Duration
+	resumed     bool
+	// pathMTU is the path MTU of the connection, zero until it is known.
+	pathMTU atomic.Int32
+
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+}
+
+// fail marks the session as broken. Only the first error is kept.
+func (s *tunnelSession) fail(err error) {
+	s.failOnce.Do(func() {
+		s.err = err
+		close(s.failed)
+	})
+}
+
+// close releases every resource held by the session.
+func (s *tunnelSession) close() {
+	if s.ipConn != nil {
+		s.ipConn.Close()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tr != nil {
+		s.tr.Close()
+	}
+}
+
+// Tunnel maintains a MASQUE connection and forwards packets between it and a TunnelDevice.
+// Whenever the connection is lost, it reconnects until it is stopped.
+//
+// A Tunnel is started with Start and can be stopped either by cancelling the context
+// passed to Start or by calling Stop. Wait blocks until the tunnel has fully shut down.
+type Tunnel struct {
+	config     TunnelConfig
+	bufferPool *NetBuffer
+	// devices are the queues packets are forwarded to and from, Device first.
+	devices []TunnelDevice
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelCauseFunc
+	done    chan struct{}
+	err     error
+	// startedAt is when Start was called.
+	startedAt time.Time
+	// tlsConfig is the TLS configuration used for the next connection, see SetTLSConfig.
+	tlsConfig *tls.Config
+	// endpoints are the endpoint candidates, the preferred one first.
+	endpoints []*net.UDPAddr
+	observers []TunnelObserver
+	// reconnect is signalled by Reconnect.
+	reconnect chan struct{}
+
+	state    atomic.Int32
+	counters tunnelCounters
+
+	// session is the currently active session, nil while (re)connecting.
+	session atomic.Pointer[tunnelSession]
+	// pathMTU is the path MTU last passed to OnPathMTUChange.
+	pathMTU atomic.Int32
+
+	addrMu sync.Mutex
+	// assigned are the addresses last assigned by the server, nil until it assigned any.
+	assigned []netip.Prefix
+	// routes are the prefixes last advertised by the server, nil until it advertised any.
+	routes []netip.Prefix
+	// translation translates between LocalAddresses and assigned, nil if they match.
+	translation atomic.Pointer[addressTranslation]
+
+	// pingID is the identifier of the echo requests sent by ping, pingSeq their last sequence number.
+	pingID  uint16
+	pingSeq atomic.Uint32
+	pingMu  sync.Mutex
+	// pings are the channels closed when the reply to an outstanding echo request arrives, by sequence number.
+	pings map[uint16]chan struct{}
+}
+
+// errTunnelStopped is the cancellation cause used by Stop.
+var errTunnelStopped = errors.New("tunnel stopped")
+
+// ErrReconnectRequested is the error a connection is torn down with when Reconnect is called.
+var ErrReconnectRequested = errors.New("reconnect requested")
+
+// NewTunnel creates a new Tunnel. The tunnel does not connect until Start is called.
 //
 // Parameters:
-//   - ctx: context.Context - The context for the connection.
-//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
-//   - keepalivePeriod: time.Duration - The keepalive period for the QUIC connection.
-//   - initialPacketSize: uint16 - The initial packet size for the QUIC connection.
-//   - endpoint: *net.UDPAddr - The UDP address of the MASQUE server.
-//   - device: TunnelDevice - The TUN device to forward packets to and from.
-//   - mtu: int - The MTU of the TUN device.
-//   - reconnectDelay: time.Duration - The delay between reconnect attempts.
-func MaintainTunnel(ctx context.Context, tlsConfig *tls.Config, keepalivePeriod time.Duration, initialPacketSize uint16, endpoint *net.UDPAddr, device TunnelDevice, mtu int, reconnectDelay time.Duration) {
-	packetBufferPool := NewNetBuffer(mtu)
+//   - config: TunnelConfig - The tunnel configuration.
+//
+// Returns:
+//   - *Tunnel: The created tunnel.
+func NewTunnel(config TunnelConfig) *Tunnel {
+	if config.ReconnectPolicy == nil {
+		config.ReconnectPolicy = DefaultReconnectPolicy()
+	}
+	if config.AttemptDelay <= 0 {
+		config.AttemptDelay = DefaultAttemptDelay
+	}
+	if config.FailoverAttempts <= 0 {
+		config.FailoverAttempts = DefaultFailoverAttempts
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+
+	return &Tunnel{
+		config:     config,
+		bufferPool: NewNetBuffer(config.MTU),
+		devices:    append([]TunnelDevice{config.Device}, config.Queues...),
+		done:       make(chan struct{}),
+		tlsConfig:  config.TLSConfig,
+		endpoints:  slices.Clone(config.Endpoints),
+		reconnect:  make(chan struct{}, 1),
+		pingID:     uint16(rand.Uint32()),
+		pings:      make(map[uint16]chan struct{}),
+	}
+}
+
+// Start starts maintaining the tunnel in the background.
+// Cancelling ctx has the same effect as calling Stop.
+//
+// Parameters:
+//   - ctx: context.Context - The context controlling the lifetime of the tunnel.
+//
+// Returns:
+//   - error: An error if the tunnel was already started.
+func (t *Tunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started {
+		return errors.New("tunnel already started")
+	}
+	t.started = true
+	t.startedAt = time.Now()
+
+	ctx, t.cancel = context.WithCancelCause(ctx)
+	go func() {
+		err := t.run(ctx)
+		t.cancel(err)
+
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		t.emit(TunnelEvent{State: StateStopped, Err: err})
+		close(t.done)
+	}()
+
+	return nil
+}
+
+// Stop tears down the current connection and stops reconnecting.
+// It blocks until the tunnel has shut down and every forwarding goroutine is done, which
+// includes closing the device. Calling Stop on a tunnel that was never started is a no-op.
+func (t *Tunnel) Stop() {
+	t.mu.Lock()
+	if !t.started {
+		t.mu.Unlock()
+		return
+	}
+	cancel := t.cancel
+	t.mu.Unlock()
+
+	cancel(errTunnelStopped)
+	<-t.done
+}
+
+// Wait blocks until a started tunnel has shut down and returns the error that terminated it.
+// It returns nil if the tunnel was stopped through Stop or by cancelling its context.
+//
+// Returns:
+//   - error: The terminal error of the tunnel, if any.
+func (t *Tunnel) Wait() error {
+	<-t.done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Reconnect tears down the current connection and connects again right away.
+// If the tunnel is waiting before the next reconnect attempt, the wait is cut short.
+// Listeners using the tunnel's device are not affected.
+func (t *Tunnel) Reconnect() {
+	select {
+	case t.reconnect <- struct{}{}:
+	default:
+		// A reconnect is already pending
+	}
+}
+
+// SetEndpoints replaces the endpoint candidates of the tunnel. The new endpoints are used
+// from the next connection attempt on; call Reconnect to switch right away.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The new endpoint candidates in order of preference.
+//
+// Returns:
+//   - error: An error if no endpoints were given.
+func (t *Tunnel) SetEndpoints(endpoints []*net.UDPAddr) error {
+	if len(endpoints) == 0 {
+		return errors.New("no endpoints given")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endpoints = slices.Clone(endpoints)
+	return nil
+}
+
+// SetTLSConfig replaces the TLS configuration of the tunnel, e.g. after the key was rotated.
+// The new configuration is used from the next connection attempt on; call Reconnect
+// to switch right away.
+//
+// Parameters:
+//   - tlsConfig: *tls.Config - The new TLS configuration.
+func (t *Tunnel) SetTLSConfig(tlsConfig *tls.Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tlsConfig = tlsConfig
+}
+
+// run is the main loop of the tunnel. It keeps connecting to the MASQUE server
+// until ctx is cancelled, the device fails or the reconnect policy gives up.
+func (t *Tunnel) run(ctx context.Context) error {
+	var workers sync.WaitGroup
+	for _, device := range t.devices {
+		for range t.config.Workers {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				t.forwardFromDevice(ctx, device)
+			}()
+		}
+	}
+	defer func() {
+		// The workers are blocked reading from the devices, closing them is what ends the reads.
+		// Cancelling first tells the workers that the read errors are expected.
+		t.cancel(nil)
+		t.closeDevices()
+		workers.Wait()
+	}()
+
+	var attempt int
 	for {
-		log.Printf("Establishing MASQUE connection to %s:%d", endpoint.IP, endpoint.Port)
-		udpConn, tr, ipConn, rsp, err := ConnectTunnel(
-			ctx,
-			tlsConfig,
-			internal.DefaultQuicConfig(keepalivePeriod, initialPacketSize),
-			internal.ConnectURI,
-			endpoint,
-		)
-		if err != nil {
-			log.Printf("Failed to connect tunnel: %v", err)
-			time.Sleep(reconnectDelay)
+		t.emit(TunnelEvent{State: StateConnecting, Attempt: attempt + 1})
+		connected, err := t.connectAndForward(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if errors.Is(err, ErrReconnectRequested) || errors.Is(err, ErrMigrationFailed) {
+			log.Printf("%v. Reconnecting now...", err)
+			attempt = 0
+			t.counters.reconnects.Add(1)
+			t.emit(TunnelEvent{State: StateReconnecting, Attempt: 1, Err: err})
 			continue
 		}
-		if rsp.StatusCode != 200 {
-			log.Printf("Tunnel connection failed: %s", rsp.Status)
-			ipConn.Close()
-			if udpConn != nil {
-				udpConn.Close()
+		if connected {
+			attempt = 0
+		}
+		attempt++
+
+		if attempt%t.config.FailoverAttempts == 0 {
+			t.mu.Lock()
+			t.endpoints = rotateEndpoints(t.endpoints)
+			if len(t.endpoints) > 1 {
+				log.Printf("Failing over to endpoint %s", t.endpoints[0])
 			}
-			if tr != nil {
-				tr.Close()
+			t.mu.Unlock()
+		}
+
+		delay, ok := t.config.ReconnectPolicy.NextDelay(attempt, err)
+		if !ok {
+			log.Printf("%v. Giving up.", err)
+			return err
+		}
+		log.Printf("%v. Reconnecting in %s...", err, delay.Round(time.Millisecond))
+		t.counters.reconnects.Add(1)
+		t.emit(TunnelEvent{State: StateReconnecting, Attempt: attempt + 1, Delay: delay, Err: err})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-t.reconnect:
+			timer.Stop()
+			attempt = 0
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if cause := context.Cause(ctx); !errors.Is(cause, errTunnelStopped) && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	return nil
+}
+
+// closeDevices closes every queue of the device that implements io.Closer.
+func (t *Tunnel) closeDevices() {
+	for _, device := range t.devices {
+		if closer, ok := device.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Failed to close TUN device: %v", err)
 			}
-			time.Sleep(reconnectDelay)
-			continue
 		}
+	}
+}
+
+// connectAndForward establishes a single MASQUE connection and forwards packets from it
+// to the device until the connection fails or ctx is cancelled. It only returns once
+// every resource of the connection has been released. The returned bool reports whether
+// the connection was successfully established before it failed.
+func (t *Tunnel) connectAndForward(ctx context.Context) (bool, error) {
+	t.mu.Lock()
+	endpoints := t.endpoints
+	tlsConfig := t.tlsConfig
+	t.mu.Unlock()
+
+	// A reconnect requested while we weren't connected is satisfied by this attempt
+	select {
+	case <-t.reconnect:
+	default:
+	}
+
+	session, err := raceEndpoints(
+		ctx,
+		tlsConfig,
+		internal.DefaultQuicConfig(t.config.KeepalivePeriod, t.config.InitialPacketSize),
+		endpoints,
+		t.config.AttemptDelay,
+		t.config.FwMark,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if session.resumed {
+		log.Printf("Connected to MASQUE server %s in %s (resumed TLS session)", session.endpoint, session.connectTime.Round(time.Millisecond))
+	} else {
+		log.Printf("Connected to MASQUE server %s in %s", session.endpoint, session.connectTime.Round(time.Millisecond))
+	}
+	t.mu.Lock()
+	t.endpoints = preferEndpoint(t.endpoints, session.endpoint)
+	t.mu.Unlock()
+	session.connectedAt = time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.watchAddresses(session)
+	}()
+	go func() {
+		defer wg.Done()
+		t.watchRoutes(session)
+	}()
 
-		log.Println("Connected to MASQUE server")
-		errChan := make(chan error, 2)
+	if t.config.PathMTUDiscovery && !t.updatePathMTU(session) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.followPathMTU(session)
+		}()
+	}
 
+	if t.config.Migration {
+		wg.Add(1)
 		go func() {
-			for {
-				buf := packetBufferPool.Get()
-				n, err := device.ReadPacket(buf)
-				if err != nil {
-					packetBufferPool.Put(buf)
-					errChan <- fmt.Errorf("failed to read from TUN device: %v", err)
-					return
-				}
-				icmp, err := ipConn.WritePacket(buf[:n])
-				if err != nil {
-					packetBufferPool.Put(buf)
-					if errors.As(err, new(*connectip.CloseError)) {
-						errChan <- fmt.Errorf("connection closed while writing to IP connection: %v", err)
-						return
-					}
-					log.Printf("Error writing to IP connection: %v, continuing...", err)
-					continue
-				}
-				packetBufferPool.Put(buf)
-
-				if len(icmp) > 0 {
-					if err := device.WritePacket(icmp); err != nil {
-						if errors.As(err, new(*connectip.CloseError)) {
-							errChan <- fmt.Errorf("connection closed while writing ICMP to TUN device: %v", err)
-							return
-						}
-						log.Printf("Error writing ICMP to TUN device: %v, continuing...", err)
-					}
-				}
-			}
+			defer wg.Done()
+			t.followNetwork(session)
 		}()
+	}
 
+	if t.config.HealthCheck != nil {
+		wg.Add(1)
 		go func() {
-			buf := packetBufferPool.Get()
-			defer packetBufferPool.Put(buf)
-			for {
-				n, err := ipConn.ReadPacket(buf, true)
-				if err != nil {
-					if errors.As(err, new(*connectip.CloseError)) {
-						errChan <- fmt.Errorf("connection closed while reading from IP connection: %v", err)
-						return
-					}
-					log.Printf("Error reading from IP connection: %v, continuing...", err)
-					continue
+			defer wg.Done()
+			t.checkHealth(session)
+		}()
+	}
+
+	t.session.Store(session)
+	t.counters.connects.Add(1)
+	t.emit(TunnelEvent{
+		State:       StateConnected,
+		Endpoint:    session.endpoint,
+		Response:    session.response,
+		ConnectTime: session.connectTime,
+		Resumed:     session.resumed,
+	})
+
+	// The packets read from the session are shared by the forwarding workers of every queue
+	queueLen := t.config.Workers
+	for _, device := range t.devices {
+		if batch, ok := device.(BatchTunnelDevice); ok {
+			queueLen = max(queueLen, batch.BatchSize())
+		}
+	}
+	packets := make(chan []byte, queueLen)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.readFromSession(session, packets)
+	}()
+	for _, device := range t.devices {
+		for range t.config.Workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.forwardToDevice(session, device, packets)
+			}()
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		session.fail(context.Cause(ctx))
+	case <-t.reconnect:
+		session.fail(ErrReconnectRequested)
+	case <-session.failed:
+	}
+
+	t.session.Store(nil)
+	session.close()
+	wg.Wait()
+
+	err = fmt.Errorf("tunnel connection lost: %w", session.err)
+	if ctx.Err() == nil {
+		t.emit(TunnelEvent{State: StateDisconnected, Endpoint: session.endpoint, Err: err})
+	}
+	return true, err
+}
+
+// forwardFromDevice reads packets from a queue of the device and writes them to the active session
+// (handling any ICMP reply). Packets read while no session is active are dropped.
+// It runs until the device is closed when the tunnel shuts down; any other device read error is
+// fatal to the tunnel.
+// Several of them may run per queue.
+func (t *Tunnel) forwardFromDevice(ctx context.Context, device TunnelDevice) {
+	batch, _ := device.(BatchTunnelDevice)
+	batchSize := 1
+	if batch != nil && batch.BatchSize() > 1 {
+		batchSize = batch.BatchSize()
+	} else {
+		batch = nil
+	}
+
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, t.config.MTU)
+	}
+	sizes := make([]int, batchSize)
+
+	for {
+		n := 1
+		var err error
+		if batch != nil {
+			n, err = batch.ReadPackets(bufs, sizes)
+		} else {
+			sizes[0], err = device.ReadPacket(bufs[0])
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			t.cancel(fmt.Errorf("failed to read from TUN device: %v", err))
+			return
+		}
+
+		session := t.session.Load()
+		if session == nil {
+			t.counters.droppedPackets.Add(uint64(n))
+			continue
+		}
+
+		// quic-go has no batch API for datagrams, but queueing a whole batch back to back
+		// lets it send them in as few syscalls as possible (using UDP GSO where available).
+		for i := range n {
+			pkt := bufs[i][:sizes[i]]
+			if t.config.ClampMSS {
+				clampMSS(pkt, t.mtu(session))
+			}
+			t.writeToSession(session, device, pkt)
+		}
+	}
+}
+
+// writeToSession writes a packet read from device to the IP connection of session. If the packet
+// is rejected locally, the ICMP reply telling the sender why is written back to device.
+func (t *Tunnel) writeToSession(session *tunnelSession, device TunnelDevice, pkt []byte) {
+	if t.config.PathMTUDiscovery {
+		mtu := t.mtu(session)
+		if len(pkt) > 0 && pkt[0]>>4 == 6 {
+			// Telling IPv6 hosts about an MTU below the minimum is pointless, packets up to it are
+			// left to connect-ip-go, which drops them until the path MTU has grown
+			mtu = max(mtu, minIPv6MTU)
+		}
+		if len(pkt) > mtu {
+			t.writeICMP(device, packetTooBig(pkt, mtu))
+			return
+		}
+	}
+
+	t.translate(pkt, true)
+	icmp, err := session.ipConn.WritePacket(pkt)
+	if err != nil {
+		t.counters.droppedPackets.Add(1)
+		if errors.As(err, new(*connectip.CloseError)) {
+			session.fail(fmt.Errorf("connection closed while writing to IP connection: %v", err))
+			return
+		}
+		log.Printf("Error writing to IP connection: %v, continuing...", err)
+		return
+	}
+
+	if len(icmp) > 0 {
+		// The packet was rejected locally (e.g. too big or TTL exceeded), the ICMP reply tells the sender why.
+		t.translate(icmp, false)
+		t.writeICMP(device, icmp)
+		return
+	}
+	t.counters.txPackets.Add(1)
+	t.counters.txBytes.Add(uint64(len(pkt)))
+}
+
+// writeICMP writes the ICMP reply to a packet that was dropped instead of being sent to device.
+func (t *Tunnel) writeICMP(device TunnelDevice, icmp []byte) {
+	t.counters.droppedPackets.Add(1)
+	if len(icmp) == 0 {
+		return
+	}
+	if err := device.WritePacket(icmp); err != nil {
+		log.Printf("Error writing ICMP to TUN device: %v, continuing...", err)
+	} else {
+		t.counters.icmpPackets.Add(1)
+	}
+}
+
+// mtu returns the MTU packets forwarded through session have to fit into: the path MTU
+// once it is known, otherwise the MTU of the device.
+func (t *Tunnel) mtu(session *tunnelSession) int {
+	if mtu := session.pathMTU.Load(); mtu > 0 {
+		return int(mtu)
+	}
+	return t.config.MTU
+}
+
+// updatePathMTU updates the path MTU of session from the datagram limit of its QUIC connection,
+// and tells OnPathMTUChange if that changes the path MTU of the tunnel.
+//
+// Returns:
+//   - bool: Whether the path MTU reached the MTU of the device, so it won't change anymore.
+func (t *Tunnel) updatePathMTU(session *tunnelSession) bool {
+	limit, ok := datagramLimit(session.quicConn, t.config.InitialPacketSize)
+	if !ok {
+		return true
+	}
+	mtu := min(limit, t.config.MTU)
+	if session.pathMTU.Swap(int32(mtu)) != int32(mtu) && t.pathMTU.Swap(int32(mtu)) != int32(mtu) {
+		log.Printf("Path MTU is %d", mtu)
+		if t.config.OnPathMTUChange != nil {
+			t.config.OnPathMTUChange(mtu)
+		}
+	}
+	return mtu == t.config.MTU
+}
+
+// followPathMTU keeps updating the path MTU of session as quic-go discovers that larger packets
+// fit, until the session fails or the path MTU reaches the MTU of the device.
+// quic-go never lowers its limit during a connection, neither does the path MTU.
+func (t *Tunnel) followPathMTU(session *tunnelSession) {
+	ticker := time.NewTicker(pathMTUPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.failed:
+			return
+		case <-ticker.C:
+		}
+		if t.updatePathMTU(session) {
+			return
+		}
+	}
+}
+
+// forwardToDevice writes the packets read from the session to a queue of the device until the
+// session fails. Several of them may share the session and packets.
+func (t *Tunnel) forwardToDevice(session *tunnelSession, device TunnelDevice, packets <-chan []byte) {
+	if batch, ok := device.(BatchTunnelDevice); ok && batch.BatchSize() > 1 {
+		t.forwardBatchesToDevice(session, batch, packets)
+		return
+	}
+
+	for pkt := range packets {
+		if !t.receivePacket(session, pkt) {
+			continue
+		}
+		err := device.WritePacket(pkt)
+		t.bufferPool.Put(pkt[:cap(pkt)])
+		if err != nil {
+			session.fail(fmt.Errorf("failed to write to TUN device: %v", err))
+			return
+		}
+		t.counters.rxPackets.Add(1)
+		t.counters.rxBytes.Add(uint64(len(pkt)))
+	}
+}
+
+// forwardBatchesToDevice is forwardToDevice for devices that take batches. The packets that
+// arrived while the previous batch was being written make up the next one, so the device gets the
+// chance to coalesce them.
+func (t *Tunnel) forwardBatchesToDevice(session *tunnelSession, device BatchTunnelDevice, packets <-chan []byte) {
+	batchSize := device.BatchSize()
+	batch := make([][]byte, 0, batchSize)
+	for pkt := range packets {
+		if !t.receivePacket(session, pkt) {
+			continue
+		}
+		batch = append(batch[:0], pkt)
+	collect:
+		for len(batch) < batchSize {
+			select {
+			case pkt, ok := <-packets:
+				if !ok {
+					break collect
 				}
-				if err := device.WritePacket(buf[:n]); err != nil {
-					errChan <- fmt.Errorf("failed to write to TUN device: %v", err)
-					return
+				if t.receivePacket(session, pkt) {
+					batch = append(batch, pkt)
 				}
+			default:
+				break collect
 			}
-		}()
+		}
 
-		err = <-errChan
-		log.Printf("Tunnel connection lost: %v. Reconnecting...", err)
-		ipConn.Close()
-		if udpConn != nil {
-			udpConn.Close()
+		err := device.WritePackets(batch)
+		for _, pkt := range batch {
+			if err == nil {
+				t.counters.rxPackets.Add(1)
+				t.counters.rxBytes.Add(uint64(len(pkt)))
+			}
+			t.bufferPool.Put(pkt[:cap(pkt)])
 		}
-		if tr != nil {
-			tr.Close()
+		if err != nil {
+			session.fail(fmt.Errorf("failed to write to TUN device: %v", err))
+			return
 		}
-		time.Sleep(reconnectDelay)
+	}
+}
+
+// readFromSession reads packets from the session's IP connection into buffers of the pool and
+// sends them to packets, retrying on errors that don't break the connection. It closes packets
+// once the session has failed.
+//
+// It is the only reader of the IP connection: a closed connection wakes up only one of the readers
+// blocked on it, and its datagrams are dequeued one at a time anyway. The rest of the work on the
+// packets is left to the forwarding workers sharing packets.
+func (t *Tunnel) readFromSession(session *tunnelSession, packets chan<- []byte) {
+	defer close(packets)
+	for {
+		buf := t.bufferPool.Get()
+		n, err := session.ipConn.ReadPacket(buf, true)
+		if err == nil {
+			select {
+			case packets <- buf[:n]:
+				continue
+			case <-session.failed:
+				t.bufferPool.Put(buf)
+				return
+			}
+		}
+		t.bufferPool.Put(buf)
+		if errors.As(err, new(*connectip.CloseError)) {
+			session.fail(fmt.Errorf("connection closed while reading from IP connection: %v", err))
+			return
+		}
+		select {
+		case <-session.failed:
+			return
+		default:
+		}
+		log.Printf("Error reading from IP connection: %v, continuing...", err)
+	}
+}
+
+// receivePacket prepares a packet read from the session for the device: its destination address
+// is translated back to the local one and its MSS is clamped if requested. Replies to the echo
+// requests sent by ping are taken instead, and their buffer is returned to the pool.
+//
+// Returns:
+//   - bool: Whether pkt is to be written to the device.
+func (t *Tunnel) receivePacket(session *tunnelSession, pkt []byte) bool {
+	if t.takePingReply(pkt) {
+		t.bufferPool.Put(pkt[:cap(pkt)])
+		return false
+	}
+	t.translate(pkt, false)
+	if t.config.ClampMSS {
+		clampMSS(pkt, t.mtu(session))
+	}
+	return true
+}
+
+// MaintainTunnel continuously connects to the MASQUE server, then starts two
+// forwarding goroutines: one forwarding from the device to the IP connection (and handling
+// any ICMP reply), and the other forwarding from the IP connection to the device.
+// If an error occurs in either loop, the connection is closed and a reconnect is attempted.
+// It blocks until ctx is cancelled, the device fails or the server rejects our credentials,
+// and closes the device before returning if it implements io.Closer.
+//
+// Earlier versions never returned: they kept retrying even after the server rejected our
+// credentials, and never closed the device. Now a rejected login ends it with the error logged,
+// and callers closing the device themselves close it a second time, which the adapters of this
+// package tolerate.
+//
+// Deprecated: Use NewTunnel, which allows stopping the tunnel and retrieving its terminal error.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the connection.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - keepalivePeriod: time.Duration - The keepalive period for the QUIC connection.
+//   - initialPacketSize: uint16 - The initial packet size for the QUIC connection.
+//   - endpoint: *net.UDPAddr - The UDP address of the MASQUE server.
+//   - device: TunnelDevice - The TUN device to forward packets to and from.
+//   - mtu: int - The MTU of the TUN device.
+//   - reconnectDelay: time.Duration - The constant delay between reconnect attempts.
+func MaintainTunnel(ctx context.Context, tlsConfig *tls.Config, keepalivePeriod time.Duration, initialPacketSize uint16, endpoint *net.UDPAddr, device TunnelDevice, mtu int, reconnectDelay time.Duration) {
+	tunnel := NewTunnel(TunnelConfig{
+		TLSConfig:         tlsConfig,
+		KeepalivePeriod:   keepalivePeriod,
+		InitialPacketSize: initialPacketSize,
+		Endpoints:         []*net.UDPAddr{endpoint},
+		Device:            device,
+		MTU:               mtu,
+		ReconnectPolicy:   &BackoffPolicy{InitialDelay: reconnectDelay},
+	})
+	if err := tunnel.Start(ctx); err != nil {
+		log.Printf("Failed to start tunnel: %v", err)
+		return
+	}
+	if err := tunnel.Wait(); err != nil {
+		log.Printf("Tunnel stopped: %v", err)
 	}
 }
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryDevice is a TunnelDevice that hands out a fixed number of copies of a packet once started,
+// and blocks further reads until it is closed. The packets written to it are counted and dropped.
+type memoryDevice struct {
+	pkt []byte
+	// left is the number of packets still to hand out.
+	left atomic.Int64
+	// start is closed to start handing out packets.
+	start chan struct{}
+	// drained is closed once the last packet was read.
+	drained chan struct{}
+	// unwritten is the number of packets still to be written to it.
+	unwritten atomic.Int64
+	// written is closed once the last of them was written.
+	written chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMemoryDevice(pkt []byte, count int) *memoryDevice {
+	d := &memoryDevice{
+		pkt:     pkt,
+		start:   make(chan struct{}),
+		drained: make(chan struct{}),
+		written: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	d.left.Store(int64(count))
+	return d
+}
+
+func (d *memoryDevice) ReadPacket(buf []byte) (int, error) {
+	select {
+	case <-d.start:
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+
+	switch left := d.left.Add(-1); {
+	case left > 0:
+		return copy(buf, d.pkt), nil
+	case left == 0:
+		close(d.drained)
+		return copy(buf, d.pkt), nil
+	}
+	<-d.closed
+	return 0, os.ErrClosed
+}
+
+func (d *memoryDevice) WritePacket(pkt []byte) error {
+	if d.unwritten.Add(-1) == 0 {
+		close(d.written)
+	}
+	return nil
+}
+
+func (d *memoryDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+// BenchmarkForwardFromDevice measures how fast the forwarding workers move packets from a device
+// into a session over the loopback interface, depending on the number of workers.
+func BenchmarkForwardFromDevice(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	server := newTestServer(b, nil)
+
+	workerCounts := []int{1, 2, 4}
+	if n := runtime.GOMAXPROCS(0); n > 4 {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkForwardFromDevice(b, server, workers)
+		})
+	}
+}
+
+func benchmarkForwardFromDevice(b *testing.B, server *testServer, workers int) {
+	pkt := testPacket(1200)
+	device := newMemoryDevice(pkt, b.N)
+	tunnel := startTestTunnel(b, server, device, workers)
+	defer tunnel.Stop()
+
+	b.SetBytes(int64(len(pkt)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	close(device.start)
+	<-device.drained
+	b.StopTimer()
+}
+
+// BenchmarkForwardToDevice measures how fast the forwarding workers move packets from a session
+// into a device over the loopback interface, depending on the number of workers. The server sends
+// packets faster than they can be received, so this is the rate at which they are received.
+func BenchmarkForwardToDevice(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	workerCounts := []int{1, 2, 4}
+	if n := runtime.GOMAXPROCS(0); n > 4 {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pkt := testPacket(1200)
+			start := make(chan struct{})
+			server := newFloodingTestServer(b, pkt, start)
+			device := newMemoryDevice(nil, 0)
+			device.unwritten.Store(int64(b.N))
+			tunnel := startTestTunnel(b, server, device, workers)
+			defer tunnel.Stop()
+
+			b.SetBytes(int64(len(pkt)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			close(start)
+			<-device.written
+			b.StopTimer()
+		})
+	}
+}
+
+// startTestTunnel starts a tunnel to server for device and waits for it to connect.
+func startTestTunnel(b *testing.B, server *testServer, device TunnelDevice, workers int) *Tunnel {
+	b.Helper()
+	tunnel := NewTunnel(TunnelConfig{
+		TLSConfig:         server.tlsConfig,
+		KeepalivePeriod:   30 * time.Second,
+		InitialPacketSize: 1242,
+		Endpoints:         []*net.UDPAddr{server.endpoint},
+		Device:            device,
+		Workers:           workers,
+		MTU:               1280,
+	})
+
+	connected := make(chan struct{}, 1)
+	tunnel.AddObserver(TunnelObserverFunc(func(event TunnelEvent) {
+		if event.State == StateConnected {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	if err := tunnel.Start(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		tunnel.Stop()
+		b.Fatal("tunnel never connected")
+	}
+	return tunnel
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// configMu serializes changes of config.AppConfig made while a tunnel is running, like key rotations
+// through the control API and addresses assigned by the server, and guards it against concurrent reads.
+var configMu sync.Mutex
+
+// getAddressSaver returns a callback for api.TunnelConfig.OnAddressAssign that stores the addresses
+// assigned by the server in the config and saves it to the file given by --config, so that the next
+// start uses them right away.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the config path from.
+//
+// Returns:
+//   - func([]netip.Prefix): The callback.
+//   - error: An error if the config path can't be read.
+func getAddressSaver(cmd *cobra.Command) (func(addresses []netip.Prefix), error) {
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(addresses []netip.Prefix) {
+		configMu.Lock()
+		defer configMu.Unlock()
+
+		ipv4, ipv6 := config.AppConfig.IPv4, config.AppConfig.IPv6
+		for _, prefix := range addresses {
+			if prefix.Addr().Is4() {
+				ipv4 = prefix.Addr().String()
+				break
+			}
+		}
+		for _, prefix := range addresses {
+			if prefix.Addr().Is6() {
+				ipv6 = prefix.Addr().String()
+				break
+			}
+		}
+		if ipv4 == config.AppConfig.IPv4 && ipv6 == config.AppConfig.IPv6 {
+			return
+		}
+
+		config.AppConfig.IPv4, config.AppConfig.IPv6 = ipv4, ipv6
+		if configPath == "" {
+			return
+		}
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			log.Printf("Failed to save assigned addresses to config: %v", err)
+			return
+		}
+		log.Printf("Saved assigned addresses %s and %s to %s", ipv4, ipv6, configPath)
+	}, nil
+}
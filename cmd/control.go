@@ -0,0 +1,386 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+// controlStatus is the response of GET /status.
+type controlStatus struct {
+	State            string       `json:"state"`
+	Endpoint         string       `json:"endpoint,omitempty"`
+	Endpoints        []string     `json:"endpoints"`
+	Addresses        []string     `json:"addresses"`
+	Routes           []string     `json:"routes,omitempty"`
+	Uptime           float64      `json:"uptime_seconds"`
+	ConnectionUptime float64      `json:"connection_uptime_seconds"`
+	PathMTU          int          `json:"path_mtu,omitempty"`
+	Stats            controlStats `json:"stats"`
+}
+
+// controlStats are the traffic counters reported by GET /status.
+type controlStats struct {
+	TxBytes        uint64 `json:"tx_bytes"`
+	TxPackets      uint64 `json:"tx_packets"`
+	RxBytes        uint64 `json:"rx_bytes"`
+	RxPackets      uint64 `json:"rx_packets"`
+	DroppedPackets uint64 `json:"dropped_packets"`
+	Connects       uint64 `json:"connects"`
+	Reconnects     uint64 `json:"reconnects"`
+}
+
+// controlEndpointRequest is the request body of POST /endpoint.
+type controlEndpointRequest struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+// controlServer serves the local control API of a running tunnel.
+type controlServer struct {
+	tunnel       *api.Tunnel
+	sni          string
+	configPath   string
+	sessionCache string
+}
+
+// startControlServer serves the local control API on the address given by the --control-listen flag.
+// It does nothing if the flag is empty. Addresses prefixed with "unix:" are unix socket paths.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//   - tunnel: *api.Tunnel - The tunnel to control.
+//
+// Returns:
+//   - func(): Stops the server and removes the unix socket, if any. Never nil.
+//   - error: An error if the flags can't be read or the listener can't be opened.
+func startControlServer(cmd *cobra.Command, tunnel *api.Tunnel) (func(), error) {
+	addr, err := cmd.Flags().GetString("control-listen")
+	if err != nil {
+		return func() {}, err
+	}
+	if addr == "" {
+		return func() {}, nil
+	}
+
+	sni, err := cmd.Flags().GetString("sni-address")
+	if err != nil {
+		return func() {}, err
+	}
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return func() {}, err
+	}
+	sessionCache, err := getSessionCachePath(cmd)
+	if err != nil {
+		return func() {}, err
+	}
+
+	tokenFile, err := cmd.Flags().GetString("control-token-file")
+	if err != nil {
+		return func() {}, err
+	}
+	var token string
+	if tokenFile != "" {
+		if token, err = readControlToken(tokenFile); err != nil {
+			return func() {}, err
+		}
+	}
+
+	var listener net.Listener
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// A socket left behind by a crashed instance would make the listen fail
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err = listenUnix(path)
+	} else {
+		// Other users of the host can connect to TCP listeners, so they need to authenticate
+		if token == "" {
+			return func() {}, errors.New("a TCP control API requires --control-token-file, or use a unix socket")
+		}
+		if err := checkLoopback(addr); err != nil {
+			return func() {}, err
+		}
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return func() {}, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	s := &controlServer{
+		tunnel:       tunnel,
+		sni:          sni,
+		configPath:   configPath,
+		sessionCache: sessionCache,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("POST /reconnect", s.handleReconnect)
+	mux.HandleFunc("POST /endpoint", s.handleEndpoint)
+	mux.HandleFunc("POST /rotate-key", s.handleRotateKey)
+
+	var handler http.Handler = mux
+	if token != "" {
+		handler = requireToken(token, mux)
+	}
+
+	server := &http.Server{Handler: handler}
+	log.Printf("Serving control API on %s", addr)
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control API stopped: %v", err)
+		}
+	}()
+
+	return func() { server.Close() }, nil
+}
+
+// readControlToken reads the bearer token of the control API from path.
+//
+// Parameters:
+//   - path: string - The file holding the token. Surrounding whitespace is ignored.
+//
+// Returns:
+//   - string: The token.
+//   - error: An error if the file can't be read or holds no token.
+func readControlToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read control token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("control token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// checkLoopback makes sure that a TCP address of the control API is only reachable from the host.
+//
+// Parameters:
+//   - addr: string - The address to listen on.
+//
+// Returns:
+//   - error: An error if addr can't be resolved or isn't a loopback address.
+func checkLoopback(addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("invalid control address %s: %v", addr, err)
+	}
+	if !tcpAddr.IP.IsLoopback() {
+		return fmt.Errorf("control API must listen on a loopback address or a unix socket, not %s", addr)
+	}
+	return nil
+}
+
+// requireToken rejects requests to next that don't carry token as bearer token.
+//
+// Parameters:
+//   - token: string - The expected token.
+//   - next: http.Handler - The handler serving authenticated requests.
+//
+// Returns:
+//   - http.Handler: The authenticating handler.
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="usque"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleStatus reports the state, addresses, routes, endpoint, uptime and counters of the tunnel.
+func (s *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.tunnel.Status()
+
+	configMu.Lock()
+	addresses := []string{}
+	for _, addr := range []string{config.AppConfig.IPv4, config.AppConfig.IPv6} {
+		if addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	configMu.Unlock()
+
+	resp := controlStatus{
+		State:     status.State.String(),
+		Endpoints: []string{},
+		Addresses: addresses,
+		Stats: controlStats{
+			TxBytes:        status.Stats.TxBytes,
+			TxPackets:      status.Stats.TxPackets,
+			RxBytes:        status.Stats.RxBytes,
+			RxPackets:      status.Stats.RxPackets,
+			DroppedPackets: status.Stats.DroppedPackets,
+			Connects:       status.Stats.Connects,
+			Reconnects:     status.Stats.Reconnects,
+		},
+	}
+	for _, route := range status.Routes {
+		resp.Routes = append(resp.Routes, route.String())
+	}
+	for _, endpoint := range status.Endpoints {
+		resp.Endpoints = append(resp.Endpoints, endpoint.String())
+	}
+	if status.Endpoint != nil {
+		resp.Endpoint = status.Endpoint.String()
+		resp.PathMTU = status.PathMTU
+	}
+	if !status.StartedAt.IsZero() {
+		resp.Uptime = time.Since(status.StartedAt).Seconds()
+	}
+	if !status.ConnectedAt.IsZero() {
+		resp.ConnectionUptime = time.Since(status.ConnectedAt).Seconds()
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleReconnect tears down the current connection and reconnects right away.
+func (s *controlServer) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	log.Println("Control API: reconnect requested")
+	s.tunnel.Reconnect()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleEndpoint replaces the endpoint candidates and reconnects to the first one that answers.
+func (s *controlServer) handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req controlEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Endpoints) == 0 {
+		http.Error(w, "no endpoints given", http.StatusBadRequest)
+		return
+	}
+
+	endpoints := make([]*net.UDPAddr, 0, len(req.Endpoints))
+	for _, e := range req.Endpoints {
+		endpoint, err := net.ResolveUDPAddr("udp", e)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid endpoint %q: %v", e, err), http.StatusBadRequest)
+			return
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if err := s.tunnel.SetEndpoints(endpoints); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Control API: switching to endpoints %v", req.Endpoints)
+	s.tunnel.Reconnect()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleRotateKey enrolls a freshly generated key, saves it to the config and reconnects with it.
+func (s *controlServer) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	log.Println("Control API: rotating key...")
+	tlsConfig, err := s.rotateKey()
+	if err != nil {
+		log.Printf("Control API: failed to rotate key: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	s.tunnel.SetTLSConfig(tlsConfig)
+	s.tunnel.Reconnect()
+	log.Println("Control API: key rotated, reconnecting")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// rotateKey generates a new key pair, enrolls its public key and persists the private key.
+// Must be called with configMu held.
+//
+// Returns:
+//   - *tls.Config: The TLS configuration using the new key.
+//   - error: An error if the key couldn't be generated, enrolled or saved.
+func (s *controlServer) rotateKey() (*tls.Config, error) {
+	privKeyBytes, publicKey, err := internal.GenerateEcKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair: %v", err)
+	}
+	privKey, err := x509.ParseECPrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	accountData := models.AccountData{
+		Token: config.AppConfig.AccessToken,
+		ID:    config.AppConfig.ID,
+	}
+	if _, apiErr, err := api.EnrollKey(accountData, publicKey, ""); err != nil {
+		if apiErr != nil {
+			return nil, fmt.Errorf("failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+		}
+		return nil, fmt.Errorf("failed to enroll key: %v", err)
+	}
+
+	// The old key is no longer enrolled, so the new one has to be saved right away
+	config.AppConfig.PrivateKey = base64.StdEncoding.EncodeToString(privKeyBytes)
+	if err := config.AppConfig.SaveConfig(s.configPath); err != nil {
+		return nil, fmt.Errorf("failed to save config: %v", err)
+	}
+
+	peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %v", err)
+	}
+	cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate cert: %v", err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, s.sni)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare TLS config: %v", err)
+	}
+	if s.sessionCache != "" {
+		// Sessions of the old key are of no use anymore, the new cache drops them
+		cache, err := api.NewFileSessionCache(s.sessionCache, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open session cache: %v", err)
+		}
+		tlsConfig.ClientSessionCache = cache
+	}
+
+	return tlsConfig, nil
+}
+
+// writeJSON writes v as the JSON response body with the given status code.
+//
+// Parameters:
+//   - w: http.ResponseWriter - The response writer.
+//   - status: int - The HTTP status code.
+//   - v: any - The value to encode.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
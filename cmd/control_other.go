@@ -0,0 +1,28 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix listens on the unix socket at path, which is only accessible by the current user.
+//
+// Parameters:
+//   - path: string - The path of the socket.
+//
+// Returns:
+//   - net.Listener: The listener of the socket.
+//   - error: An error if the socket can't be created.
+func listenUnix(path string) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package cmd
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on the unix socket at path, which is only accessible by the current user.
+// The socket is created that way, so nobody else can connect between its creation and a chmod.
+//
+// Parameters:
+//   - path: string - The path of the socket.
+//
+// Returns:
+//   - net.Listener: The listener of the socket.
+//   - error: An error if the socket can't be created.
+func listenUnix(path string) (net.Listener, error) {
+	// The umask is process-wide, files created meanwhile by other goroutines only end up more private
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
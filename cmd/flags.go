@@ -0,0 +1,404 @@
+package cmd
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// addEndpointFlags registers the flags controlling which MASQUE endpoints the tunnel connects to.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flags on.
+func addEndpointFlags(cmd *cobra.Command) {
+	cmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	cmd.Flags().BoolP("ipv6", "6", false, "Prefer IPv6 for MASQUE connection")
+	cmd.Flags().StringArray("endpoint", []string{}, "Additional MASQUE endpoint to try if the configured ones fail (host:port)")
+	cmd.Flags().Duration("endpoint-attempt-delay", api.DefaultAttemptDelay, "Delay between starting connection attempts to consecutive endpoints")
+	cmd.Flags().Int("endpoint-failover", api.DefaultFailoverAttempts, "Prefer the next endpoint after this many consecutive failed reconnect attempts")
+}
+
+// getEndpoints builds the list of MASQUE endpoint candidates from the config and the flags
+// registered by addEndpointFlags. The configured IPv4 and IPv6 endpoints are interleaved
+// (starting with the preferred family) for the connect port and then for every additional
+// port from the config. User supplied endpoints come last.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//
+// Returns:
+//   - []*net.UDPAddr: The endpoint candidates in order of preference.
+//   - error: An error if a flag is missing or invalid.
+func getEndpoints(cmd *cobra.Command) ([]*net.UDPAddr, error) {
+	connectPort, err := cmd.Flags().GetInt("connect-port")
+	if err != nil {
+		return nil, err
+	}
+	ipv6, err := cmd.Flags().GetBool("ipv6")
+	if err != nil {
+		return nil, err
+	}
+	extraEndpoints, err := cmd.Flags().GetStringArray("endpoint")
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range []string{config.AppConfig.EndpointV4, config.AppConfig.EndpointV6} {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if ipv6 {
+		slices.Reverse(ips)
+	}
+
+	ports := []int{connectPort}
+	for _, port := range config.AppConfig.EndpointPorts {
+		if port > 0 && port <= 65535 && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+
+	var endpoints []*net.UDPAddr
+	for _, port := range ports {
+		for _, ip := range ips {
+			endpoints = append(endpoints, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+
+	for _, endpoint := range extraEndpoints {
+		addr, err := net.ResolveUDPAddr("udp", endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+		}
+		endpoints = append(endpoints, addr)
+	}
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints configured")
+	}
+
+	return endpoints, nil
+}
+
+// addReconnectFlags registers the flags controlling how the tunnel reconnects.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flags on.
+func addReconnectFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Initial delay between reconnect attempts")
+	cmd.Flags().Duration("reconnect-max-delay", 1*time.Minute, "Maximum delay between reconnect attempts")
+	cmd.Flags().Float64("reconnect-multiplier", 2, "Factor the reconnect delay grows by after each failed attempt (1 keeps it constant)")
+	cmd.Flags().Float64("reconnect-jitter", 0.2, "Fraction of the reconnect delay to randomly add or subtract (0-1)")
+	cmd.Flags().Int("reconnect-max-attempts", 0, "Give up after this many consecutive failed reconnect attempts (0 retries forever)")
+}
+
+// getReconnectPolicy builds the reconnect policy from the flags registered by addReconnectFlags.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//
+// Returns:
+//   - api.ReconnectPolicy: The reconnect policy to pass to the tunnel.
+//   - error: An error if a flag is missing or invalid.
+func getReconnectPolicy(cmd *cobra.Command) (api.ReconnectPolicy, error) {
+	delay, err := cmd.Flags().GetDuration("reconnect-delay")
+	if err != nil {
+		return nil, err
+	}
+	maxDelay, err := cmd.Flags().GetDuration("reconnect-max-delay")
+	if err != nil {
+		return nil, err
+	}
+	multiplier, err := cmd.Flags().GetFloat64("reconnect-multiplier")
+	if err != nil {
+		return nil, err
+	}
+	jitter, err := cmd.Flags().GetFloat64("reconnect-jitter")
+	if err != nil {
+		return nil, err
+	}
+	maxAttempts, err := cmd.Flags().GetInt("reconnect-max-attempts")
+	if err != nil {
+		return nil, err
+	}
+
+	if delay < 0 || maxDelay < 0 {
+		return nil, fmt.Errorf("reconnect delays must not be negative")
+	}
+	if maxDelay < delay {
+		return nil, fmt.Errorf("reconnect max delay (%s) is smaller than the reconnect delay (%s)", maxDelay, delay)
+	}
+	if multiplier < 1 {
+		return nil, fmt.Errorf("reconnect multiplier must be at least 1, got %v", multiplier)
+	}
+	if jitter < 0 || jitter > 1 {
+		return nil, fmt.Errorf("reconnect jitter must be between 0 and 1, got %v", jitter)
+	}
+	if maxAttempts < 0 {
+		return nil, fmt.Errorf("reconnect max attempts must not be negative")
+	}
+
+	return &api.BackoffPolicy{
+		InitialDelay: delay,
+		MaxDelay:     maxDelay,
+		Multiplier:   multiplier,
+		Jitter:       jitter,
+		MaxAttempts:  maxAttempts,
+	}, nil
+}
+
+// addMigrationFlags registers the --no-migration flag on cmd.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flag on.
+func addMigrationFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("no-migration", false, "Reconnect instead of migrating the MASQUE connection when the local address changes, e.g. after switching networks")
+}
+
+// getMigration reports whether the tunnel should migrate its connection, going by the flag
+// registered by addMigrationFlags.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flag from.
+//
+// Returns:
+//   - bool: Whether connection migration is enabled.
+//   - error: An error if the flag is missing.
+func getMigration(cmd *cobra.Command) (bool, error) {
+	noMigration, err := cmd.Flags().GetBool("no-migration")
+	if err != nil {
+		return false, err
+	}
+	return !noMigration, nil
+}
+
+// addWorkerFlags registers the --workers flag on cmd.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flag on.
+func addWorkerFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("workers", 1, "Number of goroutines forwarding packets in each direction, raise to use more CPU cores")
+}
+
+// getWorkers returns the number of forwarding workers given with the flag registered by addWorkerFlags.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flag from.
+//
+// Returns:
+//   - int: The number of workers, at least 1.
+//   - error: An error if the flag can't be read or isn't positive.
+func getWorkers(cmd *cobra.Command) (int, error) {
+	workers, err := cmd.Flags().GetInt("workers")
+	if err != nil {
+		return 0, err
+	}
+	if workers < 1 {
+		return 0, fmt.Errorf("workers must be at least 1, got %d", workers)
+	}
+	return workers, nil
+}
+
+// addMTUFlags registers the flags controlling the MTU of the tunnel.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flags on.
+func addMTUFlags(cmd *cobra.Command) {
+	cmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection, the upper bound of path MTU discovery")
+	cmd.Flags().Bool("no-pmtud", false, "Do not discover the path MTU of the MASQUE connection, always assume packets of --mtu bytes fit")
+}
+
+// getMTU returns the MTU and whether path MTU discovery is enabled, given with the flags
+// registered by addMTUFlags.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//
+// Returns:
+//   - int: The MTU.
+//   - bool: Whether path MTU discovery is enabled.
+//   - error: An error if a flag can't be read or the MTU is invalid.
+func getMTU(cmd *cobra.Command) (int, bool, error) {
+	mtu, err := cmd.Flags().GetInt("mtu")
+	if err != nil {
+		return 0, false, err
+	}
+	noPathMTUDiscovery, err := cmd.Flags().GetBool("no-pmtud")
+	if err != nil {
+		return 0, false, err
+	}
+
+	if mtu < 576 || mtu > 65535 {
+		return 0, false, fmt.Errorf("MTU must be between 576 and 65535, got %d", mtu)
+	}
+	if mtu < 1280 {
+		log.Println("Warning: MTU is below 1280, the minimum of IPv6. IPv6 traffic will not pass through the tunnel.")
+	} else if mtu != 1280 && noPathMTUDiscovery {
+		log.Println("Warning: MTU is not the default 1280 and path MTU discovery is disabled. Packet loss and other issues may occur.")
+	}
+
+	return mtu, !noPathMTUDiscovery, nil
+}
+
+// addHealthCheckFlags registers the flags controlling the health check of the tunnel.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flags on.
+func addHealthCheckFlags(cmd *cobra.Command) {
+	cmd.Flags().String("health-check", "", "Probe the tunnel while connected and reconnect once it stops passing traffic: an IP address to ping or an http(s) URL answering with 2xx (e.g. https://cloudflareok.com/test), disabled if empty")
+	cmd.Flags().Duration("health-check-interval", api.DefaultHealthCheckInterval, "Time between two health check probes")
+	cmd.Flags().Duration("health-check-timeout", api.DefaultHealthCheckTimeout, "Time a health check probe may take")
+	cmd.Flags().Int("health-check-failures", api.DefaultHealthCheckFailures, "Reconnect after this many failed health check probes in a row")
+}
+
+// getHealthCheck builds the health check from the flags registered by addHealthCheckFlags.
+// IP addresses are pinged from the address of the same family in the config, URLs are requested
+// through dial.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//   - dial: func(ctx context.Context, network, address string) (net.Conn, error) - Dials through the tunnel, nil for the default dialer.
+//
+// Returns:
+//   - *api.HealthCheck: The health check to pass to the tunnel, nil if it is disabled.
+//   - error: An error if a flag is missing or invalid.
+func getHealthCheck(cmd *cobra.Command, dial func(ctx context.Context, network, address string) (net.Conn, error)) (*api.HealthCheck, error) {
+	target, err := cmd.Flags().GetString("health-check")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := cmd.Flags().GetDuration("health-check-interval")
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cmd.Flags().GetDuration("health-check-timeout")
+	if err != nil {
+		return nil, err
+	}
+	failures, err := cmd.Flags().GetInt("health-check-failures")
+	if err != nil {
+		return nil, err
+	}
+
+	if target == "" {
+		return nil, nil
+	}
+	if interval <= 0 || timeout <= 0 {
+		return nil, fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if failures < 1 {
+		return nil, fmt.Errorf("health check failures must be at least 1, got %d", failures)
+	}
+
+	var probe api.HealthProbe
+	if dst, err := netip.ParseAddr(target); err == nil {
+		source := config.AppConfig.IPv4
+		if dst.Is6() {
+			source = config.AppConfig.IPv6
+		}
+		src, err := netip.ParseAddr(source)
+		if err != nil {
+			return nil, fmt.Errorf("no tunnel address to ping %s from in the config: %v", dst, err)
+		}
+		probe = &api.ICMPProbe{Source: src, Destination: dst}
+	} else if u, err := url.Parse(target); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		probe = &api.HTTPProbe{URL: target, DialContext: dial}
+	} else {
+		return nil, fmt.Errorf("health check target %q is neither an IP address nor an http(s) URL", target)
+	}
+
+	return &api.HealthCheck{
+		Probe:    probe,
+		Interval: interval,
+		Timeout:  timeout,
+		Failures: failures,
+	}, nil
+}
+
+// addMetricsFlags registers the --metrics-listen flag on cmd.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flag on.
+func addMetricsFlags(cmd *cobra.Command) {
+	cmd.Flags().String("metrics-listen", "", "Address to serve Prometheus metrics on at /metrics (e.g. 127.0.0.1:9090, disabled if empty)")
+}
+
+// addControlFlags registers the --control-listen and --control-token-file flags on cmd.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flag on.
+func addControlFlags(cmd *cobra.Command) {
+	cmd.Flags().String("control-listen", "", "Address to serve the local control API on (e.g. unix:/run/usque.sock or 127.0.0.1:9091, disabled if empty)")
+	cmd.Flags().String("control-token-file", "", "File holding the bearer token the control API requires, mandatory when it listens on a loopback TCP address")
+}
+
+// addSessionCacheFlags registers the --session-cache flag on cmd.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to register the flag on.
+func addSessionCacheFlags(cmd *cobra.Command) {
+	cmd.Flags().String("session-cache", "", "File to keep TLS session tickets in across restarts, relative paths are next to the config file (in memory only if empty)")
+}
+
+// getSessionCachePath parses the --session-cache flag. Relative paths are resolved against the
+// directory of the config file.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//
+// Returns:
+//   - string: The path of the session cache, empty if it isn't kept on disk.
+//   - error: An error if the flags can't be read.
+func getSessionCachePath(cmd *cobra.Command) (string, error) {
+	path, err := cmd.Flags().GetString("session-cache")
+	if err != nil {
+		return "", err
+	}
+	if path == "" || filepath.IsAbs(path) {
+		return path, nil
+	}
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), path), nil
+}
+
+// getSessionCache opens the TLS session cache given by the --session-cache flag.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flags from.
+//   - key: crypto.PublicKey - The public key the sessions authenticate with.
+//   - peerKey: crypto.PublicKey - The public key the server is pinned to.
+//
+// Returns:
+//   - tls.ClientSessionCache: The session cache, nil if the flag is empty.
+//   - error: An error if the flags can't be read or the cache can't be opened.
+func getSessionCache(cmd *cobra.Command, key, peerKey crypto.PublicKey) (tls.ClientSessionCache, error) {
+	path, err := getSessionCachePath(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, nil
+	}
+	cache, err := api.NewFileSessionCache(path, key, peerKey)
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
@@ -2,12 +2,16 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Diniboy1123/usque/api"
@@ -55,6 +59,14 @@ var httpProxyCmd = &cobra.Command{
 			cmd.Printf("Failed to prepare TLS config: %v\n", err)
 			return
 		}
+		sessionCache, err := getSessionCache(cmd, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			cmd.Printf("Failed to get session cache: %v\n", err)
+			return
+		}
+		if sessionCache != nil {
+			tlsConfig.ClientSessionCache = sessionCache
+		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
@@ -79,23 +91,22 @@ var httpProxyCmd = &cobra.Command{
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		endpoints, err := getEndpoints(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to get endpoints: %v\n", err)
 			return
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
+		attemptDelay, err := cmd.Flags().GetDuration("endpoint-attempt-delay")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint attempt delay: %v\n", err)
+			return
+		}
+
+		failoverAttempts, err := cmd.Flags().GetInt("endpoint-failover")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint failover attempts: %v\n", err)
+			return
 		}
 
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
@@ -156,14 +167,11 @@ var httpProxyCmd = &cobra.Command{
 			return
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
+		mtu, pathMTUDiscovery, err := getMTU(cmd)
 		if err != nil {
 			cmd.Printf("Failed to get MTU: %v\n", err)
 			return
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
 
 		var username string
 		var password string
@@ -174,9 +182,21 @@ var httpProxyCmd = &cobra.Command{
 			password = p
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		reconnectPolicy, err := getReconnectPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get reconnect policy: %v\n", err)
+			return
+		}
+
+		migration, err := getMigration(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get migration: %v\n", err)
+			return
+		}
+
+		workers, err := getWorkers(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
+			cmd.Printf("Failed to get workers: %v\n", err)
 			return
 		}
 
@@ -190,36 +210,115 @@ var httpProxyCmd = &cobra.Command{
 			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
 			return
 		}
-		defer tunDev.Close()
+		// Stopping the tunnel closes the device as well, closing the adapter again is a no-op
+		device := api.NewNetstackDevice(tunDev)
+		defer device.Close()
+
+		healthCheck, err := getHealthCheck(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to get health check: %v\n", err)
+			return
+		}
+
+		saveAddresses, err := getAddressSaver(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get config path: %v\n", err)
+			return
+		}
 
 		resolver := internal.GetProxyResolver(localDNS, tunNet, dnsAddrs, dnsTimeout)
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		tunnel := api.NewTunnel(api.TunnelConfig{
+			TLSConfig:         tlsConfig,
+			KeepalivePeriod:   keepalivePeriod,
+			InitialPacketSize: initialPacketSize,
+			Endpoints:         endpoints,
+			AttemptDelay:      attemptDelay,
+			FailoverAttempts:  failoverAttempts,
+			Device:            device,
+			MTU:               mtu,
+			PathMTUDiscovery:  pathMTUDiscovery,
+			ReconnectPolicy:   reconnectPolicy,
+			Migration:         migration,
+			HealthCheck:       healthCheck,
+			LocalAddresses:    localAddresses,
+			OnAddressAssign:   saveAddresses,
+			Workers:           workers,
+		})
+		stopMetrics, err := startMetricsServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start metrics server: %v\n", err)
+			return
+		}
+		defer stopMetrics()
+		stopControl, err := startControlServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start control API: %v\n", err)
+			return
+		}
+		defer stopControl()
+		if err := tunnel.Start(ctx); err != nil {
+			cmd.Printf("Failed to start tunnel: %v\n", err)
+			return
+		}
+		defer tunnel.Stop()
 
 		server := &http.Server{
-			Addr: net.JoinHostPort(bindAddress, port),
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if !authenticate(r, authHeader) {
-					w.Header().Set("Proxy-Authenticate", `Basic realm="Proxy"`)
-					http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
-					return
-				}
-
-				if r.Method == http.MethodConnect {
-					handleHTTPSConnect(w, r, tunNet, resolver)
-				} else {
-					handleHTTPProxy(w, r, tunNet, resolver)
-				}
-			}),
+			Addr:    net.JoinHostPort(bindAddress, port),
+			Handler: newHTTPProxyHandler(tunnel, tunNet, resolver, authHeader),
 		}
 
+		go func() {
+			if err := tunnel.Wait(); err != nil {
+				log.Printf("Tunnel stopped: %v", err)
+			}
+			server.Close()
+		}()
+
 		log.Printf("HTTP proxy listening on %s:%s\n", bindAddress, port)
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			cmd.Printf("Failed to start HTTP proxy: %v\n", err)
 		}
 	},
 }
 
+// newHTTPProxyHandler creates the handler of an HTTP proxy that forwards requests through the tunnel.
+// Requests are refused while the tunnel is down.
+//
+// Parameters:
+//   - tunnel: *api.Tunnel - The tunnel carrying the proxied traffic.
+//   - tunNet: *netstack.Net - The network stack of the tunnel.
+//   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
+//   - authHeader: string - The expected Proxy-Authorization header (authentication is disabled if empty).
+//
+// Returns:
+//   - http.Handler: The proxy handler.
+func newHTTPProxyHandler(tunnel *api.Tunnel, tunNet *netstack.Net, resolver *net.Resolver, authHeader string) http.Handler {
+	dial := internal.NewProxyMetrics("http").Dial(tunNet.DialContext)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, authHeader) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="Proxy"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+
+		if !tunnel.Connected() {
+			http.Error(w, "Tunnel is down", http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Method == http.MethodConnect {
+			handleHTTPSConnect(w, r, dial, resolver)
+		} else {
+			handleHTTPProxy(w, r, dial, resolver)
+		}
+	})
+}
+
 // authenticate verifies the Proxy-Authorization header in an HTTP request.
 //
 // Parameters:
@@ -238,9 +337,9 @@ func authenticate(r *http.Request, expectedAuth string) bool {
 // Parameters:
 //   - w: http.ResponseWriter - The response writer for the HTTP request.
 //   - r: *http.Request - The incoming HTTP request.
-//   - tunNet: *netstack.Net - The netstack network interface.
+//   - dial: internal.DialFunc - The function used to open connections through the tunnel.
 //   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
-func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack.Net, resolver *net.Resolver) {
+func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, dial internal.DialFunc, resolver *net.Resolver) {
 	ctx := r.Context()
 
 	host, port, err := net.SplitHostPort(r.Host)
@@ -251,7 +350,9 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 
 	var destAddr string
 	if resolver != nil {
+		start := time.Now()
 		ips, err := resolver.LookupIP(ctx, "ip", host)
+		internal.ObserveDNSLookup(start, err)
 		if err != nil || len(ips) == 0 {
 			http.Error(w, "DNS resolution failed", http.StatusServiceUnavailable)
 			return
@@ -261,7 +362,7 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 		destAddr = r.Host
 	}
 
-	destConn, err := tunNet.DialContext(ctx, "tcp", destAddr)
+	destConn, err := dial(ctx, "tcp", destAddr)
 	if err != nil {
 		http.Error(w, "Unable to connect to destination", http.StatusServiceUnavailable)
 		return
@@ -301,9 +402,9 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 // Parameters:
 //   - w: http.ResponseWriter - The response writer for the HTTP request.
 //   - r: *http.Request - The incoming HTTP request.
-//   - tunNet: *netstack.Net - The netstack network interface.
+//   - dial: internal.DialFunc - The function used to open connections through the tunnel.
 //   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
-func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Net, resolver *net.Resolver) {
+func handleHTTPProxy(w http.ResponseWriter, r *http.Request, dial internal.DialFunc, resolver *net.Resolver) {
 	port := r.URL.Port()
 	if port == "" {
 		port = "80"
@@ -319,7 +420,9 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 
 				var dialAddr string
 				if resolver != nil {
+					start := time.Now()
 					ips, err := resolver.LookupIP(ctx, "ip", host)
+					internal.ObserveDNSLookup(start, err)
 					if err != nil || len(ips) == 0 {
 						return nil, fmt.Errorf("DNS resolution failed for %s: %w", host, err)
 					}
@@ -328,7 +431,7 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 					dialAddr = addr
 				}
 
-				return tunNet.DialContext(ctx, network, dialAddr)
+				return dial(ctx, network, dialAddr)
 			},
 		},
 	}
@@ -370,17 +473,22 @@ func init() {
 	httpProxyCmd.Flags().StringP("port", "p", "8000", "Port to listen on for HTTP proxy")
 	httpProxyCmd.Flags().StringP("username", "u", "", "Username for proxy authentication (specify both username and password to enable)")
 	httpProxyCmd.Flags().StringP("password", "w", "", "Password for proxy authentication (specify both username and password to enable)")
-	httpProxyCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	addEndpointFlags(httpProxyCmd)
 	httpProxyCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
 	httpProxyCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
-	httpProxyCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	httpProxyCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	httpProxyCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
-	httpProxyCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
-	httpProxyCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	httpProxyCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	addMTUFlags(httpProxyCmd)
+	httpProxyCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection, path MTU discovery starts from it")
+	addSessionCacheFlags(httpProxyCmd)
+	addReconnectFlags(httpProxyCmd)
+	addMigrationFlags(httpProxyCmd)
+	addHealthCheckFlags(httpProxyCmd)
+	addWorkerFlags(httpProxyCmd)
+	addMetricsFlags(httpProxyCmd)
+	addControlFlags(httpProxyCmd)
 	httpProxyCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
 	rootCmd.AddCommand(httpProxyCmd)
 }
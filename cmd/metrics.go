@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// metricsShutdownTimeout is how long scrapes in progress may take to finish when the metrics
+// server is stopped.
+const metricsShutdownTimeout = 5 * time.Second
+
+// startMetricsServer serves the Prometheus metrics of the tunnel and the proxies on the address
+// given by the --metrics-listen flag. It does nothing if the flag is empty, the proxies then don't
+// record metrics at all. The listener is opened synchronously so that a bad address is reported
+// before the tunnel starts.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flag from.
+//   - tunnel: *api.Tunnel - The tunnel whose counters are exported.
+//
+// Returns:
+//   - func(): Shuts the server down. Never nil.
+//   - error: An error if the flag can't be read or the listener can't be opened.
+func startMetricsServer(cmd *cobra.Command, tunnel *api.Tunnel) (func(), error) {
+	addr, err := cmd.Flags().GetString("metrics-listen")
+	if err != nil {
+		return func() {}, err
+	}
+	if addr == "" {
+		return func() {}, nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return func() {}, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	if err := registerTunnelMetrics(internal.DefaultRegistry, tunnel); err != nil {
+		listener.Close()
+		return func() {}, fmt.Errorf("failed to register tunnel metrics: %v", err)
+	}
+	internal.EnableProxyMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", internal.DefaultRegistry)
+	server := &http.Server{Handler: mux}
+
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// registerTunnelMetrics exports the counters and state of a tunnel in the given registry.
+//
+// Parameters:
+//   - registry: *internal.Registry - The registry to register the metrics in.
+//   - tunnel: *api.Tunnel - The tunnel to export.
+//
+// Returns:
+//   - error: An error if a metric of the tunnel is already registered, e.g. by another tunnel.
+func registerTunnelMetrics(registry *internal.Registry, tunnel *api.Tunnel) error {
+	err := registry.NewGaugeFunc("usque_tunnel_connected", "Whether the tunnel is currently connected (1) or not (0).", func() float64 {
+		if tunnel.Connected() {
+			return 1
+		}
+		return 0
+	})
+	if err != nil {
+		return err
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(api.TunnelStats) uint64
+	}{
+		{"usque_tunnel_sent_bytes_total", "Bytes sent through the tunnel.",
+			func(s api.TunnelStats) uint64 { return s.TxBytes }},
+		{"usque_tunnel_sent_packets_total", "Packets sent through the tunnel.",
+			func(s api.TunnelStats) uint64 { return s.TxPackets }},
+		{"usque_tunnel_received_bytes_total", "Bytes received through the tunnel.",
+			func(s api.TunnelStats) uint64 { return s.RxBytes }},
+		{"usque_tunnel_received_packets_total", "Packets received through the tunnel.",
+			func(s api.TunnelStats) uint64 { return s.RxPackets }},
+		{"usque_tunnel_dropped_packets_total", "Packets that couldn't be sent through the tunnel.",
+			func(s api.TunnelStats) uint64 { return s.DroppedPackets }},
+		{"usque_tunnel_icmp_packets_total", "ICMP replies generated locally for packets that couldn't be sent.",
+			func(s api.TunnelStats) uint64 { return s.ICMPPackets }},
+		{"usque_tunnel_connects_total", "Successfully established tunnel connections.",
+			func(s api.TunnelStats) uint64 { return s.Connects }},
+		{"usque_tunnel_reconnects_total", "Reconnect attempts after a tunnel failure.",
+			func(s api.TunnelStats) uint64 { return s.Reconnects }},
+		{"usque_tunnel_health_check_failures_total", "Failed health check probes.",
+			func(s api.TunnelStats) uint64 { return s.HealthCheckFailures }},
+		{"usque_tunnel_migrations_total", "Connections moved to a new network after the local address changed.",
+			func(s api.TunnelStats) uint64 { return s.Migrations }},
+	}
+	for _, c := range counters {
+		if err := registry.NewCounterFunc(c.name, c.help, func() float64 { return float64(c.value(tunnel.Stats())) }); err != nil {
+			return err
+		}
+	}
+
+	connectDuration, err := registry.NewHistogramVec("usque_tunnel_connect_duration_seconds", "Time taken to establish a tunnel connection, by TLS handshake.", "handshake", internal.DefaultBuckets)
+	if err != nil {
+		return err
+	}
+	tunnel.AddObserver(api.TunnelObserverFunc(func(event api.TunnelEvent) {
+		if event.State != api.StateConnected {
+			return
+		}
+		handshake := "full"
+		if event.Resumed {
+			handshake = "resumed"
+		}
+		connectDuration.With(handshake).Observe(event.ConnectTime.Seconds())
+	}))
+	return nil
+}
@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// TestRegisterTunnelMetricsTwice checks that the metrics of a second tunnel are refused instead of
+// panicking, e.g. when the metrics server is started twice in one process.
+func TestRegisterTunnelMetricsTwice(t *testing.T) {
+	registry := internal.NewRegistry()
+	if err := registerTunnelMetrics(registry, api.NewTunnel(api.TunnelConfig{MTU: 1280})); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerTunnelMetrics(registry, api.NewTunnel(api.TunnelConfig{MTU: 1280})); err == nil {
+		t.Fatal("registering the metrics of a second tunnel succeeded")
+	}
+}
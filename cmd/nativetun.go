@@ -2,8 +2,14 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Diniboy1123/usque/api"
@@ -18,6 +24,119 @@ type tunDevice struct {
 	iproute2 bool
 	ipv4     bool
 	ipv6     bool
+
+	addresses     []netip.Addr   // Addresses of the device, follow the ones assigned by the server
+	routes        []netip.Prefix // Prefixes routed into the tunnel
+	excludeRoutes []netip.Prefix // Prefixes kept on the routes they had before the tunnel came up
+	defaultRoute  bool           // Route everything into the tunnel, except the MASQUE endpoints
+	endpoints     []*net.UDPAddr // MASQUE endpoints, which must stay reachable outside the tunnel
+	policyRouting bool           // Route everything but the marked MASQUE socket into the tunnel using a dedicated table
+	fwmark        uint32         // Firewall mark of the MASQUE socket in policy routing mode
+	table         int            // Routing table used in policy routing mode
+	killSwitch    bool           // Drop everything leaving outside the tunnel, except the MASQUE connection
+	gateway       []netip.Prefix // LAN subnets whose traffic is forwarded into the tunnel and masqueraded
+	configureDNS  bool           // Point the resolver of the host to dns
+	dns           []netip.Addr   // DNS servers to use through the tunnel
+	dnsDomains    []string       // Search and routing domains of the DNS servers
+	netns         string         // Network namespace to move the device into, empty for none
+	workers       int            // Number of forwarding workers, on Linux every one gets its own queue of the device
+	offload       bool           // Exchange large TCP and UDP packets with the kernel (GSO/GRO)
+
+	queues  []api.TunnelDevice // Additional queues of a multi-queue device opened by create
+	linkMTU int                // Current MTU of the device, follows the path MTU of the tunnel
+
+	followEndpoints func([]*net.UDPAddr) // Keeps new endpoint candidates out of the tunnel routes, set by setupRoutes if needed
+
+	cleanup []func() // Undoes what create set up besides the device, in reverse order
+}
+
+// followPathMTU sets the MTU of the device to a new path MTU of the tunnel. With IPv6 it never
+// goes below 1280, where IPv6 would be disabled on the device; larger packets are answered with
+// ICMP by the tunnel instead.
+func (t *tunDevice) followPathMTU(pathMTU int) {
+	mtu := pathMTU
+	if t.ipv6 && mtu < 1280 {
+		mtu = min(1280, t.mtu)
+	}
+	if mtu == t.linkMTU {
+		return
+	}
+	if err := t.setMTU(mtu); err != nil {
+		log.Printf("Failed to set MTU of %s to %d: %v", t.name, mtu, err)
+		return
+	}
+	t.linkMTU = mtu
+}
+
+// followAddresses replaces the addresses of the device by the ones of the same family assigned
+// by the server, if they differ.
+func (t *tunDevice) followAddresses(assigned []netip.Prefix) {
+	for i, addr := range t.addresses {
+		for _, prefix := range assigned {
+			if prefix.Addr().Is4() != addr.Is4() {
+				continue
+			}
+			if !prefix.Contains(addr) {
+				if err := t.replaceAddress(addr, prefix.Addr()); err != nil {
+					log.Printf("Failed to change address of %s from %s to %s: %v", t.name, addr, prefix.Addr(), err)
+					break
+				}
+				log.Printf("Changed address of %s from %s to %s", t.name, addr, prefix.Addr())
+				t.addresses[i] = prefix.Addr()
+			}
+			break
+		}
+	}
+}
+
+// familyEnabled reports whether the address family of prefix is enabled inside the tunnel.
+func (t *tunDevice) familyEnabled(prefix netip.Prefix) bool {
+	return (prefix.Addr().Is4() && t.ipv4) || (prefix.Addr().Is6() && t.ipv6)
+}
+
+// probeRouted reports whether the requests of an HTTP health check to rawURL go through the device.
+// They are dialed like any other connection of the host, so they only probe the tunnel if the
+// routes send them there. A hostname can resolve to any address, which only the default route
+// covers.
+func (t *tunDevice) probeRouted(rawURL string) bool {
+	if t.netns != "" {
+		// The probe is dialed in the namespace usque runs in, not in the one of the device
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(u.Hostname())
+	if err != nil {
+		return t.defaultRoute || t.policyRouting
+	}
+	addr = addr.Unmap()
+	if !t.familyEnabled(netip.PrefixFrom(addr, addr.BitLen())) {
+		return false
+	}
+	for _, prefix := range t.excludeRoutes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if t.defaultRoute || t.policyRouting {
+		return true
+	}
+	for _, prefix := range t.routes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// close undoes what create set up besides the device itself, like a network namespace it created.
+func (t *tunDevice) close() {
+	for i := len(t.cleanup) - 1; i >= 0; i-- {
+		t.cleanup[i]()
+	}
+	t.cleanup = nil
 }
 
 var nativeTunCmd = &cobra.Command{
@@ -58,6 +177,14 @@ var nativeTunCmd = &cobra.Command{
 			cmd.Printf("Failed to prepare TLS config: %v\n", err)
 			return
 		}
+		sessionCache, err := getSessionCache(cmd, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			cmd.Printf("Failed to get session cache: %v\n", err)
+			return
+		}
+		if sessionCache != nil {
+			tlsConfig.ClientSessionCache = sessionCache
+		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
@@ -70,23 +197,22 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		endpoints, err := getEndpoints(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to get endpoints: %v\n", err)
 			return
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
+		attemptDelay, err := cmd.Flags().GetDuration("endpoint-attempt-delay")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint attempt delay: %v\n", err)
+			return
+		}
+
+		failoverAttempts, err := cmd.Flags().GetInt("endpoint-failover")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint failover attempts: %v\n", err)
+			return
 		}
 
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
@@ -101,13 +227,28 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
+		mtu, pathMTUDiscovery, err := getMTU(cmd)
 		if err != nil {
 			cmd.Printf("Failed to get MTU: %v\n", err)
 			return
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
+
+		var addresses []netip.Addr
+		if !tunnelIPv4 {
+			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
+			if err != nil {
+				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
+				return
+			}
+			addresses = append(addresses, v4)
+		}
+		if !tunnelIPv6 {
+			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
+			if err != nil {
+				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
+				return
+			}
+			addresses = append(addresses, v6)
 		}
 
 		setIproute2, err := cmd.Flags().GetBool("no-iproute2")
@@ -116,9 +257,132 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		noClampMSS, err := cmd.Flags().GetBool("no-clamp-mss")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
+			cmd.Printf("Failed to get no clamp MSS: %v\n", err)
+			return
+		}
+
+		reconnectPolicy, err := getReconnectPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get reconnect policy: %v\n", err)
+			return
+		}
+
+		migration, err := getMigration(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get migration: %v\n", err)
+			return
+		}
+
+		healthCheck, err := getHealthCheck(cmd, nil)
+		if err != nil {
+			cmd.Printf("Failed to get health check: %v\n", err)
+			return
+		}
+
+		saveAddresses, err := getAddressSaver(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get config path: %v\n", err)
+			return
+		}
+
+		workers, err := getWorkers(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get workers: %v\n", err)
+			return
+		}
+
+		routes, err := getPrefixes(cmd, "route")
+		if err != nil {
+			cmd.Printf("Failed to get routes: %v\n", err)
+			return
+		}
+
+		excludeRoutes, err := getPrefixes(cmd, "exclude-route")
+		if err != nil {
+			cmd.Printf("Failed to get excluded routes: %v\n", err)
+			return
+		}
+
+		defaultRoute, err := cmd.Flags().GetBool("default-route")
+		if err != nil {
+			cmd.Printf("Failed to get default route: %v\n", err)
+			return
+		}
+
+		policyRouting, err := cmd.Flags().GetBool("policy-routing")
+		if err != nil {
+			cmd.Printf("Failed to get policy routing: %v\n", err)
+			return
+		}
+
+		fwmark, err := cmd.Flags().GetUint32("fwmark")
+		if err != nil {
+			cmd.Printf("Failed to get fwmark: %v\n", err)
+			return
+		}
+
+		routeTable, err := cmd.Flags().GetInt("route-table")
+		if err != nil {
+			cmd.Printf("Failed to get route table: %v\n", err)
+			return
+		}
+
+		if policyRouting && fwmark == 0 {
+			cmd.Println("Policy routing needs a non-zero fwmark")
+			return
+		}
+
+		killSwitch, err := cmd.Flags().GetBool("kill-switch")
+		if err != nil {
+			cmd.Printf("Failed to get kill switch: %v\n", err)
+			return
+		}
+
+		gateway, err := getPrefixes(cmd, "gateway")
+		if err != nil {
+			cmd.Printf("Failed to get gateway subnets: %v\n", err)
+			return
+		}
+
+		configureDNS, err := cmd.Flags().GetBool("configure-dns")
+		if err != nil {
+			cmd.Printf("Failed to get configure DNS: %v\n", err)
+			return
+		}
+
+		dnsServers, err := cmd.Flags().GetStringArray("dns")
+		if err != nil {
+			cmd.Printf("Failed to get DNS servers: %v\n", err)
+			return
+		}
+
+		var dnsAddrs []netip.Addr
+		for _, dns := range dnsServers {
+			addr, err := netip.ParseAddr(dns)
+			if err != nil {
+				cmd.Printf("Failed to parse DNS server: %v\n", err)
+				return
+			}
+			dnsAddrs = append(dnsAddrs, addr)
+		}
+
+		dnsDomains, err := cmd.Flags().GetStringArray("dns-domain")
+		if err != nil {
+			cmd.Printf("Failed to get DNS domains: %v\n", err)
+			return
+		}
+
+		offload, err := cmd.Flags().GetBool("offload")
+		if err != nil {
+			cmd.Printf("Failed to get offload: %v\n", err)
+			return
+		}
+
+		netnsName, err := cmd.Flags().GetString("netns")
+		if err != nil {
+			cmd.Printf("Failed to get network namespace: %v\n", err)
 			return
 		}
 
@@ -139,38 +403,211 @@ var nativeTunCmd = &cobra.Command{
 		t := &tunDevice{
 			name:     interfaceName,
 			mtu:      mtu,
+			linkMTU:  mtu,
 			iproute2: !setIproute2,
 			ipv4:     !tunnelIPv4,
 			ipv6:     !tunnelIPv6,
+
+			addresses:     addresses,
+			routes:        routes,
+			excludeRoutes: excludeRoutes,
+			defaultRoute:  defaultRoute || netnsName != "", // Nothing else would use the device in its own namespace
+			endpoints:     endpoints,
+			policyRouting: policyRouting,
+			fwmark:        fwmark,
+			table:         routeTable,
+			killSwitch:    killSwitch,
+			gateway:       gateway,
+			configureDNS:  configureDNS,
+			dns:           dnsAddrs,
+			dnsDomains:    dnsDomains,
+			netns:         netnsName,
+			workers:       workers,
+			offload:       offload,
+		}
+
+		if healthCheck != nil {
+			if probe, ok := healthCheck.Probe.(*api.HTTPProbe); ok && !t.probeRouted(probe.URL) {
+				cmd.Println("URL health checks only probe the tunnel if --default-route, --policy-routing or a --route sends them into it, and not with --netns. Ping an IP address instead.")
+				return
+			}
+		}
+
+		// The mark is also useful for rules of the user's own, so set it whenever it was asked for.
+		// The kill switch recognizes the MASQUE socket by it, whatever endpoint it connects to.
+		var socketMark uint32
+		if policyRouting || killSwitch || cmd.Flags().Changed("fwmark") {
+			socketMark = fwmark
 		}
 
 		dev, err := t.create()
 		if err != nil {
+			t.close()
 			log.Println("Are you root/administrator? TUN device creation usually requires elevated privileges.")
 			log.Fatalf("Failed to create TUN device: %v", err)
 		}
 
+		defer t.close()
+
 		log.Printf("Created TUN device: %s", t.name)
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, dev, mtu, reconnectDelay)
+		removeRoutes, err := t.setupRoutes()
+		if err != nil {
+			cmd.Printf("Failed to set up routes: %v\n", err)
+			return
+		}
+		defer removeRoutes()
+
+		disableKillSwitch, err := t.setupKillSwitch(socketMark)
+		if err != nil {
+			cmd.Printf("Failed to set up kill switch: %v\n", err)
+			return
+		}
+		defer disableKillSwitch()
 
-		log.Println("Tunnel established, you may now set up routing and DNS")
+		disableGateway, err := t.setupGateway()
+		if err != nil {
+			cmd.Printf("Failed to set up gateway: %v\n", err)
+			return
+		}
+		defer disableGateway()
+
+		restoreDNS, err := t.setupDNS()
+		if err != nil {
+			cmd.Printf("Failed to set up DNS: %v\n", err)
+			return
+		}
+		defer restoreDNS()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		assignAddresses := func(addresses []netip.Prefix) {
+			t.followAddresses(addresses)
+			saveAddresses(addresses)
+		}
 
-		select {}
+		tunnel := api.NewTunnel(api.TunnelConfig{
+			TLSConfig:         tlsConfig,
+			KeepalivePeriod:   keepalivePeriod,
+			InitialPacketSize: initialPacketSize,
+			Endpoints:         endpoints,
+			AttemptDelay:      attemptDelay,
+			FailoverAttempts:  failoverAttempts,
+			Device:            dev,
+			MTU:               mtu,
+			PathMTUDiscovery:  pathMTUDiscovery,
+			OnPathMTUChange:   t.followPathMTU,
+			ClampMSS:          !noClampMSS,
+			ReconnectPolicy:   reconnectPolicy,
+			Migration:         migration,
+			HealthCheck:       healthCheck,
+			OnAddressAssign:   assignAddresses,
+			FwMark:            socketMark,
+			Queues:            t.queues,
+			Workers:           workers / (1 + len(t.queues)), // On Linux every queue has a worker of its own
+		})
+		if t.followEndpoints != nil {
+			// Connection attempts are only made after the observers returned, so the routes are in
+			// place for endpoints switched to through the control API or failed over to. The
+			// netlink calls take a moment, which the observer contract allows for.
+			tunnel.AddObserver(api.TunnelObserverFunc(func(event api.TunnelEvent) {
+				if event.State == api.StateConnecting {
+					t.followEndpoints(tunnel.Status().Endpoints)
+				}
+			}))
+		}
+		stopMetrics, err := startMetricsServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start metrics server: %v\n", err)
+			return
+		}
+		defer stopMetrics()
+		stopControl, err := startControlServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start control API: %v\n", err)
+			return
+		}
+		defer stopControl()
+		if err := tunnel.Start(ctx); err != nil {
+			cmd.Printf("Failed to start tunnel: %v\n", err)
+			return
+		}
+
+		routed := len(t.routes) > 0 || t.defaultRoute || t.policyRouting
+		if routed && t.configureDNS {
+			log.Println("Tunnel established, routes and DNS are set up")
+		} else if routed {
+			log.Println("Tunnel established, routes are set up, you may now set up DNS")
+		} else if t.configureDNS {
+			log.Println("Tunnel established, DNS is set up, you may now set up routing")
+		} else {
+			log.Println("Tunnel established, you may now set up routing and DNS")
+		}
+
+		if err := tunnel.Wait(); err != nil {
+			log.Printf("Tunnel stopped: %v", err)
+		}
 	},
 }
 
 func init() {
-	nativeTunCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
-	nativeTunCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	addEndpointFlags(nativeTunCmd)
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	nativeTunCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	nativeTunCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
-	nativeTunCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
-	nativeTunCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	addMTUFlags(nativeTunCmd)
+	nativeTunCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection, path MTU discovery starts from it")
+	addSessionCacheFlags(nativeTunCmd)
 	nativeTunCmd.Flags().BoolP("no-iproute2", "I", false, "Linux only: Do not set up IP addresses and do not set the link up")
-	nativeTunCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	nativeTunCmd.Flags().Bool("no-clamp-mss", false, "Do not lower the MSS of TCP connections through the tunnel to fit the MTU")
+	addReconnectFlags(nativeTunCmd)
+	addMigrationFlags(nativeTunCmd)
+	addHealthCheckFlags(nativeTunCmd)
+	addWorkerFlags(nativeTunCmd)
+	addMetricsFlags(nativeTunCmd)
+	addControlFlags(nativeTunCmd)
 	nativeTunCmd.Flags().StringP("interface-name", "n", "", "Custom inteface name for the TUN interface")
+	nativeTunCmd.Flags().StringArray("route", []string{}, "Linux only: Route this CIDR into the tunnel (can be repeated)")
+	nativeTunCmd.Flags().StringArray("exclude-route", []string{}, "Linux only: Keep this CIDR on its current route, outside the tunnel (can be repeated)")
+	nativeTunCmd.Flags().Bool("default-route", false, "Linux only: Route all traffic into the tunnel, except the traffic to the MASQUE endpoints")
+	nativeTunCmd.Flags().Bool("policy-routing", false, "Linux only: Route all traffic into the tunnel with fwmark based rules and a dedicated routing table instead of endpoint routes")
+	nativeTunCmd.Flags().Uint32("fwmark", 0x7573, "Linux only: Firewall mark set on the MASQUE socket, always set in policy routing mode and with --kill-switch")
+	nativeTunCmd.Flags().Int("route-table", 0x7573, "Linux only: Routing table used in policy routing mode")
+	nativeTunCmd.Flags().Bool("configure-dns", false, "Linux only: Point the resolver of the host to the --dns servers, through systemd-resolved or /etc/resolv.conf")
+	nativeTunCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use with --configure-dns")
+	nativeTunCmd.Flags().StringArray("dns-domain", []string{}, "Linux only: Search domain of the --dns servers, prefix with ~ for routing only domains (can be repeated, all queries if empty)")
+	nativeTunCmd.Flags().String("netns", "", "Linux only: Move the TUN device into this network namespace, created if it doesn't exist, and route all of its traffic into the tunnel")
+	nativeTunCmd.Flags().Bool("offload", false, "Linux only: Let the kernel hand over and take large TCP and UDP packets (GSO/GRO) for higher throughput")
+	nativeTunCmd.Flags().StringArray("gateway", []string{}, "Linux only: Act as a gateway for this LAN subnet, forwarding and masquerading its traffic into the tunnel (can be repeated)")
+	nativeTunCmd.Flags().Bool("kill-switch", false, "Linux only: Block all traffic outside the tunnel except loopback and the MASQUE connection, even while reconnecting")
 	rootCmd.AddCommand(nativeTunCmd)
 }
+
+// getPrefixes parses the CIDRs given with a repeatable string array flag.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command to read the flag from.
+//   - name: string - The name of the flag.
+//
+// Returns:
+//   - []netip.Prefix: The parsed prefixes, masked to their length.
+//   - error: An error if the flag can't be read or a CIDR is invalid.
+func getPrefixes(cmd *cobra.Command, name string) ([]netip.Prefix, error) {
+	values, err := cmd.Flags().GetStringArray(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
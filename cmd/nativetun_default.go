@@ -4,6 +4,7 @@ package cmd
 
 import (
 	"errors"
+	"net/netip"
 
 	"github.com/Diniboy1123/usque/api"
 )
@@ -14,3 +15,39 @@ var longDescription = "Expose Warp as a native TUN device that accepts any IP tr
 func (tun *tunDevice) create() (api.TunnelDevice, error) {
 	return nil, errors.New("nativetun is not supported on this platform")
 }
+
+func (t *tunDevice) setMTU(mtu int) error {
+	return errors.New("nativetun is not supported on this platform")
+}
+
+func (t *tunDevice) replaceAddress(old, new netip.Addr) error {
+	return errors.New("nativetun is not supported on this platform")
+}
+
+func (t *tunDevice) setupRoutes() (func(), error) {
+	if len(t.routes) > 0 || len(t.excludeRoutes) > 0 || t.defaultRoute || t.policyRouting {
+		return nil, errors.New("route management is only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func (t *tunDevice) setupKillSwitch(fwmark uint32) (func(), error) {
+	if t.killSwitch {
+		return nil, errors.New("the kill switch is only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func (t *tunDevice) setupGateway() (func(), error) {
+	if len(t.gateway) > 0 {
+		return nil, errors.New("gateway mode is only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func (t *tunDevice) setupDNS() (func(), error) {
+	if t.configureDNS {
+		return nil, errors.New("DNS configuration is only supported on Linux")
+	}
+	return func() {}, nil
+}
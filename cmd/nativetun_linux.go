@@ -3,59 +3,92 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/tun"
 )
 
+// routeSettleDelay is how long to wait for further route changes after the first one before
+// checking the routes to the endpoints again.
+const routeSettleDelay = 500 * time.Millisecond
+
 var longDescription = "Expose Warp as a native TUN device that accepts any IP traffic." +
-	" Requires root, tun.ko, and iproute2."
+	" Requires root, tun.ko, and iproute2. Routes can be managed with --route, --exclude-route and --default-route," +
+	" they are removed again when the tunnel exits. With --netns the device is moved into a network namespace."
 
-func (t *tunDevice) create() (api.TunnelDevice, error) {
-	platformSpecificParams := water.PlatformSpecificParams{
-		Name: t.name,
-	}
+func (t *tunDevice) create() (_ api.TunnelDevice, err error) {
+	// Every worker gets its own queue, the kernel spreads the flows over them
+	multiQueue := t.workers > 1
 
-	dev, err := water.New(water.Config{DeviceType: water.TUN, PlatformSpecificParams: platformSpecificParams})
+	dev, closer, err := t.openQueue(multiQueue)
 	if err != nil {
 		return nil, err
 	}
 
-	t.name = dev.Name()
+	// Queues are attached by name, so they have to be opened before the device leaves our namespace
+	closers := []io.Closer{closer}
+	defer func() {
+		if err != nil {
+			for _, closer := range closers {
+				closer.Close()
+			}
+			t.queues = nil
+		}
+	}()
+	for len(closers) < t.workers {
+		queue, closer, err := t.openQueue(multiQueue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open queue %d of %s: %v", len(closers), t.name, err)
+		}
+		closers = append(closers, closer)
+		t.queues = append(t.queues, queue)
+	}
+
+	if t.netns != "" {
+		if err := t.moveToNetns(); err != nil {
+			return nil, err
+		}
+	}
 
 	if t.iproute2 {
-		link, err := netlink.LinkByName(dev.Name())
+		h, err := t.netlinkHandle()
+		if err != nil {
+			return nil, err
+		}
+		defer h.Close()
+
+		link, err := h.LinkByName(t.name)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get link: %v", err)
 		}
 
-		if err := netlink.LinkSetMTU(link, t.mtu); err != nil {
+		if err := h.LinkSetMTU(link, t.mtu); err != nil {
 			return nil, fmt.Errorf("failed to set MTU: %v", err)
 		}
-		if t.ipv4 {
-			if err := netlink.AddrAdd(link, &netlink.Addr{
-				IPNet: &net.IPNet{
-					IP:   net.ParseIP(config.AppConfig.IPv4),
-					Mask: net.CIDRMask(32, 32),
-				}}); err != nil {
-				return nil, fmt.Errorf("failed to add IPv4 address: %v", err)
-			}
-		}
-		if t.ipv6 {
-			if err := netlink.AddrAdd(link, &netlink.Addr{
-				IPNet: &net.IPNet{
-					IP:   net.ParseIP(config.AppConfig.IPv6),
-					Mask: net.CIDRMask(128, 128),
-				}}); err != nil {
-				return nil, fmt.Errorf("failed to add IPv6 address: %v", err)
+		for _, addr := range t.addresses {
+			if err := h.AddrAdd(link, &netlink.Addr{IPNet: prefixToIPNet(netip.PrefixFrom(addr, addr.BitLen()))}); err != nil {
+				return nil, fmt.Errorf("failed to add address %s: %v", addr, err)
 			}
 		}
-		if err := netlink.LinkSetUp(link); err != nil {
+		if err := h.LinkSetUp(link); err != nil {
 			return nil, fmt.Errorf("failed to set link up: %v", err)
 		}
 	} else {
@@ -65,5 +98,709 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 		log.Printf("IPv6: %s", config.AppConfig.IPv6)
 	}
 
-	return api.NewWaterAdapter(dev), nil
+	return dev, nil
+}
+
+// openQueue opens the TUN device named by t.name, creating it if it doesn't exist yet, and sets
+// t.name to the name of the device. With --offload the device exchanges packets with a virtio net
+// header, which lets the kernel hand over and take large TCP and UDP packets (GSO/GRO).
+//
+// Parameters:
+//   - multiQueue: bool - Whether to open the device as one of several queues.
+//
+// Returns:
+//   - api.TunnelDevice: The opened queue.
+//   - io.Closer: Closes the queue.
+//   - error: An error if the device can't be opened.
+func (t *tunDevice) openQueue(multiQueue bool) (api.TunnelDevice, io.Closer, error) {
+	if !t.offload {
+		dev, err := water.New(water.Config{DeviceType: water.TUN, PlatformSpecificParams: water.PlatformSpecificParams{
+			Name:       t.name,
+			MultiQueue: multiQueue,
+		}})
+		if err != nil {
+			return nil, nil, err
+		}
+		t.name = dev.Name()
+		return api.NewWaterAdapter(dev), dev, nil
+	}
+
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	ifr, err := unix.NewIfreq(t.name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+	flags := uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if multiQueue {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	ifr.SetUint16(flags)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+
+	// Enables the offloads the kernel may use with us. The descriptor is owned by the
+	// returned device from here on, even on failure.
+	dev, name, err := tun.CreateUnmonitoredTUNFromFD(fd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to enable offloads: %v", err)
+	}
+	t.name = name
+	return api.NewOffloadAdapter(dev, t.mtu), dev, nil
+}
+
+// moveToNetns moves the TUN device into the network namespace given with --netns, creating the
+// namespace if it doesn't exist yet. A namespace created here is deleted again by close. The file
+// descriptor of the device stays usable in our namespace, so the MASQUE socket remains in the host one.
+//
+// Returns:
+//   - error: An error if the namespace can't be created or the device can't be moved.
+func (t *tunDevice) moveToNetns() error {
+	ns, err := netns.GetFromName(t.netns)
+	if errors.Is(err, os.ErrNotExist) {
+		ns, err = newNamedNetns(t.netns)
+		if err == nil {
+			log.Printf("Created network namespace %s", t.netns)
+			name := t.netns
+			t.cleanup = append(t.cleanup, func() {
+				if err := netns.DeleteNamed(name); err != nil {
+					log.Printf("Failed to delete network namespace %s: %v", name, err)
+				}
+			})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %v", t.netns, err)
+	}
+	defer ns.Close()
+
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		return fmt.Errorf("failed to move %s to network namespace %s: %v", t.name, t.netns, err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %v", t.netns, err)
+	}
+	defer h.Close()
+
+	// A fresh namespace has its loopback down, which surprises most programs
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to get loopback of network namespace %s: %v", t.netns, err)
+	}
+	if err := h.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("failed to set loopback of network namespace %s up: %v", t.netns, err)
+	}
+
+	log.Printf("Moved %s to network namespace %s", t.name, t.netns)
+	return nil
+}
+
+// newNamedNetns creates a named network namespace like `ip netns add` does, without
+// entering it.
+func newNamedNetns(name string) (netns.NsHandle, error) {
+	// Creating the namespace switches the current thread into it, so switch back on the same thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return netns.None(), err
+	}
+	defer orig.Close()
+
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		return netns.None(), err
+	}
+	if err := netns.Set(orig); err != nil {
+		ns.Close()
+		return netns.None(), err
+	}
+	return ns, nil
+}
+
+// netlinkHandle opens a netlink handle in the network namespace the TUN device lives in.
+// The caller has to close it.
+func (t *tunDevice) netlinkHandle() (*netlink.Handle, error) {
+	if t.netns == "" {
+		return netlink.NewHandle()
+	}
+
+	ns, err := netns.GetFromName(t.netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace %s: %v", t.netns, err)
+	}
+	defer ns.Close()
+	return netlink.NewHandleAt(ns)
+}
+
+// setMTU changes the MTU of the TUN device, e.g. after the path MTU changed.
+// Nothing is changed with --no-iproute2.
+//
+// Parameters:
+//   - mtu: int - The new MTU.
+//
+// Returns:
+//   - error: An error if the MTU couldn't be set.
+func (t *tunDevice) setMTU(mtu int) error {
+	if !t.iproute2 {
+		return nil
+	}
+
+	h, err := t.netlinkHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	link, err := h.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+	return h.LinkSetMTU(link, mtu)
+}
+
+// replaceAddress replaces an address of the TUN device, e.g. after the server assigned another one.
+// The new address is added before the old one is removed, so the device is never without one.
+//
+// Parameters:
+//   - old: netip.Addr - The address to remove.
+//   - new: netip.Addr - The address to add.
+//
+// Returns:
+//   - error: An error if the addresses aren't managed with --no-iproute2 or couldn't be changed.
+func (t *tunDevice) replaceAddress(old, new netip.Addr) error {
+	if !t.iproute2 {
+		return errors.New("addresses are not managed with --no-iproute2")
+	}
+
+	h, err := t.netlinkHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	link, err := h.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+	if err := h.AddrAdd(link, &netlink.Addr{IPNet: prefixToIPNet(netip.PrefixFrom(new, new.BitLen()))}); err != nil {
+		return fmt.Errorf("failed to add address: %v", err)
+	}
+	if err := h.AddrDel(link, &netlink.Addr{IPNet: prefixToIPNet(netip.PrefixFrom(old, old.BitLen()))}); err != nil {
+		return fmt.Errorf("failed to remove address: %v", err)
+	}
+	return nil
+}
+
+// setupRoutes installs the routes requested with --route, --exclude-route, --default-route and --policy-routing.
+//
+// The default route is installed as two halves per address family, so that the original default
+// route stays in place and keeps being used for the routes that bypass the tunnel. Excluded prefixes
+// and the MASQUE endpoints are pinned to the route they had before the tunnel routes were added,
+// otherwise the tunnel would end up carrying its own packets.
+//
+// With policy routing the default route goes into a dedicated routing table instead, which is used
+// for every packet without the firewall mark of the MASQUE socket. More specific routes of the main
+// table, like the local network or --exclude-route, still take precedence.
+//
+// Returns:
+//   - func(): Removes every route and rule that was added, in reverse order. Never nil on success.
+//   - error: An error if a route or rule couldn't be added. The ones added until then are removed.
+func (t *tunDevice) setupRoutes() (func(), error) {
+	routes := slices.Clone(t.routes)
+	if t.defaultRoute && !t.policyRouting {
+		routes = append(routes,
+			netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1"),
+			netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1"))
+	}
+	if len(routes) == 0 && len(t.excludeRoutes) == 0 && !t.policyRouting {
+		return func() {}, nil
+	}
+	if !t.iproute2 {
+		return nil, errors.New("routes can't be managed without setting up the link, remove --no-iproute2")
+	}
+	if t.netns != "" && (len(t.excludeRoutes) > 0 || t.policyRouting) {
+		return nil, errors.New("--exclude-route and --policy-routing can't be used with --netns, the namespace only has the TUN device")
+	}
+
+	h, err := t.netlinkHandle()
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := h.LinkByName(t.name)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to get link: %v", err)
+	}
+
+	// Bypass routes must be looked up before the tunnel routes change the answer
+	var bypass []*netlink.Route
+	for _, prefix := range t.excludeRoutes {
+		route, err := bypassRoute(prefix)
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("failed to look up route of excluded %s: %v", prefix, err)
+		}
+		bypass = append(bypass, route)
+	}
+
+	var undo []func()
+	stopWatching := func() {}
+	cleanup := func() {
+		stopWatching()
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		h.Close()
+	}
+	addRoute := func(route *netlink.Route) error {
+		if err := h.RouteAdd(route); err != nil {
+			if errors.Is(err, syscall.EEXIST) {
+				// Someone else owns this route, so leave it alone on cleanup
+				return nil
+			}
+			return fmt.Errorf("failed to add route %s: %v", route.Dst, err)
+		}
+		undo = append(undo, func() {
+			if err := h.RouteDel(route); err != nil {
+				log.Printf("Failed to remove route %s: %v", route.Dst, err)
+			}
+		})
+		return nil
+	}
+	addRule := func(rule *netlink.Rule) error {
+		if err := h.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add rule %s: %v", rule, err)
+		}
+		undo = append(undo, func() {
+			if err := h.RuleDel(rule); err != nil {
+				log.Printf("Failed to remove rule %s: %v", rule, err)
+			}
+		})
+		return nil
+	}
+
+	for _, route := range bypass {
+		if err := addRoute(route); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	if !t.policyRouting && t.netns == "" {
+		// With policy routing the marked MASQUE socket never sees the tunnel routes, and
+		// with a network namespace it lives in another one
+		endpoints := &endpointBypass{
+			h:       h,
+			tunLink: link.Attrs().Index,
+			routes:  make(map[netip.Addr]*netlink.Route),
+		}
+		undo = append(undo, endpoints.close)
+		endpoints.add(t.endpoints)
+		t.followEndpoints = endpoints.update
+		stopWatching = endpoints.watch()
+	}
+
+	for _, prefix := range routes {
+		if !t.familyEnabled(prefix) {
+			log.Printf("Skipping route %s, its address family is disabled inside the tunnel", prefix)
+			continue
+		}
+		if err := addRoute(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       prefixToIPNet(prefix),
+			Scope:     netlink.SCOPE_LINK,
+		}); err != nil {
+			cleanup()
+			return nil, err
+		}
+		log.Printf("Routing %s into the tunnel", prefix)
+	}
+
+	if t.policyRouting {
+		for _, prefix := range []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")} {
+			if !t.familyEnabled(prefix) {
+				continue
+			}
+			family := netlink.FAMILY_V4
+			if prefix.Addr().Is6() {
+				family = netlink.FAMILY_V6
+			}
+
+			if err := addRoute(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       prefixToIPNet(prefix),
+				Scope:     netlink.SCOPE_LINK,
+				Table:     t.table,
+			}); err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			// Everything but the MASQUE socket goes to our table...
+			tunnelRule := netlink.NewRule()
+			tunnelRule.Family = family
+			tunnelRule.Mark = t.fwmark
+			tunnelRule.Invert = true
+			tunnelRule.Table = t.table
+			if err := addRule(tunnelRule); err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			// ...unless the main table has something more specific than its default route.
+			// Rules added later are evaluated first.
+			mainRule := netlink.NewRule()
+			mainRule.Family = family
+			mainRule.Table = syscall.RT_TABLE_MAIN
+			mainRule.SuppressPrefixlen = 0
+			if err := addRule(mainRule); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		log.Printf("Routing all traffic into the tunnel using table %d and fwmark 0x%x", t.table, t.fwmark)
+	}
+
+	return cleanup, nil
+}
+
+// endpointBypass keeps host routes that send the MASQUE connection to the endpoints outside the
+// tunnel, even when routes into the tunnel cover them. The routes follow the endpoint candidates
+// and the network: an endpoint whose route leads into the tunnel gets a new one.
+type endpointBypass struct {
+	h *netlink.Handle
+	// tunLink is the index of the TUN device.
+	tunLink int
+
+	mu sync.Mutex
+	// routes are the bypass routes added, by endpoint address.
+	routes map[netip.Addr]*netlink.Route
+	// endpoints are the endpoint candidates last passed to add or update.
+	endpoints []*net.UDPAddr
+}
+
+// add adds bypass routes for endpoints on the routes they currently have. Must be called
+// before routes into the tunnel are added.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The endpoint candidates.
+func (b *endpointBypass) add(endpoints []*net.UDPAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints = endpoints
+
+	for _, addr := range endpointAddrs(endpoints) {
+		route, err := bypassRoute(netip.PrefixFrom(addr, addr.BitLen()))
+		if err != nil {
+			// The endpoint is probably unreachable anyway, e.g. IPv6 on an IPv4 only host
+			log.Printf("Failed to look up route of endpoint %s, skipping it: %v", addr, err)
+			continue
+		}
+		b.addRoute(addr, route)
+	}
+}
+
+// update adds a bypass route for every endpoint whose traffic would enter the tunnel, e.g. because
+// it wasn't a candidate before or the network its bypass route went through is gone. The new route
+// goes through the default route of the main table.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The endpoint candidates, nil to check the last ones again.
+func (b *endpointBypass) update(endpoints []*net.UDPAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if endpoints != nil {
+		b.endpoints = endpoints
+	}
+
+	for _, addr := range endpointAddrs(b.endpoints) {
+		current, err := netlink.RouteGet(addr.AsSlice())
+		if err == nil && len(current) > 0 && current[0].LinkIndex != b.tunLink {
+			continue
+		}
+		route, err := b.outsideRoute(addr)
+		if err != nil {
+			// Most likely there is no network at the moment, a later change brings it back
+			continue
+		}
+		b.addRoute(addr, route)
+	}
+}
+
+// addRoute adds a bypass route to addr, replacing one added before. Must be called with b.mu held.
+func (b *endpointBypass) addRoute(addr netip.Addr, route *netlink.Route) {
+	if old, ok := b.routes[addr]; ok {
+		// Usually already removed along with the network it went through
+		b.h.RouteDel(old)
+		delete(b.routes, addr)
+	}
+	if err := b.h.RouteAdd(route); err != nil {
+		if !errors.Is(err, syscall.EEXIST) {
+			log.Printf("Failed to add route to endpoint %s: %v", addr, err)
+		}
+		// Someone else owns an existing route, so leave it alone on cleanup
+		return
+	}
+	b.routes[addr] = route
+	log.Printf("Routing endpoint %s outside the tunnel via link %d", addr, route.LinkIndex)
+}
+
+// outsideRoute builds a bypass route to addr through the default route of the main table with the
+// lowest metric that doesn't lead into the tunnel.
+//
+// Parameters:
+//   - addr: netip.Addr - The address of the endpoint.
+//
+// Returns:
+//   - *netlink.Route: The route to add.
+//   - error: An error if the routes can't be listed or there is no default route.
+func (b *endpointBypass) outsideRoute(addr netip.Addr) (*netlink.Route, error) {
+	family := netlink.FAMILY_V4
+	if addr.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := b.h.RouteListFiltered(family, &netlink.Route{Table: syscall.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *netlink.Route
+	for i, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if route.LinkIndex == 0 || route.LinkIndex == b.tunLink {
+			continue
+		}
+		if best == nil || route.Priority < best.Priority {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no default route found")
+	}
+	return routeVia(netip.PrefixFrom(addr, addr.BitLen()), best), nil
+}
+
+// watch checks the bypass routes again whenever the routes of the host change, until the returned
+// function is called.
+//
+// Returns:
+//   - func(): Stops watching.
+func (b *endpointBypass) watch() func() {
+	done := make(chan struct{})
+	updates := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(updates, done); err != nil {
+		log.Printf("Failed to watch for route changes, routes to new endpoints are only added on reconnects: %v", err)
+		return func() {}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for range updates {
+			// Changes come in bursts, and our own routes cause another one
+			timer := time.NewTimer(routeSettleDelay)
+		settle:
+			for {
+				select {
+				case _, ok := <-updates:
+					if !ok {
+						timer.Stop()
+						return
+					}
+				case <-timer.C:
+					break settle
+				}
+			}
+			b.update(nil)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// close removes every bypass route added.
+func (b *endpointBypass) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for addr, route := range b.routes {
+		if err := b.h.RouteDel(route); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Printf("Failed to remove route to endpoint %s: %v", addr, err)
+		}
+	}
+	b.routes = nil
+}
+
+// endpointAddrs returns the addresses of endpoints.
+func endpointAddrs(endpoints []*net.UDPAddr) []netip.Addr {
+	var addrs []netip.Addr
+	for _, endpoint := range endpoints {
+		addr, ok := netip.AddrFromSlice(endpoint.IP)
+		if !ok {
+			continue
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs
+}
+
+// setupKillSwitch installs the kill switch if it was requested with --kill-switch.
+//
+// Parameters:
+//   - fwmark: uint32 - The firewall mark of the MASQUE socket, always set with --kill-switch.
+//
+// Returns:
+//   - func(): Removes the kill switch. Never nil on success.
+//   - error: An error if the kill switch couldn't be installed.
+func (t *tunDevice) setupKillSwitch(fwmark uint32) (func(), error) {
+	if !t.killSwitch {
+		return func() {}, nil
+	}
+	if t.netns != "" {
+		return nil, errors.New("--kill-switch can't be used with --netns, the namespace only has the TUN device anyway")
+	}
+
+	if fwmark == 0 {
+		return nil, errors.New("--kill-switch needs a non-zero --fwmark to recognize the MASQUE connection by")
+	}
+
+	killSwitch, err := internal.EnableKillSwitch(t.name, fwmark)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Kill switch enabled, only the MASQUE connection may leave outside %s", t.name)
+
+	return func() {
+		if err := killSwitch.Disable(); err != nil {
+			log.Printf("Failed to disable kill switch: %v", err)
+		}
+	}, nil
+}
+
+// setupGateway lets the LAN subnets given with --gateway use the tunnel: it enables forwarding,
+// masquerades their traffic leaving through the TUN device, drops it anywhere else and clamps the
+// TCP MSS to its MTU.
+//
+// Returns:
+//   - func(): Removes the rules and restores the forwarding settings. Never nil on success.
+//   - error: An error if the gateway couldn't be set up.
+func (t *tunDevice) setupGateway() (func(), error) {
+	if len(t.gateway) == 0 {
+		return func() {}, nil
+	}
+	if t.netns != "" {
+		return nil, errors.New("--gateway can't be used with --netns, the TUN device isn't in the namespace the LAN is in")
+	}
+
+	gateway, err := internal.EnableGateway(t.name, t.gateway, t.mtu)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Gateway enabled for %v", t.gateway)
+
+	return func() {
+		if err := gateway.Disable(); err != nil {
+			log.Printf("Failed to disable gateway: %v", err)
+		}
+	}, nil
+}
+
+// setupDNS points the resolver of the host to the DNS servers of the tunnel if it was requested with --configure-dns.
+//
+// Returns:
+//   - func(): Restores the previous DNS configuration. Never nil on success.
+//   - error: An error if the DNS configuration couldn't be applied.
+func (t *tunDevice) setupDNS() (func(), error) {
+	if !t.configureDNS {
+		return func() {}, nil
+	}
+
+	var servers []netip.Addr
+	for _, server := range t.dns {
+		if (server.Is4() && t.ipv4) || (server.Is6() && t.ipv6) {
+			servers = append(servers, server)
+		}
+	}
+
+	var restore func() error
+	var err error
+	if t.netns != "" {
+		// `ip netns exec` bind mounts this over /etc/resolv.conf
+		restore, err = internal.ConfigureNetnsDNS(t.netns, servers, t.dnsDomains)
+	} else {
+		restore, err = internal.ConfigureLinkDNS(t.name, servers, t.dnsDomains)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using DNS servers %v", servers)
+
+	return func() {
+		if err := restore(); err != nil {
+			log.Printf("Failed to restore DNS configuration: %v", err)
+		}
+	}, nil
+}
+
+// bypassRoute returns a route for prefix that uses the same gateway and link as the route the
+// kernel currently picks for its first address.
+//
+// Parameters:
+//   - prefix: netip.Prefix - The prefix to route.
+//
+// Returns:
+//   - *netlink.Route: The route to add.
+//   - error: An error if the current route can't be looked up.
+func bypassRoute(prefix netip.Prefix) (*netlink.Route, error) {
+	current, err := netlink.RouteGet(prefix.Addr().AsSlice())
+	if err != nil {
+		return nil, err
+	}
+	if len(current) == 0 {
+		return nil, errors.New("no route found")
+	}
+
+	return routeVia(prefix, &current[0]), nil
+}
+
+// routeVia builds a route to prefix through the link and gateway of via.
+func routeVia(prefix netip.Prefix, via *netlink.Route) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: via.LinkIndex,
+		Dst:       prefixToIPNet(prefix),
+		Gw:        via.Gw,
+	}
+	if route.Gw == nil {
+		// Directly connected, like the routes iproute2 adds without a gateway
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route
+}
+
+// prefixToIPNet converts a netip.Prefix to the net.IPNet netlink expects.
+func prefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
 }
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// TestProbeRouted checks which URL health checks nativetun accepts, depending on the routes into
+// the tunnel.
+func TestProbeRouted(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var p []netip.Prefix
+		for _, prefix := range s {
+			p = append(p, netip.MustParsePrefix(prefix))
+		}
+		return p
+	}
+
+	tests := []struct {
+		name   string
+		device tunDevice
+		url    string
+		want   bool
+	}{
+		{"hostname without routes", tunDevice{ipv4: true, ipv6: true}, "https://cloudflareok.com/test", false},
+		{"IP without routes", tunDevice{ipv4: true, ipv6: true}, "http://1.1.1.1/", false},
+		{"hostname with the default route", tunDevice{ipv4: true, ipv6: true, defaultRoute: true}, "https://cloudflareok.com/test", true},
+		{"hostname with policy routing", tunDevice{ipv4: true, ipv6: true, policyRouting: true}, "https://cloudflareok.com/test", true},
+		{"hostname with a route", tunDevice{ipv4: true, ipv6: true, routes: prefixes("1.1.1.0/24")}, "https://cloudflareok.com/test", false},
+		{"IP with a route", tunDevice{ipv4: true, ipv6: true, routes: prefixes("1.1.1.0/24")}, "http://1.1.1.1/", true},
+		{"IPv6 with a route", tunDevice{ipv4: true, ipv6: true, routes: prefixes("2606:4700::/32")}, "http://[2606:4700:4700::1111]:8080/", true},
+		{"IP outside the routes", tunDevice{ipv4: true, ipv6: true, routes: prefixes("1.0.0.0/24")}, "http://1.1.1.1/", false},
+		{
+			"excluded IP with the default route",
+			tunDevice{ipv4: true, ipv6: true, defaultRoute: true, excludeRoutes: prefixes("1.1.1.0/24")},
+			"http://1.1.1.1/", false,
+		},
+		{"IPv6 disabled in the tunnel", tunDevice{ipv4: true, defaultRoute: true}, "http://[2606:4700:4700::1111]/", false},
+		{"network namespace", tunDevice{ipv4: true, ipv6: true, defaultRoute: true, netns: "usque"}, "http://1.1.1.1/", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.device.probeRouted(tt.url); got != tt.want {
+				t.Errorf("probeRouted(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
@@ -15,6 +17,13 @@ var longDescription = "Expose Warp as a native TUN device that accepts any IP tr
 	" Requires wintun.dll and administrator rights."
 
 func (t *tunDevice) create() (api.TunnelDevice, error) {
+	if t.netns != "" {
+		return nil, errors.New("network namespaces are only supported on Linux")
+	}
+	if t.offload {
+		return nil, errors.New("offloads are only supported on Linux")
+	}
+
 	if t.name == "" {
 		t.name = "usque"
 	}
@@ -55,3 +64,56 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 
 	return api.NewNetstackAdapter(dev), nil
 }
+
+func (t *tunDevice) setMTU(mtu int) error {
+	if t.ipv4 {
+		if err := internal.SetIPv4MTU(t.name, mtu); err != nil {
+			return fmt.Errorf("failed to set IPv4 MTU: %v", err)
+		}
+	}
+	if t.ipv6 {
+		if err := internal.SetIPv6MTU(t.name, mtu); err != nil {
+			return fmt.Errorf("failed to set IPv6 MTU: %v", err)
+		}
+	}
+	return nil
+}
+
+func (t *tunDevice) replaceAddress(old, new netip.Addr) error {
+	if new.Is4() {
+		// Setting a static IPv4 address replaces the previous one
+		return internal.SetIPv4Address(t.name, new.String(), "255.255.255.255")
+	}
+	if err := internal.SetIPv6Address(t.name, new.String(), "128"); err != nil {
+		return err
+	}
+	return internal.DeleteIPv6Address(t.name, old.String())
+}
+
+func (t *tunDevice) setupRoutes() (func(), error) {
+	if len(t.routes) > 0 || len(t.excludeRoutes) > 0 || t.defaultRoute || t.policyRouting {
+		return nil, errors.New("route management is only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func (t *tunDevice) setupKillSwitch(fwmark uint32) (func(), error) {
+	if t.killSwitch {
+		return nil, errors.New("the kill switch is only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func (t *tunDevice) setupGateway() (func(), error) {
+	if len(t.gateway) > 0 {
+		return nil, errors.New("gateway mode is only supported on Linux")
+	}
+	return func() {}, nil
+}
+
+func (t *tunDevice) setupDNS() (func(), error) {
+	if t.configureDNS {
+		return nil, errors.New("DNS configuration is only supported on Linux")
+	}
+	return func() {}, nil
+}
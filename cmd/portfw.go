@@ -2,12 +2,17 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/Diniboy1123/usque/api"
@@ -21,8 +26,9 @@ var portFwCmd = &cobra.Command{
 	Use:   "portfw",
 	Short: "Forward ports through a MASQUE tunnel",
 	Long: "This tool is useful if you have Cloudflare Zero Trust Gateway enabled and want to forward ports to/from the tunnel." +
-		" It creates a virtual TUN device and forward ports through it either from or to the client. It works a bit like SSH port forwarding. TCP only at the moment." +
-		"Doesn't require elevated privileges.",
+		" It creates a virtual TUN device and forward ports through it either from or to the client. It works a bit like SSH port forwarding." +
+		" UDP ports can be forwarded by prefixing the mapping with udp/, -D starts a SOCKS5 proxy for dynamic forwarding." +
+		" Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if !config.ConfigLoaded {
 			cmd.Println("Config not loaded. Please register first.")
@@ -57,6 +63,14 @@ var portFwCmd = &cobra.Command{
 			cmd.Printf("Failed to prepare TLS config: %v\n", err)
 			return
 		}
+		sessionCache, err := getSessionCache(cmd, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			cmd.Printf("Failed to get session cache: %v\n", err)
+			return
+		}
+		if sessionCache != nil {
+			tlsConfig.ClientSessionCache = sessionCache
+		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
@@ -69,23 +83,22 @@ var portFwCmd = &cobra.Command{
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		endpoints, err := getEndpoints(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to get endpoints: %v\n", err)
 			return
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
+		attemptDelay, err := cmd.Flags().GetDuration("endpoint-attempt-delay")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint attempt delay: %v\n", err)
+			return
+		}
+
+		failoverAttempts, err := cmd.Flags().GetInt("endpoint-failover")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint failover attempts: %v\n", err)
+			return
 		}
 
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
@@ -134,14 +147,11 @@ var portFwCmd = &cobra.Command{
 			dnsAddrs = append(dnsAddrs, addr)
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
+		mtu, pathMTUDiscovery, err := getMTU(cmd)
 		if err != nil {
 			cmd.Printf("Failed to get MTU: %v\n", err)
 			return
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
 
 		localPorts, err := cmd.Flags().GetStringArray("local-ports")
 		if err != nil {
@@ -176,9 +186,60 @@ var portFwCmd = &cobra.Command{
 			remotePortMappings = append(remotePortMappings, portMapping)
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		dynamicPorts, err := cmd.Flags().GetStringArray("dynamic-ports")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
+			cmd.Printf("Failed to get dynamic ports: %v\n", err)
+			return
+		}
+
+		dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get DNS timeout: %v\n", err)
+			return
+		}
+
+		// Open the dynamic forwarding listeners before connecting, so that a taken port is reported right away
+		var dynamicListeners []net.Listener
+		defer func() {
+			for _, listener := range dynamicListeners {
+				listener.Close()
+			}
+		}()
+		for _, port := range dynamicPorts {
+			addr, err := internal.ParseDynamicForward(port)
+			if err != nil {
+				cmd.Printf("Failed to parse dynamic port mapping: %v\n", err)
+				return
+			}
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				cmd.Printf("Failed to listen on %s: %v\n", addr, err)
+				return
+			}
+			dynamicListeners = append(dynamicListeners, listener)
+		}
+
+		udpIdleTimeout, err := cmd.Flags().GetDuration("udp-idle-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get UDP idle timeout: %v\n", err)
+			return
+		}
+
+		reconnectPolicy, err := getReconnectPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get reconnect policy: %v\n", err)
+			return
+		}
+
+		migration, err := getMigration(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get migration: %v\n", err)
+			return
+		}
+
+		workers, err := getWorkers(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get workers: %v\n", err)
 			return
 		}
 
@@ -187,16 +248,66 @@ var portFwCmd = &cobra.Command{
 			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
 			return
 		}
-		defer tunDev.Close()
+		// Stopping the tunnel closes the device as well, closing the adapter again is a no-op
+		device := api.NewNetstackDevice(tunDev)
+		defer device.Close()
+
+		healthCheck, err := getHealthCheck(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to get health check: %v\n", err)
+			return
+		}
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+		saveAddresses, err := getAddressSaver(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get config path: %v\n", err)
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		tunnel := api.NewTunnel(api.TunnelConfig{
+			TLSConfig:         tlsConfig,
+			KeepalivePeriod:   keepalivePeriod,
+			InitialPacketSize: initialPacketSize,
+			Endpoints:         endpoints,
+			AttemptDelay:      attemptDelay,
+			FailoverAttempts:  failoverAttempts,
+			Device:            device,
+			MTU:               mtu,
+			PathMTUDiscovery:  pathMTUDiscovery,
+			ReconnectPolicy:   reconnectPolicy,
+			Migration:         migration,
+			HealthCheck:       healthCheck,
+			LocalAddresses:    localAddresses,
+			OnAddressAssign:   saveAddresses,
+			Workers:           workers,
+		})
+		stopMetrics, err := startMetricsServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start metrics server: %v\n", err)
+			return
+		}
+		defer stopMetrics()
+		stopControl, err := startControlServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start control API: %v\n", err)
+			return
+		}
+		defer stopControl()
+		if err := tunnel.Start(ctx); err != nil {
+			cmd.Printf("Failed to start tunnel: %v\n", err)
+			return
+		}
+		defer tunnel.Stop()
 
 		log.Printf("Virtual tunnel created, forwarding ports")
 
 		// Start Local Port Forwarding (-L)
 		for _, pm := range localPortMappings {
 			go func(pm internal.PortMapping) {
-				err := forwardPort(tunNet, pm, false) // false = local forwarding
+				err := forwardPort(tunnel, tunNet, pm, false, udpIdleTimeout) // false = local forwarding
 				if err != nil {
 					cmd.Printf("Error in local forwarding %d: %v\n", pm.LocalPort, err)
 				}
@@ -206,46 +317,81 @@ var portFwCmd = &cobra.Command{
 		// Start Remote Port Forwarding (-R)
 		for _, pm := range remotePortMappings {
 			go func(pm internal.PortMapping) {
-				err := forwardPort(tunNet, pm, true) // true = remote forwarding
+				err := forwardPort(tunnel, tunNet, pm, true, udpIdleTimeout) // true = remote forwarding
 				if err != nil {
 					cmd.Printf("Error in remote forwarding %d: %v\n", pm.LocalPort, err)
 				}
 			}(pm)
 		}
 
-		// One packet must be sent in order to listen for incoming packets
-		// a ping may suffice as well, but we will use a simple GET request
-		client := &http.Client{
-			Transport: &http.Transport{
-				DialContext: tunNet.DialContext,
-			},
-		}
-		resp, err := client.Get("https://cloudflareok.com/test")
-		if err != nil {
-			cmd.Printf("Failed to make request to cloudflare.com: %v\n", err)
-			return
+		// Start Dynamic Port Forwarding (-D)
+		if len(dynamicListeners) > 0 {
+			server := newSocksServer(tunnel, tunNet, internal.TunnelDNSResolver{TunNet: tunNet, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}, "", "", udpIdleTimeout)
+			for _, listener := range dynamicListeners {
+				go func(listener net.Listener) {
+					log.Printf("Dynamic forwarding: SOCKS proxy listening on %s", listener.Addr())
+					if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+						cmd.Printf("Error in dynamic forwarding %s: %v\n", listener.Addr(), err)
+					}
+				}(listener)
+			}
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 204 {
-			cmd.Printf("Failed to make request to cloudflare.com: %s\n", resp.Status)
+
+		if err := announceTunnel(tunNet); err != nil {
+			cmd.Printf("%v\n", err)
 			return
 		}
 		log.Println("Successfully connected to Cloudflare")
 
-		select {}
+		if err := tunnel.Wait(); err != nil {
+			log.Printf("Tunnel stopped: %v", err)
+		}
 	},
 }
 
+// announceTunnel sends a request through the tunnel. One packet must be sent in order to
+// listen for incoming packets, a ping may suffice as well, but we use a simple GET request.
+//
+// Parameters:
+//   - tunNet: *netstack.Net - The network stack of the tunnel.
+//
+// Returns:
+//   - error: An error if the request fails.
+func announceTunnel(tunNet *netstack.Net) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: tunNet.DialContext,
+		},
+	}
+	resp, err := client.Get("https://cloudflareok.com/test")
+	if err != nil {
+		return fmt.Errorf("failed to make request to cloudflare.com: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 204 {
+		return fmt.Errorf("failed to make request to cloudflare.com: %s", resp.Status)
+	}
+	return nil
+}
+
 // forwardPort sets up a local or remote port forwarding using either the MASQUE tunnel or the local network.
 //
+// Local connections are refused while the tunnel is down.
+//
 // Parameters:
+//   - tunnel: *api.Tunnel - The tunnel carrying the forwarded traffic.
 //   - netstackNet: *netstack.Net - The network stack used for handling remote forwarding.
 //   - pm: internal.PortMapping - The port mapping configuration containing bind address, local port, remote IP, and remote port.
 //   - isRemote: bool - Indicates whether the forwarding is remote (true) or local (false).
+//   - udpIdleTimeout: time.Duration - The time after which an idle UDP session is closed.
 //
 // Returns:
 //   - error: An error if port forwarding fails; otherwise, nil.
-func forwardPort(netstackNet *netstack.Net, pm internal.PortMapping, isRemote bool) error {
+func forwardPort(tunnel *api.Tunnel, netstackNet *netstack.Net, pm internal.PortMapping, isRemote bool, udpIdleTimeout time.Duration) error {
+	if pm.Network == "udp" {
+		return forwardUDPPort(tunnel, netstackNet, pm, isRemote, udpIdleTimeout)
+	}
+
 	localAddrPort, err := netip.ParseAddrPort(fmt.Sprintf("%s:%d", pm.BindAddress, pm.LocalPort))
 	if err != nil {
 		return fmt.Errorf("invalid local address: %w", err)
@@ -287,11 +433,83 @@ func forwardPort(netstackNet *netstack.Net, pm internal.PortMapping, isRemote bo
 				continue
 			}
 
+			if !tunnel.Connected() {
+				log.Printf("Refusing connection from %s: %v", conn.RemoteAddr(), api.ErrTunnelDown)
+				conn.Close()
+				continue
+			}
+
 			go handleConnection(conn, pm, isRemote, netstackNet)
 		}
 	}
 }
 
+// forwardUDPPort sets up a local or remote UDP port forwarding. Every source address gets its own
+// session, which is closed after being idle for udpIdleTimeout.
+//
+// New local sessions are refused while the tunnel is down.
+//
+// Parameters:
+//   - tunnel: *api.Tunnel - The tunnel carrying the forwarded traffic.
+//   - netstackNet: *netstack.Net - The network stack of the tunnel.
+//   - pm: internal.PortMapping - The port mapping configuration.
+//   - isRemote: bool - Indicates whether the forwarding is remote (true) or local (false).
+//   - udpIdleTimeout: time.Duration - The time after which an idle session is closed.
+//
+// Returns:
+//   - error: An error if port forwarding fails; otherwise, nil.
+func forwardUDPPort(tunnel *api.Tunnel, netstackNet *netstack.Net, pm internal.PortMapping, isRemote bool, udpIdleTimeout time.Duration) error {
+	localAddr, err := netip.ParseAddr(pm.BindAddress)
+	if err != nil {
+		return fmt.Errorf("invalid local address: %w", err)
+	}
+	localAddrPort := netip.AddrPortFrom(localAddr.Unmap(), uint16(pm.LocalPort))
+
+	remote := net.JoinHostPort(pm.RemoteIP, strconv.Itoa(pm.RemotePort))
+
+	forwarder := &internal.UDPForwarder{IdleTimeout: udpIdleTimeout}
+	if isRemote {
+		// Remote forwarding: Listen inside the MASQUE tunnel, forward to the local network
+		listener, err := netstackNet.ListenUDPAddrPort(localAddrPort)
+		if err != nil {
+			return fmt.Errorf("failed to listen on udp/%s: %w", localAddrPort, err)
+		}
+		forwarder.Listener = listener
+		forwarder.Dial = func() (net.Conn, error) {
+			return net.Dial("udp", remote)
+		}
+
+		log.Printf("Remote forwarding: Listening on MASQUE network udp/%s, forwarding to local %s", localAddrPort, remote)
+	} else {
+		// Local forwarding: Listen on local machine, forward into the MASQUE tunnel
+		remoteAddr, err := netip.ParseAddr(pm.RemoteIP)
+		if err != nil {
+			return fmt.Errorf("invalid remote address: %w", err)
+		}
+		remoteAddrPort := netip.AddrPortFrom(remoteAddr.Unmap(), uint16(pm.RemotePort))
+
+		listener, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localAddrPort))
+		if err != nil {
+			return fmt.Errorf("failed to listen on udp/%s: %w", localAddrPort, err)
+		}
+		metrics := internal.NewProxyMetrics("portfw")
+		forwarder.Listener = listener
+		forwarder.Dial = func() (net.Conn, error) {
+			if !tunnel.Connected() {
+				return nil, api.ErrTunnelDown
+			}
+			return metrics.Dial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return netstackNet.DialUDPAddrPort(netip.AddrPort{}, remoteAddrPort)
+			})(context.Background(), "udp", remoteAddrPort.String())
+		}
+
+		log.Printf("Local forwarding: Listening on udp/%s, forwarding to remote %s", localAddrPort, remoteAddrPort)
+	}
+	defer forwarder.Listener.Close()
+
+	return forwarder.Serve()
+}
+
 // handleConnection manages an individual forwarded connection between the local and remote endpoints.
 //
 // Parameters:
@@ -300,6 +518,11 @@ func forwardPort(netstackNet *netstack.Net, pm internal.PortMapping, isRemote bo
 //   - isRemote: bool - Indicates whether the connection is remote-forwarded.
 //   - tunNet: *netstack.Net - The network stack used for making remote connections.
 func handleConnection(localConn net.Conn, pm internal.PortMapping, isRemote bool, tunNet *netstack.Net) {
+	metrics := internal.NewProxyMetrics("portfw")
+	if isRemote {
+		// The accepted connection is the one inside the tunnel
+		localConn = metrics.Track(localConn)
+	}
 	defer localConn.Close()
 
 	remoteAddrPort, err := netip.ParseAddrPort(fmt.Sprintf("%s:%d", pm.RemoteIP, pm.RemotePort))
@@ -314,7 +537,7 @@ func handleConnection(localConn net.Conn, pm internal.PortMapping, isRemote bool
 		remoteConn, err = net.Dial("tcp", remoteAddrPort.String())
 	} else {
 		// Local forwarding: Connect inside the tunnel network
-		remoteConn, err = tunNet.DialContext(context.Background(), "tcp", remoteAddrPort.String())
+		remoteConn, err = metrics.Dial(tunNet.DialContext)(context.Background(), "tcp", remoteAddrPort.String())
 	}
 
 	if err != nil {
@@ -328,17 +551,25 @@ func handleConnection(localConn net.Conn, pm internal.PortMapping, isRemote bool
 }
 
 func init() {
-	portFwCmd.Flags().StringArrayP("local-ports", "L", []string{}, "List of port mappings to forward (SSH like e.g. localhost:8080:100.96.0.2:8080)")
-	portFwCmd.Flags().StringArrayP("remote-ports", "R", []string{}, "List of port mappings to forward (SSH like e.g. 100.96.0.3:8080:localhost:8080)")
-	portFwCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	portFwCmd.Flags().StringArrayP("local-ports", "L", []string{}, "List of port mappings to forward (SSH like e.g. localhost:8080:100.96.0.2:8080, prefix with udp/ for UDP)")
+	portFwCmd.Flags().StringArrayP("remote-ports", "R", []string{}, "List of port mappings to forward (SSH like e.g. 100.96.0.3:8080:localhost:8080, prefix with udp/ for UDP)")
+	portFwCmd.Flags().StringArrayP("dynamic-ports", "D", []string{}, "List of SOCKS5 proxy addresses for dynamic forwarding (SSH like e.g. 1080 or localhost:1080)")
+	addEndpointFlags(portFwCmd)
 	portFwCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use inside the MASQUE tunnel")
-	portFwCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	portFwCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries of dynamic forwarding")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	portFwCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	portFwCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
-	portFwCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
-	portFwCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	portFwCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	addMTUFlags(portFwCmd)
+	portFwCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection, path MTU discovery starts from it")
+	addSessionCacheFlags(portFwCmd)
+	portFwCmd.Flags().Duration("udp-idle-timeout", internal.DefaultUDPIdleTimeout, "Close UDP forwarding sessions and SOCKS UDP associations after being idle for this long")
+	addReconnectFlags(portFwCmd)
+	addMigrationFlags(portFwCmd)
+	addHealthCheckFlags(portFwCmd)
+	addWorkerFlags(portFwCmd)
+	addMetricsFlags(portFwCmd)
+	addControlFlags(portFwCmd)
 	rootCmd.AddCommand(portFwCmd)
 }
@@ -97,6 +97,7 @@ var registerCmd = &cobra.Command{
 			EndpointV4: updatedAccountData.Config.Peers[0].Endpoint.V4[:len(updatedAccountData.Config.Peers[0].Endpoint.V4)-2],
 			// strip [ from beginning and ]:0 from end
 			EndpointV6:     updatedAccountData.Config.Peers[0].Endpoint.V6[1 : len(updatedAccountData.Config.Peers[0].Endpoint.V6)-3],
+			EndpointPorts:  updatedAccountData.Config.Peers[0].Endpoint.Ports,
 			EndpointPubKey: updatedAccountData.Config.Peers[0].PublicKey,
 			License:        updatedAccountData.Account.License,
 			ID:             updatedAccountData.ID,
@@ -0,0 +1,375 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run several proxies and port forwards over a single tunnel",
+	Long: "Creates a single MASQUE tunnel and attaches every SOCKS5 proxy, HTTP proxy and port forward" +
+		" defined in a JSON file to it. Tunnel options are set with flags like in the other modes." +
+		" Doesn't require elevated privileges.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			cmd.Println("Config not loaded. Please register first.")
+			return
+		}
+
+		serveConfigPath, err := cmd.Flags().GetString("file")
+		if err != nil {
+			cmd.Printf("Failed to get serve config path: %v\n", err)
+			return
+		}
+
+		serveConfig, err := config.LoadServeConfig(serveConfigPath)
+		if err != nil {
+			cmd.Printf("Failed to load serve config: %v\n", err)
+			return
+		}
+
+		var localPortMappings []internal.PortMapping
+		for _, port := range serveConfig.PortForwards.Local {
+			portMapping, err := internal.ParsePortMapping(port)
+			if err != nil {
+				cmd.Printf("Failed to parse local port mapping: %v\n", err)
+				return
+			}
+			localPortMappings = append(localPortMappings, portMapping)
+		}
+
+		var remotePortMappings []internal.PortMapping
+		for _, port := range serveConfig.PortForwards.Remote {
+			portMapping, err := internal.ParsePortMapping(port)
+			if err != nil {
+				cmd.Printf("Failed to parse remote port mapping: %v\n", err)
+				return
+			}
+			remotePortMappings = append(remotePortMappings, portMapping)
+		}
+
+		sni, err := cmd.Flags().GetString("sni-address")
+		if err != nil {
+			cmd.Printf("Failed to get SNI address: %v\n", err)
+			return
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			cmd.Printf("Failed to get private key: %v\n", err)
+			return
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			cmd.Printf("Failed to get public key: %v\n", err)
+			return
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			cmd.Printf("Failed to generate cert: %v\n", err)
+			return
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			cmd.Printf("Failed to prepare TLS config: %v\n", err)
+			return
+		}
+		sessionCache, err := getSessionCache(cmd, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			cmd.Printf("Failed to get session cache: %v\n", err)
+			return
+		}
+		if sessionCache != nil {
+			tlsConfig.ClientSessionCache = sessionCache
+		}
+
+		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+		if err != nil {
+			cmd.Printf("Failed to get keepalive period: %v\n", err)
+			return
+		}
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			cmd.Printf("Failed to get initial packet size: %v\n", err)
+			return
+		}
+
+		endpoints, err := getEndpoints(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get endpoints: %v\n", err)
+			return
+		}
+
+		attemptDelay, err := cmd.Flags().GetDuration("endpoint-attempt-delay")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint attempt delay: %v\n", err)
+			return
+		}
+
+		failoverAttempts, err := cmd.Flags().GetInt("endpoint-failover")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint failover attempts: %v\n", err)
+			return
+		}
+
+		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		if err != nil {
+			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
+			return
+		}
+
+		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
+		if err != nil {
+			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
+			return
+		}
+
+		var localAddresses []netip.Addr
+		if !tunnelIPv4 {
+			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
+			if err != nil {
+				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
+				return
+			}
+			localAddresses = append(localAddresses, v4)
+		}
+		if !tunnelIPv6 {
+			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
+			if err != nil {
+				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
+				return
+			}
+			localAddresses = append(localAddresses, v6)
+		}
+
+		dnsServers, err := cmd.Flags().GetStringArray("dns")
+		if err != nil {
+			cmd.Printf("Failed to get DNS servers: %v\n", err)
+			return
+		}
+
+		var dnsAddrs []netip.Addr
+		for _, dns := range dnsServers {
+			addr, err := netip.ParseAddr(dns)
+			if err != nil {
+				cmd.Printf("Failed to parse DNS server: %v\n", err)
+				return
+			}
+			dnsAddrs = append(dnsAddrs, addr)
+		}
+
+		dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get DNS timeout: %v\n", err)
+			return
+		}
+
+		localDNS, err := cmd.Flags().GetBool("local-dns")
+		if err != nil {
+			cmd.Printf("Failed to get local-dns flag: %v\n", err)
+			return
+		}
+
+		mtu, pathMTUDiscovery, err := getMTU(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get MTU: %v\n", err)
+			return
+		}
+
+		udpIdleTimeout, err := cmd.Flags().GetDuration("udp-idle-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get UDP idle timeout: %v\n", err)
+			return
+		}
+
+		reconnectPolicy, err := getReconnectPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get reconnect policy: %v\n", err)
+			return
+		}
+
+		migration, err := getMigration(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get migration: %v\n", err)
+			return
+		}
+
+		workers, err := getWorkers(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get workers: %v\n", err)
+			return
+		}
+
+		// Open every proxy listener before connecting, so that a taken port is reported right away
+		var listeners []net.Listener
+		defer func() {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		}()
+		for _, l := range slices.Concat(serveConfig.Socks, serveConfig.HTTP) {
+			listener, err := net.Listen("tcp", l.Listen)
+			if err != nil {
+				cmd.Printf("Failed to listen on %s: %v\n", l.Listen, err)
+				return
+			}
+			listeners = append(listeners, listener)
+		}
+
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		if err != nil {
+			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
+			return
+		}
+		// Stopping the tunnel closes the device as well, closing the adapter again is a no-op
+		device := api.NewNetstackDevice(tunDev)
+		defer device.Close()
+
+		healthCheck, err := getHealthCheck(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to get health check: %v\n", err)
+			return
+		}
+
+		saveAddresses, err := getAddressSaver(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get config path: %v\n", err)
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		tunnel := api.NewTunnel(api.TunnelConfig{
+			TLSConfig:         tlsConfig,
+			KeepalivePeriod:   keepalivePeriod,
+			InitialPacketSize: initialPacketSize,
+			Endpoints:         endpoints,
+			AttemptDelay:      attemptDelay,
+			FailoverAttempts:  failoverAttempts,
+			Device:            device,
+			MTU:               mtu,
+			PathMTUDiscovery:  pathMTUDiscovery,
+			ReconnectPolicy:   reconnectPolicy,
+			Migration:         migration,
+			HealthCheck:       healthCheck,
+			LocalAddresses:    localAddresses,
+			OnAddressAssign:   saveAddresses,
+			Workers:           workers,
+		})
+		stopMetrics, err := startMetricsServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start metrics server: %v\n", err)
+			return
+		}
+		defer stopMetrics()
+		stopControl, err := startControlServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start control API: %v\n", err)
+			return
+		}
+		defer stopControl()
+		if err := tunnel.Start(ctx); err != nil {
+			cmd.Printf("Failed to start tunnel: %v\n", err)
+			return
+		}
+		defer tunnel.Stop()
+
+		socksResolver := internal.TunnelDNSResolver{TunNet: tunNet, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}
+		if localDNS {
+			socksResolver.TunNet = nil
+		}
+		httpResolver := internal.GetProxyResolver(localDNS, tunNet, dnsAddrs, dnsTimeout)
+
+		for i, l := range serveConfig.Socks {
+			server := newSocksServer(tunnel, tunNet, socksResolver, l.Username, l.Password, udpIdleTimeout)
+			go func(listener net.Listener) {
+				log.Printf("SOCKS proxy listening on %s", listener.Addr())
+				if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+					log.Printf("SOCKS proxy on %s stopped: %v", listener.Addr(), err)
+				}
+			}(listeners[i])
+		}
+
+		for i, l := range serveConfig.HTTP {
+			var authHeader string
+			if l.Username != "" && l.Password != "" {
+				authHeader = "Basic " + internal.LoginToBase64(l.Username, l.Password)
+			}
+			server := &http.Server{Handler: newHTTPProxyHandler(tunnel, tunNet, httpResolver, authHeader)}
+			go func(listener net.Listener) {
+				log.Printf("HTTP proxy listening on %s", listener.Addr())
+				if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+					log.Printf("HTTP proxy on %s stopped: %v", listener.Addr(), err)
+				}
+			}(listeners[len(serveConfig.Socks)+i])
+		}
+
+		for _, pm := range localPortMappings {
+			go func(pm internal.PortMapping) {
+				if err := forwardPort(tunnel, tunNet, pm, false, udpIdleTimeout); err != nil {
+					log.Printf("Error in local forwarding %d: %v", pm.LocalPort, err)
+				}
+			}(pm)
+		}
+
+		for _, pm := range remotePortMappings {
+			go func(pm internal.PortMapping) {
+				if err := forwardPort(tunnel, tunNet, pm, true, udpIdleTimeout); err != nil {
+					log.Printf("Error in remote forwarding %d: %v", pm.LocalPort, err)
+				}
+			}(pm)
+		}
+
+		if len(remotePortMappings) > 0 {
+			if err := announceTunnel(tunNet); err != nil {
+				log.Printf("Remote forwards may not receive connections: %v", err)
+			}
+		}
+
+		if err := tunnel.Wait(); err != nil {
+			log.Printf("Tunnel stopped: %v", err)
+		}
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringP("file", "f", "serve.json", "JSON file listing the proxies and port forwards to run")
+	addEndpointFlags(serveCmd)
+	serveCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
+	serveCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
+	serveCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
+	serveCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
+	serveCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	serveCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
+	addMTUFlags(serveCmd)
+	serveCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection, path MTU discovery starts from it")
+	addSessionCacheFlags(serveCmd)
+	addReconnectFlags(serveCmd)
+	addMigrationFlags(serveCmd)
+	addHealthCheckFlags(serveCmd)
+	addWorkerFlags(serveCmd)
+	addMetricsFlags(serveCmd)
+	addControlFlags(serveCmd)
+	serveCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
+	serveCmd.Flags().Duration("udp-idle-timeout", internal.DefaultUDPIdleTimeout, "Close SOCKS UDP associations and UDP forwarding sessions after being idle for this long")
+	rootCmd.AddCommand(serveCmd)
+}
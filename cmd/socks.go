@@ -2,10 +2,14 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"net/netip"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Diniboy1123/usque/api"
@@ -13,6 +17,7 @@ import (
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
@@ -54,6 +59,14 @@ var socksCmd = &cobra.Command{
 			cmd.Printf("Failed to prepare TLS config: %v\n", err)
 			return
 		}
+		sessionCache, err := getSessionCache(cmd, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			cmd.Printf("Failed to get session cache: %v\n", err)
+			return
+		}
+		if sessionCache != nil {
+			tlsConfig.ClientSessionCache = sessionCache
+		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
@@ -78,23 +91,22 @@ var socksCmd = &cobra.Command{
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		endpoints, err := getEndpoints(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to get endpoints: %v\n", err)
 			return
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
+		attemptDelay, err := cmd.Flags().GetDuration("endpoint-attempt-delay")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint attempt delay: %v\n", err)
+			return
+		}
+
+		failoverAttempts, err := cmd.Flags().GetInt("endpoint-failover")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint failover attempts: %v\n", err)
+			return
 		}
 
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
@@ -155,14 +167,11 @@ var socksCmd = &cobra.Command{
 			return
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
+		mtu, pathMTUDiscovery, err := getMTU(cmd)
 		if err != nil {
 			cmd.Printf("Failed to get MTU: %v\n", err)
 			return
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
 
 		var username string
 		var password string
@@ -173,9 +182,27 @@ var socksCmd = &cobra.Command{
 			password = p
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		udpIdleTimeout, err := cmd.Flags().GetDuration("udp-idle-timeout")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
+			cmd.Printf("Failed to get UDP idle timeout: %v\n", err)
+			return
+		}
+
+		reconnectPolicy, err := getReconnectPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get reconnect policy: %v\n", err)
+			return
+		}
+
+		migration, err := getMigration(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get migration: %v\n", err)
+			return
+		}
+
+		workers, err := getWorkers(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get workers: %v\n", err)
 			return
 		}
 
@@ -184,9 +211,59 @@ var socksCmd = &cobra.Command{
 			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
 			return
 		}
-		defer tunDev.Close()
+		// Stopping the tunnel closes the device as well, closing the adapter again is a no-op
+		device := api.NewNetstackDevice(tunDev)
+		defer device.Close()
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+		healthCheck, err := getHealthCheck(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to get health check: %v\n", err)
+			return
+		}
+
+		saveAddresses, err := getAddressSaver(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get config path: %v\n", err)
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		tunnel := api.NewTunnel(api.TunnelConfig{
+			TLSConfig:         tlsConfig,
+			KeepalivePeriod:   keepalivePeriod,
+			InitialPacketSize: initialPacketSize,
+			Endpoints:         endpoints,
+			AttemptDelay:      attemptDelay,
+			FailoverAttempts:  failoverAttempts,
+			Device:            device,
+			MTU:               mtu,
+			PathMTUDiscovery:  pathMTUDiscovery,
+			ReconnectPolicy:   reconnectPolicy,
+			Migration:         migration,
+			HealthCheck:       healthCheck,
+			LocalAddresses:    localAddresses,
+			OnAddressAssign:   saveAddresses,
+			Workers:           workers,
+		})
+		stopMetrics, err := startMetricsServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start metrics server: %v\n", err)
+			return
+		}
+		defer stopMetrics()
+		stopControl, err := startControlServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start control API: %v\n", err)
+			return
+		}
+		defer stopControl()
+		if err := tunnel.Start(ctx); err != nil {
+			cmd.Printf("Failed to start tunnel: %v\n", err)
+			return
+		}
+		defer tunnel.Stop()
 
 		var resolver socks5.NameResolver
 		if localDNS {
@@ -195,58 +272,106 @@ var socksCmd = &cobra.Command{
 			resolver = internal.TunnelDNSResolver{TunNet: tunNet, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}
 		}
 
-		var server *socks5.Server
-		if username == "" || password == "" {
-			server = socks5.NewServer(
-				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
-				socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return tunNet.DialContext(ctx, network, addr)
-				}),
-				socks5.WithResolver(resolver),
-			)
-		} else {
-			server = socks5.NewServer(
-				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
-				socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return tunNet.DialContext(ctx, network, addr)
-				}),
-				socks5.WithResolver(resolver),
-				socks5.WithAuthMethods(
-					[]socks5.Authenticator{
-						socks5.UserPassAuthenticator{
-							Credentials: socks5.StaticCredentials{
-								username: password,
-							},
-						},
-					},
-				),
-			)
-		}
+		server := newSocksServer(tunnel, tunNet, resolver, username, password, udpIdleTimeout)
 
-		log.Printf("SOCKS proxy listening on %s:%s", bindAddress, port)
-		if err := server.ListenAndServe("tcp", net.JoinHostPort(bindAddress, port)); err != nil {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, port))
+		if err != nil {
 			cmd.Printf("Failed to start SOCKS proxy: %v\n", err)
 			return
 		}
+
+		go func() {
+			if err := tunnel.Wait(); err != nil {
+				log.Printf("Tunnel stopped: %v", err)
+			}
+			listener.Close()
+		}()
+
+		log.Printf("SOCKS proxy listening on %s:%s", bindAddress, port)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			cmd.Printf("SOCKS proxy stopped: %v\n", err)
+		}
 	},
 }
 
+// newSocksServer creates a SOCKS5 server that dials through the tunnel.
+// New connections are refused while the tunnel is down.
+//
+// Parameters:
+//   - tunnel: *api.Tunnel - The tunnel carrying the proxied traffic.
+//   - tunNet: *netstack.Net - The network stack of the tunnel.
+//   - resolver: socks5.NameResolver - The resolver used for domain name requests.
+//   - username: string - The username for authentication (authentication is disabled if empty).
+//   - password: string - The password for authentication (authentication is disabled if empty).
+//   - udpIdleTimeout: time.Duration - The time after which an idle UDP association is closed.
+//
+// Returns:
+//   - *socks5.Server: The created server.
+func newSocksServer(tunnel *api.Tunnel, tunNet *netstack.Net, resolver socks5.NameResolver, username, password string, udpIdleTimeout time.Duration) *socks5.Server {
+	metrics := internal.NewProxyMetrics("socks")
+	dial := metrics.Dial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !tunnel.Connected() {
+			return nil, api.ErrTunnelDown
+		}
+		return tunNet.DialContext(ctx, network, addr)
+	})
+
+	relay := &internal.SocksUDPRelay{
+		TunNet:      tunNet,
+		Resolver:    resolver,
+		IdleTimeout: udpIdleTimeout,
+		Metrics:     metrics,
+	}
+
+	opts := []socks5.Option{
+		socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
+		socks5.WithDial(dial),
+		socks5.WithResolver(resolver),
+		socks5.WithAssociateHandle(func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+			if !tunnel.Connected() {
+				socks5.SendReply(writer, statute.RepNetworkUnreachable, nil)
+				return api.ErrTunnelDown
+			}
+			return relay.Handle(ctx, writer, request)
+		}),
+	}
+	if username != "" && password != "" {
+		opts = append(opts, socks5.WithAuthMethods(
+			[]socks5.Authenticator{
+				socks5.UserPassAuthenticator{
+					Credentials: socks5.StaticCredentials{
+						username: password,
+					},
+				},
+			},
+		))
+	}
+
+	return socks5.NewServer(opts...)
+}
+
 func init() {
 	socksCmd.Flags().StringP("bind", "b", "0.0.0.0", "Address to bind the SOCKS proxy to")
 	socksCmd.Flags().StringP("port", "p", "1080", "Port to listen on for SOCKS proxy")
 	socksCmd.Flags().StringP("username", "u", "", "Username for proxy authentication (specify both username and password to enable)")
 	socksCmd.Flags().StringP("password", "w", "", "Password for proxy authentication (specify both username and password to enable)")
-	socksCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	addEndpointFlags(socksCmd)
 	socksCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
 	socksCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
-	socksCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
 	socksCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	socksCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	socksCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	socksCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
-	socksCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
-	socksCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	socksCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	addMTUFlags(socksCmd)
+	socksCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection, path MTU discovery starts from it")
+	addSessionCacheFlags(socksCmd)
+	addReconnectFlags(socksCmd)
+	addMigrationFlags(socksCmd)
+	addHealthCheckFlags(socksCmd)
+	addWorkerFlags(socksCmd)
+	addMetricsFlags(socksCmd)
+	addControlFlags(socksCmd)
 	socksCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
+	socksCmd.Flags().Duration("udp-idle-timeout", internal.DefaultUDPIdleTimeout, "Close UDP associations after being idle for this long")
 	rootCmd.AddCommand(socksCmd)
 }
@@ -0,0 +1,388 @@
+//go:build linux
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+var tproxyCmd = &cobra.Command{
+	Use:   "tproxy",
+	Short: "Expose Warp as a transparent proxy",
+	Long: "Forwards the traffic sent to it by iptables or nftables rules through the tunnel to its original destination." +
+		" TCP connections redirected with REDIRECT are accepted on --redirect-port, TCP connections and UDP datagrams" +
+		" diverted with TPROXY on --tproxy-port. Linux only, TPROXY requires CAP_NET_ADMIN.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			cmd.Println("Config not loaded. Please register first.")
+			return
+		}
+
+		sni, err := cmd.Flags().GetString("sni-address")
+		if err != nil {
+			cmd.Printf("Failed to get SNI address: %v\n", err)
+			return
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			cmd.Printf("Failed to get private key: %v\n", err)
+			return
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			cmd.Printf("Failed to get public key: %v\n", err)
+			return
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			cmd.Printf("Failed to generate cert: %v\n", err)
+			return
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			cmd.Printf("Failed to prepare TLS config: %v\n", err)
+			return
+		}
+		sessionCache, err := getSessionCache(cmd, &privKey.PublicKey, peerPubKey)
+		if err != nil {
+			cmd.Printf("Failed to get session cache: %v\n", err)
+			return
+		}
+		if sessionCache != nil {
+			tlsConfig.ClientSessionCache = sessionCache
+		}
+
+		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+		if err != nil {
+			cmd.Printf("Failed to get keepalive period: %v\n", err)
+			return
+		}
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			cmd.Printf("Failed to get initial packet size: %v\n", err)
+			return
+		}
+
+		bindAddress, err := cmd.Flags().GetString("bind")
+		if err != nil {
+			cmd.Printf("Failed to get bind address: %v\n", err)
+			return
+		}
+
+		redirectPort, err := cmd.Flags().GetString("redirect-port")
+		if err != nil {
+			cmd.Printf("Failed to get redirect port: %v\n", err)
+			return
+		}
+
+		tproxyPort, err := cmd.Flags().GetString("tproxy-port")
+		if err != nil {
+			cmd.Printf("Failed to get TPROXY port: %v\n", err)
+			return
+		}
+
+		if redirectPort == "" && tproxyPort == "" {
+			cmd.Println("At least one of --redirect-port and --tproxy-port is required")
+			return
+		}
+
+		endpoints, err := getEndpoints(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get endpoints: %v\n", err)
+			return
+		}
+
+		attemptDelay, err := cmd.Flags().GetDuration("endpoint-attempt-delay")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint attempt delay: %v\n", err)
+			return
+		}
+
+		failoverAttempts, err := cmd.Flags().GetInt("endpoint-failover")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint failover attempts: %v\n", err)
+			return
+		}
+
+		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		if err != nil {
+			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
+			return
+		}
+
+		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
+		if err != nil {
+			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
+			return
+		}
+
+		var localAddresses []netip.Addr
+		if !tunnelIPv4 {
+			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
+			if err != nil {
+				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
+				return
+			}
+			localAddresses = append(localAddresses, v4)
+		}
+		if !tunnelIPv6 {
+			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
+			if err != nil {
+				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
+				return
+			}
+			localAddresses = append(localAddresses, v6)
+		}
+
+		mtu, pathMTUDiscovery, err := getMTU(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get MTU: %v\n", err)
+			return
+		}
+
+		udpIdleTimeout, err := cmd.Flags().GetDuration("udp-idle-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get UDP idle timeout: %v\n", err)
+			return
+		}
+
+		reconnectPolicy, err := getReconnectPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get reconnect policy: %v\n", err)
+			return
+		}
+
+		migration, err := getMigration(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get migration: %v\n", err)
+			return
+		}
+
+		workers, err := getWorkers(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get workers: %v\n", err)
+			return
+		}
+
+		// Open the listeners before connecting, so that a taken port or missing privileges are reported right away
+		var listeners []io.Closer
+		defer func() {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		}()
+
+		var redirectListener, tproxyListener net.Listener
+		var tproxyUDP *net.UDPConn
+		if redirectPort != "" {
+			redirectListener, err = net.Listen("tcp", net.JoinHostPort(bindAddress, redirectPort))
+			if err != nil {
+				cmd.Printf("Failed to listen on %s: %v\n", net.JoinHostPort(bindAddress, redirectPort), err)
+				return
+			}
+			listeners = append(listeners, redirectListener)
+		}
+		if tproxyPort != "" {
+			tproxyListener, err = internal.ListenTransparentTCP(net.JoinHostPort(bindAddress, tproxyPort))
+			if err != nil {
+				cmd.Printf("Failed to listen on %s: %v\n", net.JoinHostPort(bindAddress, tproxyPort), err)
+				return
+			}
+			listeners = append(listeners, tproxyListener)
+
+			tproxyUDP, err = internal.ListenTransparentUDP(net.JoinHostPort(bindAddress, tproxyPort))
+			if err != nil {
+				cmd.Printf("Failed to listen on udp/%s: %v\n", net.JoinHostPort(bindAddress, tproxyPort), err)
+				return
+			}
+			listeners = append(listeners, tproxyUDP)
+		}
+
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, nil, mtu)
+		if err != nil {
+			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
+			return
+		}
+		// Stopping the tunnel closes the device as well, closing the adapter again is a no-op
+		device := api.NewNetstackDevice(tunDev)
+		defer device.Close()
+
+		healthCheck, err := getHealthCheck(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to get health check: %v\n", err)
+			return
+		}
+
+		saveAddresses, err := getAddressSaver(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get config path: %v\n", err)
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		tunnel := api.NewTunnel(api.TunnelConfig{
+			TLSConfig:         tlsConfig,
+			KeepalivePeriod:   keepalivePeriod,
+			InitialPacketSize: initialPacketSize,
+			Endpoints:         endpoints,
+			AttemptDelay:      attemptDelay,
+			FailoverAttempts:  failoverAttempts,
+			Device:            device,
+			MTU:               mtu,
+			PathMTUDiscovery:  pathMTUDiscovery,
+			ReconnectPolicy:   reconnectPolicy,
+			Migration:         migration,
+			HealthCheck:       healthCheck,
+			LocalAddresses:    localAddresses,
+			OnAddressAssign:   saveAddresses,
+			Workers:           workers,
+		})
+		stopMetrics, err := startMetricsServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start metrics server: %v\n", err)
+			return
+		}
+		defer stopMetrics()
+		stopControl, err := startControlServer(cmd, tunnel)
+		if err != nil {
+			cmd.Printf("Failed to start control API: %v\n", err)
+			return
+		}
+		defer stopControl()
+		if err := tunnel.Start(ctx); err != nil {
+			cmd.Printf("Failed to start tunnel: %v\n", err)
+			return
+		}
+		defer tunnel.Stop()
+
+		metrics := internal.NewProxyMetrics("tproxy")
+		dial := metrics.Dial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if !tunnel.Connected() {
+				return nil, api.ErrTunnelDown
+			}
+			return tunNet.DialContext(ctx, network, addr)
+		})
+
+		if redirectListener != nil {
+			log.Printf("Transparent proxy accepting redirected TCP connections on %s", redirectListener.Addr())
+			go serveTransparentTCP(redirectListener, true, dial)
+		}
+		if tproxyListener != nil {
+			log.Printf("Transparent proxy accepting TPROXY TCP connections and UDP datagrams on %s", tproxyListener.Addr())
+			go serveTransparentTCP(tproxyListener, false, dial)
+
+			relay := &internal.TProxyUDPRelay{
+				Conn:        tproxyUDP,
+				IdleTimeout: udpIdleTimeout,
+				Dial: func(dst netip.AddrPort) (net.Conn, error) {
+					return dial(context.Background(), "udp", dst.String())
+				},
+			}
+			go func() {
+				if err := relay.Serve(); err != nil {
+					cmd.Printf("Transparent UDP proxy stopped: %v\n", err)
+				}
+			}()
+		}
+
+		if err := tunnel.Wait(); err != nil {
+			log.Printf("Tunnel stopped: %v", err)
+		}
+	},
+}
+
+// serveTransparentTCP accepts the connections sent to a transparent proxy listener and forwards
+// each of them through the tunnel to its original destination, until the listener is closed.
+//
+// Parameters:
+//   - listener: net.Listener - The listener receiving the connections.
+//   - redirected: bool - Whether the connections were redirected with REDIRECT (true) or diverted with TPROXY (false).
+//   - dial: internal.DialFunc - Dials the original destinations through the tunnel.
+func serveTransparentTCP(listener net.Listener, redirected bool, dial internal.DialFunc) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Accept error on %s: %v", listener.Addr(), err)
+			continue
+		}
+
+		go handleTransparentConnection(conn.(*net.TCPConn), redirected, dial)
+	}
+}
+
+// handleTransparentConnection forwards a single connection to its original destination.
+//
+// Parameters:
+//   - conn: *net.TCPConn - The accepted connection.
+//   - redirected: bool - Whether the connection was redirected with REDIRECT (true) or diverted with TPROXY (false).
+//   - dial: internal.DialFunc - Dials the original destination through the tunnel.
+func handleTransparentConnection(conn *net.TCPConn, redirected bool, dial internal.DialFunc) {
+	defer conn.Close()
+
+	// A diverted connection keeps its original destination as the local address
+	dst := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	if redirected {
+		var err error
+		dst, err = internal.OriginalDst(conn)
+		if err != nil {
+			log.Printf("Refusing connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+
+	remoteConn, err := dial(context.Background(), "tcp", dst.String())
+	if err != nil {
+		log.Printf("Failed to connect to %s for %s: %v", dst, conn.RemoteAddr(), err)
+		return
+	}
+	defer remoteConn.Close()
+
+	go func() { io.Copy(remoteConn, conn) }()
+	io.Copy(conn, remoteConn)
+}
+
+func init() {
+	tproxyCmd.Flags().StringP("bind", "b", "::", "Address to bind the transparent proxy to (:: listens on all IPv4 and IPv6 addresses)")
+	tproxyCmd.Flags().String("redirect-port", "", "Port to accept TCP connections redirected with REDIRECT on (disabled if empty)")
+	tproxyCmd.Flags().String("tproxy-port", "", "Port to accept TCP connections and UDP datagrams diverted with TPROXY on (disabled if empty)")
+	addEndpointFlags(tproxyCmd)
+	tproxyCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
+	tproxyCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
+	tproxyCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	tproxyCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
+	addMTUFlags(tproxyCmd)
+	tproxyCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection, path MTU discovery starts from it")
+	addSessionCacheFlags(tproxyCmd)
+	tproxyCmd.Flags().Duration("udp-idle-timeout", internal.DefaultUDPIdleTimeout, "Close UDP sessions after being idle for this long")
+	addReconnectFlags(tproxyCmd)
+	addMigrationFlags(tproxyCmd)
+	addHealthCheckFlags(tproxyCmd)
+	addWorkerFlags(tproxyCmd)
+	addMetricsFlags(tproxyCmd)
+	addControlFlags(tproxyCmd)
+	rootCmd.AddCommand(tproxyCmd)
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// ServeConfig describes the front-ends `usque serve` attaches to its single tunnel.
+type ServeConfig struct {
+	Socks        []ProxyListener `json:"socks"`         // SOCKS5 proxies to start
+	HTTP         []ProxyListener `json:"http"`          // HTTP proxies to start
+	PortForwards PortForwards    `json:"port_forwards"` // Ports to forward to and from the tunnel
+}
+
+// ProxyListener describes a single SOCKS5 or HTTP proxy listener.
+type ProxyListener struct {
+	Listen   string `json:"listen"`             // Address to listen on, e.g. 127.0.0.1:1080
+	Username string `json:"username,omitempty"` // Username for proxy authentication (optional)
+	Password string `json:"password,omitempty"` // Password for proxy authentication (optional)
+}
+
+// PortForwards lists port mappings in the same syntax as the -L and -R flags of portfw.
+type PortForwards struct {
+	Local  []string `json:"local,omitempty"`  // Local ports forwarded into the tunnel
+	Remote []string `json:"remote,omitempty"` // Tunnel ports forwarded to the local network
+}
+
+// LoadServeConfig loads the front-end configuration of `usque serve` from a JSON file.
+//
+// Parameters:
+//   - path: string - The path to the JSON file.
+//
+// Returns:
+//   - ServeConfig: The parsed configuration.
+//   - error: An error if the file cannot be read, parsed or doesn't define any front-end.
+func LoadServeConfig(path string) (ServeConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ServeConfig{}, fmt.Errorf("failed to open serve config file: %v", err)
+	}
+	defer file.Close()
+
+	var serveConfig ServeConfig
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&serveConfig); err != nil {
+		return ServeConfig{}, fmt.Errorf("failed to decode serve config file: %v", err)
+	}
+
+	if len(serveConfig.Socks)+len(serveConfig.HTTP)+len(serveConfig.PortForwards.Local)+len(serveConfig.PortForwards.Remote) == 0 {
+		return ServeConfig{}, fmt.Errorf("serve config file %s doesn't define any listener", path)
+	}
+	for _, l := range slices.Concat(serveConfig.Socks, serveConfig.HTTP) {
+		if l.Listen == "" {
+			return ServeConfig{}, fmt.Errorf("proxy listener without listen address in %s", path)
+		}
+	}
+
+	return serveConfig, nil
+}
@@ -0,0 +1,310 @@
+//go:build linux
+
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal D-Bus client, just enough to call methods on the system bus and wait for their
+// replies. Only little endian messages and the argument types systemd-resolved needs are supported.
+
+// DefaultSystemBusAddress is the socket of the D-Bus system bus.
+const DefaultSystemBusAddress = "/run/dbus/system_bus_socket"
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+
+	dbusCallTimeout = 5 * time.Second
+)
+
+// DBusError is an error reply to a method call.
+type DBusError struct {
+	Name    string
+	Message string
+}
+
+func (e *DBusError) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// dbusConn is a connection to a message bus.
+type dbusConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	serial uint32
+}
+
+// dbusEncoder marshals values in the little endian D-Bus wire format. Offsets are relative
+// to the start of the message, which alignment depends on.
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) byte(v byte) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *dbusEncoder) int32(v int32) {
+	e.uint32(uint32(v))
+}
+
+func (e *dbusEncoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (e *dbusEncoder) string(v string) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) signature(v string) {
+	e.byte(byte(len(v)))
+	e.buf = append(e.buf, v...)
+	e.buf = append(e.buf, 0)
+}
+
+// array marshals an array whose elements are aligned to elemAlign, calling elems to marshal them.
+func (e *dbusEncoder) array(elemAlign int, elems func()) {
+	e.uint32(0)
+	lengthAt := len(e.buf) - 4
+	e.align(elemAlign)
+	start := len(e.buf)
+	elems()
+	binary.LittleEndian.PutUint32(e.buf[lengthAt:], uint32(len(e.buf)-start))
+}
+
+// headerField marshals a header field, a struct of a field code and a variant.
+func (e *dbusEncoder) headerField(code byte, sig string, value func()) {
+	e.align(8)
+	e.byte(code)
+	e.signature(sig)
+	value()
+}
+
+// dialSystemBus connects and authenticates to the D-Bus system bus.
+//
+// Parameters:
+//   - path: string - The path of the system bus socket.
+//
+// Returns:
+//   - *dbusConn: The connection, ready for method calls.
+//   - error: An error if the bus can't be reached or refuses us.
+func dialSystemBus(path string) (*dbusConn, error) {
+	conn, err := net.DialTimeout("unix", path, dbusCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(dbusCallTimeout))
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(conn, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(conn, "BEGIN\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Every connection to a message bus has to say hello first
+	if err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// close closes the connection.
+func (c *dbusConn) close() error {
+	return c.conn.Close()
+}
+
+// call calls a method and waits for its reply.
+//
+// Parameters:
+//   - dest, path, iface, member: string - The bus name, object path, interface and method to call.
+//   - sig: string - The signature of the arguments.
+//   - args: func(*dbusEncoder) - Marshals the arguments, nil if there are none.
+//
+// Returns:
+//   - error: A *DBusError if the method failed, other errors if the call couldn't be made.
+func (c *dbusConn) call(dest, path, iface, member, sig string, args func(*dbusEncoder)) error {
+	c.serial++
+	serial := c.serial
+
+	// The body is aligned to 8 within the message, so it can be marshalled on its own
+	body := &dbusEncoder{}
+	if args != nil {
+		args(body)
+	}
+
+	msg := &dbusEncoder{}
+	msg.byte('l')
+	msg.byte(dbusMethodCall)
+	msg.byte(0)
+	msg.byte(1)
+	msg.uint32(uint32(len(body.buf)))
+	msg.uint32(serial)
+	msg.array(8, func() {
+		msg.headerField(dbusFieldPath, "o", func() { msg.string(path) })
+		msg.headerField(dbusFieldInterface, "s", func() { msg.string(iface) })
+		msg.headerField(dbusFieldMember, "s", func() { msg.string(member) })
+		msg.headerField(dbusFieldDestination, "s", func() { msg.string(dest) })
+		if sig != "" {
+			msg.headerField(dbusFieldSignature, "g", func() { msg.signature(sig) })
+		}
+	})
+	msg.align(8)
+	msg.buf = append(msg.buf, body.buf...)
+
+	c.conn.SetDeadline(time.Now().Add(dbusCallTimeout))
+	if _, err := c.conn.Write(msg.buf); err != nil {
+		return err
+	}
+
+	for {
+		typ, replySerial, errorName, replyBody, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if replySerial != serial {
+			// Signals like NameAcquired
+			continue
+		}
+		switch typ {
+		case dbusMethodReturn:
+			return nil
+		case dbusError:
+			dbusErr := &DBusError{Name: errorName}
+			// The first argument of an error is its message, if it is a string
+			if len(replyBody) >= 4 {
+				if n := binary.LittleEndian.Uint32(replyBody); int(n) <= len(replyBody)-4 {
+					dbusErr.Message = string(replyBody[4 : 4+n])
+				}
+			}
+			return dbusErr
+		}
+	}
+}
+
+// readMessage reads a single message and returns the header fields we care about.
+func (c *dbusConn) readMessage() (typ byte, replySerial uint32, errorName string, body []byte, err error) {
+	fixed := make([]byte, 16)
+	if _, err = io.ReadFull(c.r, fixed); err != nil {
+		return
+	}
+	if fixed[0] != 'l' {
+		err = errors.New("big endian D-Bus messages are not supported")
+		return
+	}
+	typ = fixed[1]
+	bodyLen := binary.LittleEndian.Uint32(fixed[4:8])
+	fieldsLen := binary.LittleEndian.Uint32(fixed[12:16])
+
+	// Header fields, padded to 8, then the body
+	headerLen := 16 + int(fieldsLen)
+	padded := (headerLen + 7) &^ 7
+	rest := make([]byte, padded-16+int(bodyLen))
+	if _, err = io.ReadFull(c.r, rest); err != nil {
+		return
+	}
+	fields := rest[:fieldsLen]
+	body = rest[padded-16:]
+
+	// Offsets within fields are relative to the message, which has 16 bytes before them
+	for pos := 0; pos < len(fields); {
+		pos = (pos+16+7)&^7 - 16
+		if pos+3 > len(fields) {
+			break
+		}
+		code := fields[pos]
+		sigLen := int(fields[pos+1])
+		if pos+2+sigLen+1 > len(fields) {
+			break
+		}
+		sig := string(fields[pos+2 : pos+2+sigLen])
+		pos += 2 + sigLen + 1
+
+		switch sig {
+		case "u", "s", "o":
+			pos = (pos+16+3)&^3 - 16
+			if pos+4 > len(fields) {
+				return
+			}
+			v := binary.LittleEndian.Uint32(fields[pos:])
+			pos += 4
+			if sig == "u" {
+				if code == dbusFieldReplySerial {
+					replySerial = v
+				}
+				continue
+			}
+			if pos+int(v)+1 > len(fields) {
+				return
+			}
+			if code == dbusFieldErrorName {
+				errorName = string(fields[pos : pos+int(v)])
+			}
+			pos += int(v) + 1
+		case "g":
+			if pos >= len(fields) {
+				return
+			}
+			pos += 1 + int(fields[pos]) + 1
+		default:
+			err = fmt.Errorf("unexpected D-Bus header field signature %q", sig)
+			return
+		}
+	}
+	return
+}
@@ -36,10 +36,11 @@ type TunnelDNSResolver struct {
 //   - context.Context: The original context for the DNS lookup.
 //   - net.IP: The resolved IP address.
 //   - error: An error if the lookup fails.
-func (r TunnelDNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+func (r TunnelDNSResolver) Resolve(ctx context.Context, name string) (_ context.Context, _ net.IP, err error) {
 	if len(r.DNSAddrs) == 0 {
 		return ctx, nil, fmt.Errorf("no DNS servers configured")
 	}
+	defer func(start time.Time) { ObserveDNSLookup(start, err) }(time.Now())
 
 	var queryCtx context.Context = ctx
 	var cancel context.CancelFunc
@@ -0,0 +1,175 @@
+//go:build linux
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Sysctls enabling IP forwarding for either family.
+const (
+	ipv4ForwardingSysctl = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardingSysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+// tcpOptionMaxSeg is the kind of the TCP maximum segment size option.
+const tcpOptionMaxSeg = 2
+
+// Gateway lets other hosts use the tunnel: it enables IP forwarding and installs an nftables
+// table that masquerades the traffic of their subnets leaving through the TUN device and clamps
+// the MSS of TCP connections through it to what fits the MTU of the tunnel. Traffic of their
+// subnets forwarded anywhere else is dropped, so it never leaves through a physical interface,
+// not even while the tunnel is down or for destinations routed around it.
+type Gateway struct {
+	table string
+	// sysctls holds the previous values of the sysctls changed, by path.
+	sysctls map[string]string
+}
+
+// EnableGateway enables IP forwarding for the families of subnets and installs the gateway table.
+// A table left behind by a previous run with the same TUN device is replaced atomically.
+//
+// Parameters:
+//   - tunName: string - The name of the TUN device.
+//   - subnets: []netip.Prefix - The source subnets whose traffic is masqueraded.
+//   - mtu: int - The MTU of the TUN device, the MSS is clamped to it.
+//
+// Returns:
+//   - *Gateway: The enabled gateway.
+//   - error: An error if forwarding couldn't be enabled or the table couldn't be installed.
+func EnableGateway(tunName string, subnets []netip.Prefix, mtu int) (*Gateway, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("no subnets given")
+	}
+
+	g := &Gateway{table: "usque_gw_" + tunName, sysctls: make(map[string]string)}
+	if err := gatewayBatch(g.table, tunName, subnets, mtu).commit(); err != nil {
+		return nil, fmt.Errorf("failed to install gateway rules: %v", err)
+	}
+
+	ipv4 := slices.ContainsFunc(subnets, func(subnet netip.Prefix) bool { return subnet.Addr().Is4() })
+	ipv6 := slices.ContainsFunc(subnets, func(subnet netip.Prefix) bool { return subnet.Addr().Is6() })
+	if ipv4 {
+		if err := g.setSysctl(ipv4ForwardingSysctl, "1"); err != nil {
+			g.Disable()
+			return nil, err
+		}
+	}
+	if ipv6 {
+		if err := g.setSysctl(ipv6ForwardingSysctl, "1"); err != nil {
+			g.Disable()
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// gatewayBatch builds the batch that replaces the gateway table, see EnableGateway.
+func gatewayBatch(table, tunName string, subnets []netip.Prefix, mtu int) *nftBatch {
+	b := &nftBatch{}
+	// Creating the table first makes the delete succeed even if it didn't exist
+	b.addTable(nfprotoInet, table)
+	b.delTable(nfprotoInet, table)
+	b.addTable(nfprotoInet, table)
+	b.addBaseChain(nfprotoInet, table, "postrouting", "nat", nfInetPostRouting, 100, nfAccept)
+	b.addBaseChain(nfprotoInet, table, "forward", "filter", nfInetForward, -150, nfAccept)
+
+	var ipv4, ipv6 bool
+	var drops [][]nftExpr
+	for _, subnet := range subnets {
+		proto, offset := uint8(nfprotoIPv4), uint32(12)
+		if subnet.Addr().Is6() {
+			proto, offset = nfprotoIPv6, 8
+			ipv6 = true
+		} else {
+			ipv4 = true
+		}
+		addr := subnet.Masked().Addr().AsSlice()
+		mask := net.CIDRMask(subnet.Bits(), len(addr)*8)
+
+		b.addRule(nfprotoInet, table, "postrouting",
+			nftMeta(nftMetaOifname), nftCmpEq(nftIfname(tunName)),
+			nftMeta(nftMetaNfproto), nftCmpEq([]byte{proto}),
+			nftPayload(nftPayloadNetworkHeader, offset, uint32(len(addr))), nftBitwise(mask), nftCmpEq(addr),
+			nftMasq(),
+		)
+		drops = append(drops, []nftExpr{
+			nftMeta(nftMetaOifname), nftCmp(nftCmpOpNeq, nftIfname(tunName)),
+			nftMeta(nftMetaNfproto), nftCmpEq([]byte{proto}),
+			nftPayload(nftPayloadNetworkHeader, offset, uint32(len(addr))), nftBitwise(mask), nftCmpEq(addr),
+			nftDrop(),
+		})
+	}
+
+	// Lower the MSS of SYN and SYN-ACK packets in both directions, so neither side sends
+	// segments that don't fit into the tunnel
+	for _, family := range []struct {
+		proto   uint8
+		enabled bool
+		headers int
+	}{{nfprotoIPv4, ipv4, 40}, {nfprotoIPv6, ipv6, 60}} {
+		if !family.enabled {
+			continue
+		}
+		mss := binary.BigEndian.AppendUint16(nil, uint16(mtu-family.headers))
+		for _, key := range []nftMetaKey{nftMetaOifname, nftMetaIifname} {
+			b.addRule(nfprotoInet, table, "forward",
+				nftMeta(key), nftCmpEq(nftIfname(tunName)),
+				nftMeta(nftMetaNfproto), nftCmpEq([]byte{family.proto}),
+				nftMeta(nftMetaL4proto), nftCmpEq([]byte{syscall.IPPROTO_TCP}),
+				nftPayload(nftPayloadTransportHeader, 13, 1), nftBitwise([]byte{0x02}), nftCmp(nftCmpOpNeq, []byte{0}),
+				nftTCPOption(tcpOptionMaxSeg, 2, 2), nftCmp(nftCmpOpGt, mss),
+				nftImmediate(mss), nftSetTCPOption(tcpOptionMaxSeg, 2, 2),
+			)
+		}
+	}
+
+	// After clamping, which has no verdict: nothing of the subnets leaves outside the tunnel
+	for _, drop := range drops {
+		b.addRule(nfprotoInet, table, "forward", drop...)
+	}
+
+	return b
+}
+
+// setSysctl sets a sysctl, remembering its previous value for Disable.
+func (g *Gateway) setSysctl(path, value string) error {
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	g.sysctls[path] = strings.TrimSpace(string(previous))
+	return nil
+}
+
+// Disable removes the gateway table and restores the previous forwarding settings.
+//
+// Returns:
+//   - error: An error if the table couldn't be removed or a setting couldn't be restored.
+func (g *Gateway) Disable() error {
+	var errs []error
+	for path, value := range g.sysctls {
+		if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %v", path, err))
+		}
+	}
+
+	b := &nftBatch{}
+	b.delTable(nfprotoInet, g.table)
+	if err := b.commit(); err != nil && !errors.Is(err, syscall.ENOENT) {
+		errs = append(errs, fmt.Errorf("failed to remove gateway rules: %v", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// KillSwitch is an nftables table that drops every packet the host sends outside the TUN device,
+// except for loopback traffic and the packets of the MASQUE socket. It stays in place while the
+// tunnel reconnects, so nothing leaks to the physical interfaces in the meantime.
+type KillSwitch struct {
+	table string
+}
+
+// EnableKillSwitch installs the kill switch table. A table left behind by a previous run with
+// the same TUN device is replaced atomically.
+//
+// The MASQUE socket is recognized by its firewall mark rather than by the address of the endpoint,
+// so endpoints switched to later on are allowed as well. Besides that, only what keeps the physical
+// interfaces working is allowed: DHCP and DHCPv6 client traffic, so leases can be renewed, and
+// ICMPv6 router and neighbor solicitations and neighbor advertisements, otherwise IPv6 endpoints
+// would become unreachable once their neighbor cache entries expire.
+//
+// Parameters:
+//   - tunName: string - The name of the TUN device traffic is allowed through.
+//   - fwmark: uint32 - The firewall mark of the MASQUE socket, must not be zero.
+//
+// Returns:
+//   - *KillSwitch: The installed kill switch.
+//   - error: An error if the table couldn't be installed.
+func EnableKillSwitch(tunName string, fwmark uint32) (*KillSwitch, error) {
+	if fwmark == 0 {
+		return nil, errors.New("the MASQUE socket has to be marked")
+	}
+
+	k := &KillSwitch{table: "usque_" + tunName}
+	if err := killSwitchBatch(k.table, tunName, fwmark).commit(); err != nil {
+		return nil, fmt.Errorf("failed to install kill switch: %v", err)
+	}
+
+	return k, nil
+}
+
+// killSwitchBatch builds the batch that replaces the kill switch table, see EnableKillSwitch.
+func killSwitchBatch(table, tunName string, fwmark uint32) *nftBatch {
+	const chain = "output"
+
+	b := &nftBatch{}
+	// Creating the table first makes the delete succeed even if it didn't exist
+	b.addTable(nfprotoInet, table)
+	b.delTable(nfprotoInet, table)
+	b.addTable(nfprotoInet, table)
+	b.addBaseChain(nfprotoInet, table, chain, "filter", nfInetLocalOut, 0, nfDrop)
+
+	b.addRule(nfprotoInet, table, chain, nftMeta(nftMetaOifname), nftCmpEq(nftIfname("lo")), nftAccept())
+	b.addRule(nfprotoInet, table, chain, nftMeta(nftMetaOifname), nftCmpEq(nftIfname(tunName)), nftAccept())
+	b.addRule(nfprotoInet, table, chain,
+		nftMeta(nftMetaMark), nftCmpEq(binary.NativeEndian.AppendUint32(nil, fwmark)), nftAccept())
+
+	// DHCP client to server, source and destination port in one go
+	for _, dhcp := range []struct {
+		proto uint8
+		ports []byte
+	}{{nfprotoIPv4, []byte{0, 68, 0, 67}}, {nfprotoIPv6, []byte{0x02, 0x22, 0x02, 0x23}}} {
+		b.addRule(nfprotoInet, table, chain,
+			nftMeta(nftMetaNfproto), nftCmpEq([]byte{dhcp.proto}),
+			nftMeta(nftMetaL4proto), nftCmpEq([]byte{syscall.IPPROTO_UDP}),
+			nftPayload(nftPayloadTransportHeader, 0, 4), nftCmpEq(dhcp.ports),
+			nftAccept(),
+		)
+	}
+
+	// Router solicitation, neighbor solicitation and neighbor advertisement
+	for _, icmpType := range []byte{133, 135, 136} {
+		b.addRule(nfprotoInet, table, chain,
+			nftMeta(nftMetaNfproto), nftCmpEq([]byte{nfprotoIPv6}),
+			nftMeta(nftMetaL4proto), nftCmpEq([]byte{syscall.IPPROTO_ICMPV6}),
+			nftPayload(nftPayloadTransportHeader, 0, 1), nftCmpEq([]byte{icmpType}),
+			nftAccept(),
+		)
+	}
+
+	return b
+}
+
+// Disable removes the kill switch table, letting traffic outside the tunnel through again.
+//
+// Returns:
+//   - error: An error if the table couldn't be removed.
+func (k *KillSwitch) Disable() error {
+	b := &nftBatch{}
+	b.delTable(nfprotoInet, k.table)
+	if err := b.commit(); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to remove kill switch: %v", err)
+	}
+	return nil
+}
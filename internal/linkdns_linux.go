@@ -0,0 +1,213 @@
+//go:build linux
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ResolvConfPath is the resolver configuration rewritten when systemd-resolved isn't available.
+const ResolvConfPath = "/etc/resolv.conf"
+
+// resolvConfBackupSuffix is appended to ResolvConfPath for the backup of the original file.
+const resolvConfBackupSuffix = ".usque-backup"
+
+// ConfigureLinkDNS makes the host resolve names through servers, which are reachable over the link ifname.
+//
+// systemd-resolved is configured over D-Bus if it is running: servers become the DNS servers of the link
+// and domains its search and routing domains. Routing-only domains are prefixed with "~", "~." routes
+// every query to the link. If domains is empty, the link becomes the default route for queries.
+//
+// Otherwise ResolvConfPath is replaced after backing it up. Non routing-only domains become its search list.
+// A backup left behind by a previous run is kept, as it holds the original file.
+//
+// Parameters:
+//   - ifname: string - The name of the link the servers are reachable over.
+//   - servers: []netip.Addr - The DNS servers to use.
+//   - domains: []string - The search and routing domains.
+//
+// Returns:
+//   - func() error: Restores the previous configuration. Never nil on success.
+//   - error: An error if the configuration couldn't be applied.
+func ConfigureLinkDNS(ifname string, servers []netip.Addr, domains []string) (func() error, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers given")
+	}
+
+	link, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link: %v", err)
+	}
+
+	restore, err := configureResolved(link.Index, servers, domains)
+	if err == nil {
+		log.Printf("Configured DNS of %s through systemd-resolved", ifname)
+		return restore, nil
+	}
+	var dbusErr *DBusError
+	if errors.As(err, &dbusErr) && dbusErr.Name != "org.freedesktop.DBus.Error.ServiceUnknown" && dbusErr.Name != "org.freedesktop.DBus.Error.NameHasNoOwner" {
+		// systemd-resolved is there, but refused the configuration
+		return nil, fmt.Errorf("failed to configure systemd-resolved: %v", err)
+	}
+	log.Printf("systemd-resolved is not available (%v), rewriting %s", err, ResolvConfPath)
+
+	return rewriteResolvConf(ResolvConfPath, servers, domains)
+}
+
+// ConfigureNetnsDNS makes the processes started with `ip netns exec` in a named network namespace resolve
+// names through servers, by writing the resolv.conf it bind mounts over ResolvConfPath.
+//
+// Parameters:
+//   - netns: string - The name of the network namespace.
+//   - servers: []netip.Addr - The DNS servers to use.
+//   - domains: []string - The search domains, routing-only domains prefixed with "~" are ignored.
+//
+// Returns:
+//   - func() error: Restores the previous configuration. Never nil on success.
+//   - error: An error if the configuration couldn't be written.
+func ConfigureNetnsDNS(netns string, servers []netip.Addr, domains []string) (func() error, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers given")
+	}
+
+	dir := filepath.Join("/etc/netns", netns)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+
+	return rewriteResolvConf(filepath.Join(dir, "resolv.conf"), servers, domains)
+}
+
+// configureResolved sets the DNS servers and domains of a link in systemd-resolved.
+func configureResolved(ifindex int, servers []netip.Addr, domains []string) (func() error, error) {
+	conn, err := dialSystemBus(DefaultSystemBusAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	call := func(member, sig string, args func(*dbusEncoder)) error {
+		return conn.call("org.freedesktop.resolve1", "/org/freedesktop/resolve1", "org.freedesktop.resolve1.Manager", member, sig, args)
+	}
+	revert := func() error {
+		conn, err := dialSystemBus(DefaultSystemBusAddress)
+		if err != nil {
+			return err
+		}
+		defer conn.close()
+		return conn.call("org.freedesktop.resolve1", "/org/freedesktop/resolve1", "org.freedesktop.resolve1.Manager", "RevertLink", "i", func(e *dbusEncoder) {
+			e.int32(int32(ifindex))
+		})
+	}
+
+	if err := call("SetLinkDNS", "ia(iay)", func(e *dbusEncoder) {
+		e.int32(int32(ifindex))
+		e.array(8, func() {
+			for _, server := range servers {
+				e.align(8)
+				family := int32(syscall.AF_INET)
+				if server.Is6() {
+					family = syscall.AF_INET6
+				}
+				e.int32(family)
+				addr := server.AsSlice()
+				e.array(1, func() { e.buf = append(e.buf, addr...) })
+			}
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(domains) == 0 {
+		domains = []string{"~."}
+	}
+	if err := call("SetLinkDomains", "ia(sb)", func(e *dbusEncoder) {
+		e.int32(int32(ifindex))
+		e.array(8, func() {
+			for _, domain := range domains {
+				e.align(8)
+				name, routingOnly := strings.CutPrefix(domain, "~")
+				if name == "" {
+					name = "."
+				}
+				e.string(name)
+				e.bool(routingOnly)
+			}
+		})
+	}); err != nil {
+		revert()
+		return nil, err
+	}
+
+	defaultRoute := false
+	for _, domain := range domains {
+		defaultRoute = defaultRoute || domain == "~."
+	}
+	if err := call("SetLinkDefaultRoute", "ib", func(e *dbusEncoder) {
+		e.int32(int32(ifindex))
+		e.bool(defaultRoute)
+	}); err != nil {
+		revert()
+		return nil, err
+	}
+
+	return revert, nil
+}
+
+// rewriteResolvConf replaces the resolv.conf at path with one listing servers, keeping a backup to restore.
+func rewriteResolvConf(path string, servers []netip.Addr, domains []string) (func() error, error) {
+	backup := path + resolvConfBackupSuffix
+
+	// The file may be a symlink, e.g. to the stub of systemd-resolved, so move it instead of copying
+	hadOriginal := true
+	if _, err := os.Lstat(backup); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(path, backup); errors.Is(err, os.ErrNotExist) {
+			hadOriginal = false
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", path, err)
+		}
+	} else {
+		log.Printf("Keeping existing backup %s from a previous run", backup)
+		os.Remove(path)
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by usque, the original is restored from " + backup + " on exit\n")
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	var search []string
+	for _, domain := range domains {
+		if !strings.HasPrefix(domain, "~") {
+			search = append(search, domain)
+		}
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+
+	restore := func() error {
+		if !hadOriginal {
+			return os.Remove(path)
+		}
+		if err := os.Rename(backup, path); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", path, err)
+		}
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		restore()
+		return nil, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	return restore, nil
+}
@@ -0,0 +1,622 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets (in seconds) used for latency metrics.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is the registry the metrics of this package are registered in.
+var DefaultRegistry = NewRegistry()
+
+// Metrics fed by the proxies and resolvers of this package.
+var (
+	proxyConnections       = mustRegister(DefaultRegistry.NewCounterVec("usque_proxy_connections_total", "Connections opened through the tunnel.", "proxy"))
+	proxyConnectionErrors  = mustRegister(DefaultRegistry.NewCounterVec("usque_proxy_connection_errors_total", "Connections that couldn't be opened through the tunnel.", "proxy"))
+	proxyActiveConnections = mustRegister(DefaultRegistry.NewGaugeVec("usque_proxy_active_connections", "Connections currently open through the tunnel.", "proxy"))
+	proxySentBytes         = mustRegister(DefaultRegistry.NewCounterVec("usque_proxy_sent_bytes_total", "Bytes sent into the tunnel by proxied connections.", "proxy"))
+	proxyReceivedBytes     = mustRegister(DefaultRegistry.NewCounterVec("usque_proxy_received_bytes_total", "Bytes received from the tunnel by proxied connections.", "proxy"))
+	proxyDialDuration      = mustRegister(DefaultRegistry.NewHistogramVec("usque_proxy_dial_duration_seconds", "Time taken to open a connection through the tunnel.", "proxy", DefaultBuckets))
+
+	dnsLookupDuration = mustRegister(DefaultRegistry.NewHistogramVec("usque_dns_lookup_duration_seconds", "Time taken to resolve a name.", "result", DefaultBuckets))
+)
+
+// mustRegister returns m, or panics if registering it failed. It is meant for the metrics of this
+// package, whose names are fixed at compile time.
+func mustRegister[M any](m M, err error) M {
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// metric is a single metric family that can render itself in the Prometheus text format.
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+// Registry is a set of metrics that can be exposed in the Prometheus text exposition format.
+// It implements http.Handler.
+type Registry struct {
+	mu      sync.Mutex
+	names   []string
+	helps   map[string]string
+	types   map[string]string
+	metrics map[string]metric
+}
+
+// NewRegistry creates an empty registry.
+//
+// Returns:
+//   - *Registry: The created registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		helps:   make(map[string]string),
+		types:   make(map[string]string),
+		metrics: make(map[string]metric),
+	}
+}
+
+// register adds a metric family to the registry.
+//
+// Returns:
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) register(name, help, typ string, m metric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		return fmt.Errorf("metric %s is already registered", name)
+	}
+	r.names = append(r.names, name)
+	r.helps[name] = help
+	r.types[name] = typ
+	r.metrics[name] = m
+	return nil
+}
+
+// NewCounter registers and returns a new counter.
+//
+// Parameters:
+//   - name: string - The metric name.
+//   - help: string - The help text of the metric.
+//
+// Returns:
+//   - *Counter: The registered counter.
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) NewCounter(name, help string) (*Counter, error) {
+	c := &Counter{}
+	if err := r.register(name, help, "counter", c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCounterVec registers and returns a new counter partitioned by a single label.
+//
+// Parameters:
+//   - name: string - The metric name.
+//   - help: string - The help text of the metric.
+//   - label: string - The name of the label.
+//
+// Returns:
+//   - *CounterVec: The registered counter vector.
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) NewCounterVec(name, help, label string) (*CounterVec, error) {
+	v := &CounterVec{vec[*Counter]{label: label, new: func() *Counter { return &Counter{} }}}
+	if err := r.register(name, help, "counter", v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// NewCounterFunc registers a counter whose value is read from f on every scrape.
+//
+// Parameters:
+//   - name: string - The metric name.
+//   - help: string - The help text of the metric.
+//   - f: func() float64 - Returns the current value of the counter.
+//
+// Returns:
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) error {
+	return r.register(name, help, "counter", valueFunc(f))
+}
+
+// NewGaugeVec registers and returns a new gauge partitioned by a single label.
+//
+// Parameters:
+//   - name: string - The metric name.
+//   - help: string - The help text of the metric.
+//   - label: string - The name of the label.
+//
+// Returns:
+//   - *GaugeVec: The registered gauge vector.
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) NewGaugeVec(name, help, label string) (*GaugeVec, error) {
+	v := &GaugeVec{vec[*Gauge]{label: label, new: func() *Gauge { return &Gauge{} }}}
+	if err := r.register(name, help, "gauge", v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f on every scrape.
+//
+// Parameters:
+//   - name: string - The metric name.
+//   - help: string - The help text of the metric.
+//   - f: func() float64 - Returns the current value of the gauge.
+//
+// Returns:
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) error {
+	return r.register(name, help, "gauge", valueFunc(f))
+}
+
+// NewHistogramVec registers and returns a new histogram partitioned by a single label.
+//
+// Parameters:
+//   - name: string - The metric name.
+//   - help: string - The help text of the metric.
+//   - label: string - The name of the label.
+//   - buckets: []float64 - The upper bounds of the buckets, in increasing order.
+//
+// Returns:
+//   - *HistogramVec: The registered histogram vector.
+//   - error: An error if a metric of the same name is already registered.
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) (*HistogramVec, error) {
+	v := &HistogramVec{vec[*Histogram]{label: label, new: func() *Histogram { return newHistogram(buckets) }}}
+	if err := r.register(name, help, "histogram", v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// WriteText writes all registered metrics in the Prometheus text exposition format.
+//
+// Parameters:
+//   - w: io.Writer - The writer to write the metrics to.
+//
+// Returns:
+//   - error: An error if writing fails.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := slices.Clone(r.names)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.mu.Lock()
+		help, typ, m := r.helps[name], r.types[name], r.metrics[name]
+		r.mu.Unlock()
+
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		m.write(bw, name)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the registered metrics to a Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Counter is a monotonically increasing integer metric.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n.
+//
+// Parameters:
+//   - n: uint64 - The amount to add.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", c.v.Load())
+}
+
+// Gauge is an integer metric that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", g.v.Load())
+}
+
+// valueFunc is a metric whose value is computed on every scrape.
+type valueFunc func() float64
+
+func (f valueFunc) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", f())
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64 // float64 bits
+}
+
+// newHistogram creates a histogram with the given bucket upper bounds.
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// Observe adds a single observation to the histogram.
+//
+// Parameters:
+//   - v: float64 - The observed value.
+func (h *Histogram) Observe(v float64) {
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// ObserveSince observes the time elapsed since start, in seconds.
+//
+// Parameters:
+//   - start: time.Time - The start of the measured operation.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.writeLabeled(w, name, "")
+}
+
+// writeLabeled writes the buckets, sum and count of the histogram with an optional extra label pair.
+func (h *Histogram) writeLabeled(w *bufio.Writer, name, labels string) {
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += h.counts[i].Load()
+		writeSample(w, name+"_bucket", joinLabels(labels, `le="`+formatFloat(upper)+`"`), cumulative)
+	}
+	count := h.count.Load()
+	writeSample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), count)
+	writeSample(w, name+"_sum", labels, math.Float64frombits(h.sum.Load()))
+	writeSample(w, name+"_count", labels, count)
+}
+
+// vec holds the children of a metric partitioned by a single label.
+type vec[M any] struct {
+	label string
+	new   func() M
+
+	mu       sync.Mutex
+	values   []string
+	children map[string]M
+}
+
+// with returns the child for the given label value, creating it if needed.
+func (v *vec[M]) with(value string) M {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if child, ok := v.children[value]; ok {
+		return child
+	}
+	if v.children == nil {
+		v.children = make(map[string]M)
+	}
+	child := v.new()
+	v.values = append(v.values, value)
+	v.children[value] = child
+	return child
+}
+
+// each calls f for every child along with its rendered label pair.
+func (v *vec[M]) each(f func(labels string, child M)) {
+	v.mu.Lock()
+	values := slices.Clone(v.values)
+	children := make([]M, len(values))
+	for i, value := range values {
+		children[i] = v.children[value]
+	}
+	v.mu.Unlock()
+
+	for i, value := range values {
+		f(v.label+`="`+labelEscaper.Replace(value)+`"`, children[i])
+	}
+}
+
+// CounterVec is a counter partitioned by a single label.
+type CounterVec struct {
+	vec[*Counter]
+}
+
+// With returns the counter for the given label value.
+//
+// Parameters:
+//   - value: string - The label value.
+//
+// Returns:
+//   - *Counter: The counter for the label value.
+func (v *CounterVec) With(value string) *Counter {
+	return v.with(value)
+}
+
+func (v *CounterVec) write(w *bufio.Writer, name string) {
+	v.each(func(labels string, c *Counter) {
+		writeSample(w, name, labels, c.v.Load())
+	})
+}
+
+// GaugeVec is a gauge partitioned by a single label.
+type GaugeVec struct {
+	vec[*Gauge]
+}
+
+// With returns the gauge for the given label value.
+//
+// Parameters:
+//   - value: string - The label value.
+//
+// Returns:
+//   - *Gauge: The gauge for the label value.
+func (v *GaugeVec) With(value string) *Gauge {
+	return v.with(value)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer, name string) {
+	v.each(func(labels string, g *Gauge) {
+		writeSample(w, name, labels, g.v.Load())
+	})
+}
+
+// HistogramVec is a histogram partitioned by a single label.
+type HistogramVec struct {
+	vec[*Histogram]
+}
+
+// With returns the histogram for the given label value.
+//
+// Parameters:
+//   - value: string - The label value.
+//
+// Returns:
+//   - *Histogram: The histogram for the label value.
+func (v *HistogramVec) With(value string) *Histogram {
+	return v.with(value)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer, name string) {
+	v.each(func(labels string, h *Histogram) {
+		h.writeLabeled(w, name, labels)
+	})
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// joinLabels joins two rendered label pairs, either of which may be empty.
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "," + b
+}
+
+// writeSample writes a single sample line.
+func writeSample[V uint64 | int64 | float64](w *bufio.Writer, name, labels string, value V) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(float64(value)))
+	w.WriteByte('\n')
+}
+
+// formatFloat formats a sample value the way Prometheus expects it.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// DialFunc dials a connection, typically through the tunnel.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyMetricsEnabled is whether NewProxyMetrics returns metrics that record anything.
+var proxyMetricsEnabled atomic.Bool
+
+// EnableProxyMetrics makes NewProxyMetrics return working metrics from now on. Until then the
+// proxies pass their connections through untouched, as no one collects the metrics anyway.
+func EnableProxyMetrics() {
+	proxyMetricsEnabled.Store(true)
+}
+
+// ProxyMetrics records the connections a proxy opens through the tunnel.
+// A nil *ProxyMetrics records nothing.
+type ProxyMetrics struct {
+	connections   *Counter
+	errors        *Counter
+	active        *Gauge
+	sentBytes     *Counter
+	receivedBytes *Counter
+	dialDuration  *Histogram
+}
+
+// NewProxyMetrics returns the metrics of the proxy with the given name, e.g. "socks".
+// Calling it again with the same name returns metrics backed by the same series.
+//
+// Parameters:
+//   - proxy: string - The name of the proxy, used as the value of the "proxy" label.
+//
+// Returns:
+//   - *ProxyMetrics: The metrics of the proxy, nil unless EnableProxyMetrics was called.
+func NewProxyMetrics(proxy string) *ProxyMetrics {
+	if !proxyMetricsEnabled.Load() {
+		return nil
+	}
+	return &ProxyMetrics{
+		connections:   proxyConnections.With(proxy),
+		errors:        proxyConnectionErrors.With(proxy),
+		active:        proxyActiveConnections.With(proxy),
+		sentBytes:     proxySentBytes.With(proxy),
+		receivedBytes: proxyReceivedBytes.With(proxy),
+		dialDuration:  proxyDialDuration.With(proxy),
+	}
+}
+
+// Dial wraps a dial function so that the time it takes, its failures and the traffic of
+// the connections it opens are recorded.
+//
+// Parameters:
+//   - dial: DialFunc - The dial function to wrap.
+//
+// Returns:
+//   - DialFunc: The instrumented dial function, dial itself if m is nil.
+func (m *ProxyMetrics) Dial(dial DialFunc) DialFunc {
+	if m == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		m.dialDuration.ObserveSince(start)
+		if err != nil {
+			m.errors.Inc()
+			return nil, err
+		}
+		return m.Track(conn), nil
+	}
+}
+
+// Track records an already established connection until it is closed. Reads from conn are
+// counted as received bytes, writes as sent bytes.
+//
+// Parameters:
+//   - conn: net.Conn - The connection to track.
+//
+// Returns:
+//   - net.Conn: A connection that updates the metrics as it is used, conn itself if m is nil.
+//     It can be half-closed if conn can.
+func (m *ProxyMetrics) Track(conn net.Conn) net.Conn {
+	if m == nil {
+		return conn
+	}
+	m.connections.Inc()
+	m.active.Inc()
+	metered := &meteredConn{Conn: conn, metrics: m}
+	if halfCloser, ok := conn.(halfCloser); ok {
+		return &meteredHalfCloseConn{meteredConn: metered, halfCloser: halfCloser}
+	}
+	return metered
+}
+
+// halfCloser is implemented by connections that can be shut down in one direction, like TCP ones.
+// Proxies copying between two connections rely on it to pass on the end of a stream.
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// meteredConn is a net.Conn that updates ProxyMetrics as it is used.
+type meteredConn struct {
+	net.Conn
+	metrics   *ProxyMetrics
+	closeOnce sync.Once
+}
+
+// meteredHalfCloseConn is a meteredConn whose connection can be half-closed.
+type meteredHalfCloseConn struct {
+	*meteredConn
+	halfCloser halfCloser
+}
+
+func (c *meteredHalfCloseConn) CloseRead() error {
+	return c.halfCloser.CloseRead()
+}
+
+func (c *meteredHalfCloseConn) CloseWrite() error {
+	return c.halfCloser.CloseWrite()
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.receivedBytes.Add(uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.sentBytes.Add(uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOnce.Do(c.metrics.active.Dec)
+	return c.Conn.Close()
+}
+
+// ObserveDNSLookup records the duration and outcome of a DNS lookup.
+//
+// Parameters:
+//   - start: time.Time - When the lookup started.
+//   - err: error - The error of the lookup, if any.
+func ObserveDNSLookup(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	dnsLookupDuration.With(result).ObserveSince(start)
+}
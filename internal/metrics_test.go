@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRegistryWriteText checks the exposition format of every kind of metric against its expected
+// output, including the escaping of label values and help texts and the series of histograms.
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	requests, err := r.NewCounter("test_requests_total", "Requests handled.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests.Inc()
+	requests.Add(2)
+
+	errs, err := r.NewCounterVec("test_errors_total", `Errors by path, e.g. C:\dir
+or /plain.`, "path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs.With("/plain").Inc()
+	errs.With(`C:\dir`).Add(2)
+	errs.With(`say "hi"`).Inc()
+	errs.With("two\nlines").Inc()
+
+	active, err := r.NewGaugeVec("test_active", "Active things.", "kind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active.With("x").Inc()
+	active.With("x").Dec()
+	active.With("x").Dec()
+
+	if err := r.NewGaugeFunc("test_ratio", "A computed gauge.", func() float64 { return 0.5 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.NewCounterFunc("test_bytes_total", "A computed counter.", func() float64 { return 1536 }); err != nil {
+		t.Fatal(err)
+	}
+
+	durations, err := r.NewHistogramVec("test_duration_seconds", "Durations.", "op", []float64{0.25, 1, 2.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One observation on a bucket bound, two inside the buckets and one above all of them
+	for _, v := range []float64{0.25, 0.5, 2, 5} {
+		durations.With("a").Observe(v)
+	}
+	durations.With("b")
+
+	const want = `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total 3
+# HELP test_errors_total Errors by path, e.g. C:\\dir\nor /plain.
+# TYPE test_errors_total counter
+test_errors_total{path="/plain"} 1
+test_errors_total{path="C:\\dir"} 2
+test_errors_total{path="say \"hi\""} 1
+test_errors_total{path="two\nlines"} 1
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active{kind="x"} -1
+# HELP test_ratio A computed gauge.
+# TYPE test_ratio gauge
+test_ratio 0.5
+# HELP test_bytes_total A computed counter.
+# TYPE test_bytes_total counter
+test_bytes_total 1536
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="a",le="0.25"} 1
+test_duration_seconds_bucket{op="a",le="1"} 2
+test_duration_seconds_bucket{op="a",le="2.5"} 3
+test_duration_seconds_bucket{op="a",le="+Inf"} 4
+test_duration_seconds_sum{op="a"} 7.75
+test_duration_seconds_count{op="a"} 4
+test_duration_seconds_bucket{op="b",le="0.25"} 0
+test_duration_seconds_bucket{op="b",le="1"} 0
+test_duration_seconds_bucket{op="b",le="2.5"} 0
+test_duration_seconds_bucket{op="b",le="+Inf"} 0
+test_duration_seconds_sum{op="b"} 0
+test_duration_seconds_count{op="b"} 0
+`
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("WriteText wrote\n%s\nwant\n%s", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type is %q", got)
+	}
+	if got := rec.Body.String(); got != want {
+		t.Errorf("ServeHTTP served\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestRegistryDuplicate checks that registering a name twice fails, whatever the kind of the
+// metrics, and leaves the registered metric in place.
+func TestRegistryDuplicate(t *testing.T) {
+	r := NewRegistry()
+	if err := r.NewGaugeFunc("test_value", "The value.", func() float64 { return 1 }); err != nil {
+		t.Fatal(err)
+	}
+
+	registrations := map[string]func() error{
+		"counter": func() error {
+			_, err := r.NewCounter("test_value", "Another value.")
+			return err
+		},
+		"counter vector": func() error {
+			_, err := r.NewCounterVec("test_value", "Another value.", "label")
+			return err
+		},
+		"counter function": func() error {
+			return r.NewCounterFunc("test_value", "Another value.", func() float64 { return 2 })
+		},
+		"gauge vector": func() error {
+			_, err := r.NewGaugeVec("test_value", "Another value.", "label")
+			return err
+		},
+		"gauge function": func() error {
+			return r.NewGaugeFunc("test_value", "Another value.", func() float64 { return 2 })
+		},
+		"histogram vector": func() error {
+			_, err := r.NewHistogramVec("test_value", "Another value.", "label", DefaultBuckets)
+			return err
+		},
+	}
+	for name, register := range registrations {
+		t.Run(name, func(t *testing.T) {
+			if err := register(); err == nil {
+				t.Fatal("registering a name twice succeeded")
+			}
+		})
+	}
+
+	const want = `# HELP test_value The value.
+# TYPE test_value gauge
+test_value 1
+`
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("WriteText wrote\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,370 @@
+//go:build linux
+
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// A minimal nftables client speaking the nf_tables netlink protocol directly, just enough
+// to install a table with base chains and simple rules. Constants are taken from
+// linux/netfilter/nf_tables.h and linux/netfilter/nfnetlink.h.
+
+const (
+	nfnlSubsysNftables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+
+	nftMsgNewTable = 0
+	nftMsgDelTable = 2
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+
+	nftaTableName = 1
+
+	nftaChainTable  = 1
+	nftaChainName   = 3
+	nftaChainHook   = 4
+	nftaChainPolicy = 5
+	nftaChainType   = 7
+
+	nftaHookHooknum  = 1
+	nftaHookPriority = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+
+	nftaListElem = 1
+	nftaExprName = 1
+	nftaExprData = 2
+
+	nftaMetaDreg = 1
+	nftaMetaKey  = 2
+
+	nftaCmpSreg = 1
+	nftaCmpOp   = 2
+	nftaCmpData = 3
+
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+
+	nftaImmediateDreg = 1
+	nftaImmediateData = 2
+
+	nftaBitwiseSreg = 1
+	nftaBitwiseDreg = 2
+	nftaBitwiseLen  = 3
+	nftaBitwiseMask = 4
+	nftaBitwiseXor  = 5
+
+	nftaExthdrDreg   = 1
+	nftaExthdrType   = 2
+	nftaExthdrOffset = 3
+	nftaExthdrLen    = 4
+	nftaExthdrOp     = 6
+	nftaExthdrSreg   = 7
+
+	nftExthdrOpTcpopt = 1
+
+	nftaDataValue   = 1
+	nftaDataVerdict = 2
+	nftaVerdictCode = 1
+
+	nftRegVerdict = 0
+	nftReg1       = 1
+	nftCmpOpEq    = 0
+	nftCmpOpNeq   = 1
+	nftCmpOpGt    = 4
+
+	nftPayloadNetworkHeader   = 1
+	nftPayloadTransportHeader = 2
+
+	nfprotoInet = 1
+	nfprotoIPv4 = 2
+	nfprotoIPv6 = 10
+
+	nfInetForward     = 2
+	nfInetLocalOut    = 3
+	nfInetPostRouting = 4
+	nfDrop            = 0
+	nfAccept          = 1
+
+	nlaFNested = 0x8000
+	ifNameSize = 16
+)
+
+// nftMetaKey selects what a meta expression loads.
+type nftMetaKey uint32
+
+const (
+	nftMetaMark    nftMetaKey = 3
+	nftMetaIifname nftMetaKey = 6
+	nftMetaOifname nftMetaKey = 7
+	nftMetaNfproto nftMetaKey = 15
+	nftMetaL4proto nftMetaKey = 16
+)
+
+// nftExpr is a single encoded rule expression.
+type nftExpr []byte
+
+// nftBatch collects nf_tables messages that the kernel applies in a single transaction.
+type nftBatch struct {
+	msgs [][]byte
+}
+
+// nlAttr encodes a netlink attribute.
+func nlAttr(typ uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data)+3)
+	binary.NativeEndian.PutUint16(b[0:2], uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// nlNested encodes a nested netlink attribute.
+func nlNested(typ uint16, attrs ...[]byte) []byte {
+	var data []byte
+	for _, attr := range attrs {
+		data = append(data, attr...)
+	}
+	return nlAttr(typ|nlaFNested, data)
+}
+
+// nlString encodes a NUL terminated string attribute.
+func nlString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+// nlBe32 encodes a big endian uint32 attribute, which is what nf_tables uses for numbers.
+func nlBe32(typ uint16, v uint32) []byte {
+	return nlAttr(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// nftExpression encodes an expression of the given kind.
+func nftExpression(name string, attrs ...[]byte) nftExpr {
+	return nlNested(nftaListElem, nlString(nftaExprName, name), nlNested(nftaExprData, attrs...))
+}
+
+// nftMeta loads a meta key into register 1.
+func nftMeta(key nftMetaKey) nftExpr {
+	return nftExpression("meta", nlBe32(nftaMetaKey, uint32(key)), nlBe32(nftaMetaDreg, nftReg1))
+}
+
+// nftPayload loads length bytes at offset of a packet header into register 1.
+func nftPayload(base, offset, length uint32) nftExpr {
+	return nftExpression("payload",
+		nlBe32(nftaPayloadDreg, nftReg1),
+		nlBe32(nftaPayloadBase, base),
+		nlBe32(nftaPayloadOffset, offset),
+		nlBe32(nftaPayloadLen, length),
+	)
+}
+
+// nftCmp stops evaluating the rule unless register 1 compares to data as op says.
+// Registers are compared bytewise, so numbers have to be big endian.
+func nftCmp(op uint32, data []byte) nftExpr {
+	return nftExpression("cmp",
+		nlBe32(nftaCmpSreg, nftReg1),
+		nlBe32(nftaCmpOp, op),
+		nlNested(nftaCmpData, nlAttr(nftaDataValue, data)),
+	)
+}
+
+// nftCmpEq stops evaluating the rule unless register 1 equals data.
+func nftCmpEq(data []byte) nftExpr {
+	return nftCmp(nftCmpOpEq, data)
+}
+
+// nftBitwise masks the first len(mask) bytes of register 1 with mask.
+func nftBitwise(mask []byte) nftExpr {
+	return nftExpression("bitwise",
+		nlBe32(nftaBitwiseSreg, nftReg1),
+		nlBe32(nftaBitwiseDreg, nftReg1),
+		nlBe32(nftaBitwiseLen, uint32(len(mask))),
+		nlNested(nftaBitwiseMask, nlAttr(nftaDataValue, mask)),
+		nlNested(nftaBitwiseXor, nlAttr(nftaDataValue, make([]byte, len(mask)))),
+	)
+}
+
+// nftImmediate loads data into register 1.
+func nftImmediate(data []byte) nftExpr {
+	return nftExpression("immediate",
+		nlBe32(nftaImmediateDreg, nftReg1),
+		nlNested(nftaImmediateData, nlAttr(nftaDataValue, data)),
+	)
+}
+
+// nftTCPOption loads length bytes at offset of a TCP option into register 1. The rule
+// stops if the packet doesn't carry the option.
+func nftTCPOption(kind uint8, offset, length uint32) nftExpr {
+	return nftExpression("exthdr",
+		nlBe32(nftaExthdrDreg, nftReg1),
+		nlAttr(nftaExthdrType, []byte{kind}),
+		nlBe32(nftaExthdrOffset, offset),
+		nlBe32(nftaExthdrLen, length),
+		nlBe32(nftaExthdrOp, nftExthdrOpTcpopt),
+	)
+}
+
+// nftSetTCPOption writes register 1 to length bytes at offset of a TCP option, fixing up
+// the checksum.
+func nftSetTCPOption(kind uint8, offset, length uint32) nftExpr {
+	return nftExpression("exthdr",
+		nlBe32(nftaExthdrSreg, nftReg1),
+		nlAttr(nftaExthdrType, []byte{kind}),
+		nlBe32(nftaExthdrOffset, offset),
+		nlBe32(nftaExthdrLen, length),
+		nlBe32(nftaExthdrOp, nftExthdrOpTcpopt),
+	)
+}
+
+// nftMasq rewrites the source address to the one of the outgoing interface.
+func nftMasq() nftExpr {
+	return nftExpression("masq")
+}
+
+// nftAccept accepts the packet.
+func nftAccept() nftExpr {
+	return nftExpression("immediate",
+		nlBe32(nftaImmediateDreg, nftRegVerdict),
+		nlNested(nftaImmediateData, nlNested(nftaDataVerdict, nlBe32(nftaVerdictCode, nfAccept))),
+	)
+}
+
+// nftDrop drops the packet.
+func nftDrop() nftExpr {
+	return nftExpression("immediate",
+		nlBe32(nftaImmediateDreg, nftRegVerdict),
+		nlNested(nftaImmediateData, nlNested(nftaDataVerdict, nlBe32(nftaVerdictCode, nfDrop))),
+	)
+}
+
+// nftIfname pads an interface name the way meta oifname loads it.
+func nftIfname(name string) []byte {
+	b := make([]byte, ifNameSize)
+	copy(b, name)
+	return b
+}
+
+// add appends a message to the batch.
+func (b *nftBatch) add(msgType uint16, flags uint16, family uint8, attrs ...[]byte) {
+	msg := []byte{family, 0, 0, 0} // struct nfgenmsg, version NFNETLINK_V0, res_id 0
+	for _, attr := range attrs {
+		msg = append(msg, attr...)
+	}
+	b.msgs = append(b.msgs, nlMessage(nfnlSubsysNftables<<8|msgType, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags, msg))
+}
+
+// addTable creates a table, or does nothing if it already exists.
+func (b *nftBatch) addTable(family uint8, table string) {
+	b.add(nftMsgNewTable, syscall.NLM_F_CREATE, family, nlString(nftaTableName, table))
+}
+
+// delTable deletes a table with all of its chains and rules.
+func (b *nftBatch) delTable(family uint8, table string) {
+	b.add(nftMsgDelTable, 0, family, nlString(nftaTableName, table))
+}
+
+// addBaseChain creates a chain of chainType ("filter" or "nat") attached to a netfilter hook.
+func (b *nftBatch) addBaseChain(family uint8, table, chain, chainType string, hook uint32, priority int32, policy uint32) {
+	b.add(nftMsgNewChain, syscall.NLM_F_CREATE, family,
+		nlString(nftaChainTable, table),
+		nlString(nftaChainName, chain),
+		nlNested(nftaChainHook, nlBe32(nftaHookHooknum, hook), nlBe32(nftaHookPriority, uint32(priority))),
+		nlBe32(nftaChainPolicy, policy),
+		nlString(nftaChainType, chainType),
+	)
+}
+
+// addRule appends a rule made of exprs to a chain.
+func (b *nftBatch) addRule(family uint8, table, chain string, exprs ...nftExpr) {
+	var list []byte
+	for _, expr := range exprs {
+		list = append(list, expr...)
+	}
+	b.add(nftMsgNewRule, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND, family,
+		nlString(nftaRuleTable, table),
+		nlString(nftaRuleChain, chain),
+		nlAttr(nftaRuleExpressions|nlaFNested, list),
+	)
+}
+
+// nlMessage encodes a netlink message, leaving the sequence number to be filled in on send.
+func nlMessage(msgType uint16, flags uint16, payload []byte) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(payload))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(syscall.NLMSG_HDRLEN+len(payload)))
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	return append(b, payload...)
+}
+
+// commit sends the batch to the kernel as a single transaction and waits for every message
+// to be acknowledged.
+//
+// Returns:
+//   - error: The first error the kernel reported, in which case nothing was applied.
+func (b *nftBatch) commit() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("failed to open netfilter socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netfilter socket: %v", err)
+	}
+
+	// The batch markers carry the subsystem in res_id instead of a family
+	marker := []byte{syscall.AF_UNSPEC, 0, 0, 0}
+	binary.BigEndian.PutUint16(marker[2:4], nfnlSubsysNftables)
+
+	msgs := make([][]byte, 0, len(b.msgs)+2)
+	msgs = append(msgs, nlMessage(nfnlMsgBatchBegin, syscall.NLM_F_REQUEST, marker))
+	msgs = append(msgs, b.msgs...)
+	msgs = append(msgs, nlMessage(nfnlMsgBatchEnd, syscall.NLM_F_REQUEST, marker))
+
+	seq := uint32(os.Getpid())
+	var buf []byte
+	for _, msg := range msgs {
+		seq++
+		binary.NativeEndian.PutUint32(msg[8:12], seq)
+		buf = append(buf, msg...)
+	}
+	if err := syscall.Sendto(fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send nftables batch: %v", err)
+	}
+
+	rb := make([]byte, os.Getpagesize()*8)
+	for pending := len(b.msgs); pending > 0; {
+		n, _, err := syscall.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return fmt.Errorf("failed to receive nftables reply: %v", err)
+		}
+		replies, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse nftables reply: %v", err)
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return fmt.Errorf("short nftables reply")
+			}
+			if errno := int32(binary.NativeEndian.Uint32(reply.Data[0:4])); errno != 0 {
+				return fmt.Errorf("nftables transaction failed: %w", syscall.Errno(-errno))
+			}
+			pending--
+		}
+	}
+
+	return nil
+}
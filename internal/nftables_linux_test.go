@@ -0,0 +1,459 @@
+//go:build linux
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// goldenHex decodes hex digits, ignoring whitespace and comments running to the end of the line.
+func goldenHex(t *testing.T, s string) []byte {
+	t.Helper()
+	var digits strings.Builder
+	for line := range strings.Lines(s) {
+		line, _, _ = strings.Cut(line, "//")
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestNftMessages checks the encoding of each kind of message against bytes derived from
+// linux/netlink.h, linux/netfilter/nfnetlink.h and linux/netfilter/nf_tables.h. The sequence
+// numbers are left to commit.
+func TestNftMessages(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the expected bytes are those of a little endian host")
+	}
+
+	tests := []struct {
+		name string
+		add  func(b *nftBatch)
+		want string
+	}{
+		{
+			name: "new table",
+			add:  func(b *nftBatch) { b.addTable(nfprotoInet, "usque_tun0") },
+			want: `
+				24000000 000a 0504 00000000 00000000 // length 36, NFT_MSG_NEWTABLE, REQUEST|ACK|CREATE
+				01 00 0000                           // inet, NFNETLINK_V0, res_id 0
+				0f00 0100 75737175655f74756e3000 00  // NFTA_TABLE_NAME "usque_tun0"
+			`,
+		},
+		{
+			name: "delete table",
+			add:  func(b *nftBatch) { b.delTable(nfprotoInet, "usque_tun0") },
+			want: `
+				24000000 020a 0500 00000000 00000000 // length 36, NFT_MSG_DELTABLE, REQUEST|ACK
+				01 00 0000
+				0f00 0100 75737175655f74756e3000 00  // NFTA_TABLE_NAME "usque_tun0"
+			`,
+		},
+		{
+			name: "new base chain",
+			add: func(b *nftBatch) {
+				b.addBaseChain(nfprotoInet, "usque_tun0", "output", "filter", nfInetLocalOut, -150, nfDrop)
+			},
+			want: `
+				58000000 030a 0504 00000000 00000000 // length 88, NFT_MSG_NEWCHAIN, REQUEST|ACK|CREATE
+				01 00 0000
+				0f00 0100 75737175655f74756e3000 00  // NFTA_CHAIN_TABLE "usque_tun0"
+				0b00 0300 6f757470757400 00          // NFTA_CHAIN_NAME "output"
+				1400 0480                            // NFTA_CHAIN_HOOK
+				  0800 0100 00000003                 //   NFTA_HOOK_HOOKNUM NF_INET_LOCAL_OUT
+				  0800 0200 ffffff6a                 //   NFTA_HOOK_PRIORITY -150
+				0800 0500 00000000                   // NFTA_CHAIN_POLICY NF_DROP
+				0b00 0700 66696c74657200 00          // NFTA_CHAIN_TYPE "filter"
+			`,
+		},
+		{
+			name: "new rule",
+			add: func(b *nftBatch) {
+				b.addRule(nfprotoInet, "usque_tun0", "output", nftMeta(nftMetaOifname), nftCmpEq(nftIfname("lo")), nftAccept())
+			},
+			want: `
+				c0000000 060a 050c 00000000 00000000 // length 192, NFT_MSG_NEWRULE, REQUEST|ACK|CREATE|APPEND
+				01 00 0000
+				0f00 0100 75737175655f74756e3000 00  // NFTA_RULE_TABLE "usque_tun0"
+				0b00 0200 6f757470757400 00          // NFTA_RULE_CHAIN "output"
+				9000 0480                            // NFTA_RULE_EXPRESSIONS
+				  2400 0180                          //   NFTA_LIST_ELEM
+				    0900 0100 6d65746100 000000      //     NFTA_EXPR_NAME "meta"
+				    1400 0280                        //     NFTA_EXPR_DATA
+				      0800 0200 00000007             //       NFTA_META_KEY NFT_META_OIFNAME
+				      0800 0100 00000001             //       NFTA_META_DREG NFT_REG_1
+				  3800 0180                          //   NFTA_LIST_ELEM
+				    0800 0100 636d7000               //     NFTA_EXPR_NAME "cmp"
+				    2c00 0280                        //     NFTA_EXPR_DATA
+				      0800 0100 00000001             //       NFTA_CMP_SREG NFT_REG_1
+				      0800 0200 00000000             //       NFTA_CMP_OP NFT_CMP_EQ
+				      1800 0380                      //       NFTA_CMP_DATA
+				        1400 0100 6c6f0000000000000000000000000000 // NFTA_DATA_VALUE "lo", padded to IFNAMSIZ
+				  3000 0180                          //   NFTA_LIST_ELEM
+				    0e00 0100 696d6d65646961746500 0000 //  NFTA_EXPR_NAME "immediate"
+				    1c00 0280                        //     NFTA_EXPR_DATA
+				      0800 0100 00000000             //       NFTA_IMMEDIATE_DREG NFT_REG_VERDICT
+				      1000 0280                      //       NFTA_IMMEDIATE_DATA
+				        0c00 0280                    //         NFTA_DATA_VERDICT
+				          0800 0100 00000001         //           NFTA_VERDICT_CODE NF_ACCEPT
+			`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &nftBatch{}
+			tt.add(b)
+			if len(b.msgs) != 1 {
+				t.Fatalf("got %d messages, want 1", len(b.msgs))
+			}
+			if want := goldenHex(t, tt.want); !bytes.Equal(b.msgs[0], want) {
+				t.Errorf("message is\n%x, want\n%x", b.msgs[0], want)
+			}
+		})
+	}
+}
+
+// nlAttrs splits the netlink attributes in b by type, stripping the nested and byte order flags.
+func nlAttrs(t *testing.T, b []byte) map[uint16][]byte {
+	t.Helper()
+	attrs := make(map[uint16][]byte)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			t.Fatalf("truncated attribute header %x", b)
+		}
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		typ := binary.NativeEndian.Uint16(b[2:4]) &^ (nlaFNested | 0x4000)
+		if length < 4 || length > len(b) {
+			t.Fatalf("attribute %d has length %d with %d bytes left", typ, length, len(b))
+		}
+		attrs[typ] = b[4:length]
+		b = b[min((length+3)&^3, len(b)):]
+	}
+	return attrs
+}
+
+// nlList splits a list of nested NFTA_LIST_ELEM attributes.
+func nlList(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	var elems [][]byte
+	for len(b) > 0 {
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		if typ := binary.NativeEndian.Uint16(b[2:4]) &^ nlaFNested; typ != nftaListElem || length < 4 || length > len(b) {
+			t.Fatalf("malformed list element %x", b)
+		}
+		elems = append(elems, b[4:length])
+		b = b[min((length+3)&^3, len(b)):]
+	}
+	return elems
+}
+
+// be32 decodes a big endian number attribute.
+func be32(t *testing.T, b []byte) uint32 {
+	t.Helper()
+	if len(b) != 4 {
+		t.Fatalf("number attribute %x is not 4 bytes long", b)
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// cString decodes a NUL terminated string attribute.
+func cString(t *testing.T, b []byte) string {
+	t.Helper()
+	s, ok := bytes.CutSuffix(b, []byte{0})
+	if !ok {
+		t.Fatalf("string attribute %q is not NUL terminated", b)
+	}
+	return string(s)
+}
+
+// dataWords renders register data as libnftnl does, in 32 bit words of host byte order.
+func dataWords(t *testing.T, data []byte) string {
+	t.Helper()
+	value := nlAttrs(t, data)[nftaDataValue]
+	padded := append(bytes.Clone(value), make([]byte, -len(value)&3)...)
+	words := make([]string, 0, len(padded)/4)
+	for i := 0; i < len(padded); i += 4 {
+		words = append(words, fmt.Sprintf("0x%08x", binary.NativeEndian.Uint32(padded[i:])))
+	}
+	return strings.Join(words, " ")
+}
+
+// verdict renders the verdict held by an NFTA_DATA_VERDICT attribute.
+func verdict(t *testing.T, data []byte) string {
+	t.Helper()
+	code := be32(t, nlAttrs(t, nlAttrs(t, data)[nftaDataVerdict])[nftaVerdictCode])
+	switch code {
+	case nfDrop:
+		return "drop"
+	case nfAccept:
+		return "accept"
+	}
+	return fmt.Sprintf("verdict %d", code)
+}
+
+// renderExpr renders an expression the way nft --debug=netlink lists it.
+func renderExpr(t *testing.T, elem []byte) string {
+	t.Helper()
+	expr := nlAttrs(t, elem)
+	name := cString(t, expr[nftaExprName])
+	data := nlAttrs(t, expr[nftaExprData])
+
+	switch name {
+	case "meta":
+		keys := map[uint32]string{
+			uint32(nftMetaMark): "mark", uint32(nftMetaIifname): "iifname", uint32(nftMetaOifname): "oifname",
+			uint32(nftMetaNfproto): "nfproto", uint32(nftMetaL4proto): "l4proto",
+		}
+		return fmt.Sprintf("meta load %s => reg %d", keys[be32(t, data[nftaMetaKey])], be32(t, data[nftaMetaDreg]))
+	case "cmp":
+		ops := []string{"eq", "neq", "lt", "lte", "gt", "gte"}
+		return fmt.Sprintf("cmp %s reg %d %s", ops[be32(t, data[nftaCmpOp])], be32(t, data[nftaCmpSreg]), dataWords(t, data[nftaCmpData]))
+	case "payload":
+		bases := []string{"link", "network", "transport"}
+		return fmt.Sprintf("payload load %db @ %s header + %d => reg %d",
+			be32(t, data[nftaPayloadLen]), bases[be32(t, data[nftaPayloadBase])], be32(t, data[nftaPayloadOffset]), be32(t, data[nftaPayloadDreg]))
+	case "bitwise":
+		if be32(t, data[nftaBitwiseLen]) != uint32(len(nlAttrs(t, data[nftaBitwiseMask])[nftaDataValue])) {
+			t.Fatalf("bitwise length doesn't match its mask")
+		}
+		return fmt.Sprintf("bitwise reg %d = ( reg %d & %s ) ^ %s",
+			be32(t, data[nftaBitwiseDreg]), be32(t, data[nftaBitwiseSreg]), dataWords(t, data[nftaBitwiseMask]), dataWords(t, data[nftaBitwiseXor]))
+	case "immediate":
+		if dreg := be32(t, data[nftaImmediateDreg]); dreg != nftRegVerdict {
+			return fmt.Sprintf("immediate reg %d %s", dreg, dataWords(t, data[nftaImmediateData]))
+		}
+		return "immediate reg 0 " + verdict(t, data[nftaImmediateData])
+	case "exthdr":
+		if be32(t, data[nftaExthdrOp]) != nftExthdrOpTcpopt {
+			t.Fatalf("exthdr expression on something else than TCP options")
+		}
+		typ := data[nftaExthdrType]
+		if len(typ) != 1 {
+			t.Fatalf("exthdr type %x is not a single byte", typ)
+		}
+		if sreg, ok := data[nftaExthdrSreg]; ok {
+			return fmt.Sprintf("exthdr write tcpopt reg %d => %db @ %d + %d",
+				be32(t, sreg), be32(t, data[nftaExthdrLen]), typ[0], be32(t, data[nftaExthdrOffset]))
+		}
+		return fmt.Sprintf("exthdr load tcpopt %db @ %d + %d => reg %d",
+			be32(t, data[nftaExthdrLen]), typ[0], be32(t, data[nftaExthdrOffset]), be32(t, data[nftaExthdrDreg]))
+	case "masq":
+		if len(data) != 0 {
+			t.Fatalf("masq expression has attributes")
+		}
+		return "masq"
+	}
+	t.Fatalf("unknown expression %q", name)
+	return ""
+}
+
+// renderBatch renders the messages of a batch as the nft commands they stand for, with the
+// expressions of rules listed the way nft --debug=netlink does.
+func renderBatch(t *testing.T, b *nftBatch) string {
+	t.Helper()
+	families := map[byte]string{nfprotoInet: "inet", nfprotoIPv4: "ip", nfprotoIPv6: "ip6"}
+	hooks := map[uint32]string{nfInetForward: "forward", nfInetLocalOut: "output", nfInetPostRouting: "postrouting"}
+	policies := map[uint32]string{nfDrop: "drop", nfAccept: "accept"}
+
+	var out strings.Builder
+	for _, msg := range b.msgs {
+		if len(msg) < syscall.NLMSG_HDRLEN+4 || binary.NativeEndian.Uint32(msg[0:4]) != uint32(len(msg)) {
+			t.Fatalf("message length doesn't match its header: %x", msg)
+		}
+		msgType := binary.NativeEndian.Uint16(msg[4:6])
+		if msgType>>8 != nfnlSubsysNftables {
+			t.Fatalf("message of subsystem %d", msgType>>8)
+		}
+		if flags := binary.NativeEndian.Uint16(msg[6:8]); flags&(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK) != syscall.NLM_F_REQUEST|syscall.NLM_F_ACK {
+			t.Fatalf("message flags %#x don't ask for an acknowledgement", flags)
+		}
+		family := families[msg[syscall.NLMSG_HDRLEN]]
+		attrs := nlAttrs(t, msg[syscall.NLMSG_HDRLEN+4:])
+
+		switch msgType & 0xff {
+		case nftMsgNewTable:
+			fmt.Fprintf(&out, "add table %s %s\n", family, cString(t, attrs[nftaTableName]))
+		case nftMsgDelTable:
+			fmt.Fprintf(&out, "delete table %s %s\n", family, cString(t, attrs[nftaTableName]))
+		case nftMsgNewChain:
+			hook := nlAttrs(t, attrs[nftaChainHook])
+			fmt.Fprintf(&out, "add chain %s %s %s { type %s hook %s priority %d; policy %s; }\n",
+				family, cString(t, attrs[nftaChainTable]), cString(t, attrs[nftaChainName]),
+				cString(t, attrs[nftaChainType]), hooks[be32(t, hook[nftaHookHooknum])],
+				int32(be32(t, hook[nftaHookPriority])), policies[be32(t, attrs[nftaChainPolicy])])
+		case nftMsgNewRule:
+			fmt.Fprintf(&out, "add rule %s %s %s\n", family, cString(t, attrs[nftaRuleTable]), cString(t, attrs[nftaRuleChain]))
+			for _, elem := range nlList(t, attrs[nftaRuleExpressions]) {
+				fmt.Fprintf(&out, "  [ %s ]\n", renderExpr(t, elem))
+			}
+		default:
+			t.Fatalf("unknown message type %d", msgType&0xff)
+		}
+	}
+	return out.String()
+}
+
+// Expressions shared by the expected listings, for a TUN device named tun0.
+const (
+	oifnameTun0 = `  [ meta load oifname => reg 1 ]
+  [ cmp eq reg 1 0x306e7574 0x00000000 0x00000000 0x00000000 ]
+`
+	iifnameTun0 = `  [ meta load iifname => reg 1 ]
+  [ cmp eq reg 1 0x306e7574 0x00000000 0x00000000 0x00000000 ]
+`
+	notOifnameTun0 = `  [ meta load oifname => reg 1 ]
+  [ cmp neq reg 1 0x306e7574 0x00000000 0x00000000 0x00000000 ]
+`
+	ipv4 = `  [ meta load nfproto => reg 1 ]
+  [ cmp eq reg 1 0x00000002 ]
+`
+	ipv6 = `  [ meta load nfproto => reg 1 ]
+  [ cmp eq reg 1 0x0000000a ]
+`
+	accept = "  [ immediate reg 0 accept ]\n"
+)
+
+// TestKillSwitchBatch checks the kill switch table, rule by rule.
+func TestKillSwitchBatch(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the expected listing is that of a little endian host")
+	}
+
+	icmpv6 := func(typ string) string {
+		return "add rule inet usque_tun0 output\n" + ipv6 + `  [ meta load l4proto => reg 1 ]
+  [ cmp eq reg 1 0x0000003a ]
+  [ payload load 1b @ transport header + 0 => reg 1 ]
+  [ cmp eq reg 1 ` + typ + ` ]
+` + accept
+	}
+
+	want := `add table inet usque_tun0
+delete table inet usque_tun0
+add table inet usque_tun0
+add chain inet usque_tun0 output { type filter hook output priority 0; policy drop; }
+add rule inet usque_tun0 output
+  [ meta load oifname => reg 1 ]
+  [ cmp eq reg 1 0x00006f6c 0x00000000 0x00000000 0x00000000 ]
+` + accept + `add rule inet usque_tun0 output
+` + oifnameTun0 + accept + `add rule inet usque_tun0 output
+  [ meta load mark => reg 1 ]
+  [ cmp eq reg 1 0x00000100 ]
+` + accept + `add rule inet usque_tun0 output
+` + ipv4 + `  [ meta load l4proto => reg 1 ]
+  [ cmp eq reg 1 0x00000011 ]
+  [ payload load 4b @ transport header + 0 => reg 1 ]
+  [ cmp eq reg 1 0x43004400 ]
+` + accept + `add rule inet usque_tun0 output
+` + ipv6 + `  [ meta load l4proto => reg 1 ]
+  [ cmp eq reg 1 0x00000011 ]
+  [ payload load 4b @ transport header + 0 => reg 1 ]
+  [ cmp eq reg 1 0x23022202 ]
+` + accept + icmpv6("0x00000085") + icmpv6("0x00000087") + icmpv6("0x00000088")
+
+	if got := renderBatch(t, killSwitchBatch("usque_tun0", "tun0", 0x100)); got != want {
+		t.Errorf("kill switch batch is\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestGatewayBatch checks the gateway table for an IPv4 and an IPv6 subnet, rule by rule.
+func TestGatewayBatch(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the expected listing is that of a little endian host")
+	}
+
+	const (
+		ipv4Subnet = `  [ payload load 4b @ network header + 12 => reg 1 ]
+  [ bitwise reg 1 = ( reg 1 & 0x00ffffff ) ^ 0x00000000 ]
+  [ cmp eq reg 1 0x0001a8c0 ]
+`
+		ipv6Subnet = `  [ payload load 16b @ network header + 8 => reg 1 ]
+  [ bitwise reg 1 = ( reg 1 & 0xffffffff 0xffffffff 0x00000000 0x00000000 ) ^ 0x00000000 0x00000000 0x00000000 0x00000000 ]
+  [ cmp eq reg 1 0x000000fd 0x00000000 0x00000000 0x00000000 ]
+`
+	)
+	clamp := func(direction, family, mss string) string {
+		return "add rule inet usque_gw_tun0 forward\n" + direction + family + `  [ meta load l4proto => reg 1 ]
+  [ cmp eq reg 1 0x00000006 ]
+  [ payload load 1b @ transport header + 13 => reg 1 ]
+  [ bitwise reg 1 = ( reg 1 & 0x00000002 ) ^ 0x00000000 ]
+  [ cmp neq reg 1 0x00000000 ]
+  [ exthdr load tcpopt 2b @ 2 + 2 => reg 1 ]
+  [ cmp gt reg 1 ` + mss + ` ]
+  [ immediate reg 1 ` + mss + ` ]
+  [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
+`
+	}
+
+	want := `add table inet usque_gw_tun0
+delete table inet usque_gw_tun0
+add table inet usque_gw_tun0
+add chain inet usque_gw_tun0 postrouting { type nat hook postrouting priority 100; policy accept; }
+add chain inet usque_gw_tun0 forward { type filter hook forward priority -150; policy accept; }
+add rule inet usque_gw_tun0 postrouting
+` + oifnameTun0 + ipv4 + ipv4Subnet + `  [ masq ]
+add rule inet usque_gw_tun0 postrouting
+` + oifnameTun0 + ipv6 + ipv6Subnet + `  [ masq ]
+` + clamp(oifnameTun0, ipv4, "0x0000d804") + // 1280 - 40
+		clamp(iifnameTun0, ipv4, "0x0000d804") +
+		clamp(oifnameTun0, ipv6, "0x0000c404") + // 1280 - 60
+		clamp(iifnameTun0, ipv6, "0x0000c404") + `add rule inet usque_gw_tun0 forward
+` + notOifnameTun0 + ipv4 + ipv4Subnet + `  [ immediate reg 0 drop ]
+add rule inet usque_gw_tun0 forward
+` + notOifnameTun0 + ipv6 + ipv6Subnet + `  [ immediate reg 0 drop ]
+`
+
+	subnets := []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("fd00::/64")}
+	if got := renderBatch(t, gatewayBatch("usque_gw_tun0", "tun0", subnets, 1280)); got != want {
+		t.Errorf("gateway batch is\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestNftBatchKernel checks that the kernel accepts the kill switch and gateway tables. They are
+// installed in a network namespace of their own, so the test needs to run as root.
+func TestNftBatchKernel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing nftables tables requires root")
+	}
+
+	unshareErr := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The thread is left in the namespace and discarded when the goroutine exits
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			unshareErr <- err
+			return
+		}
+
+		subnets := []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("fd00::/64")}
+		for name, b := range map[string]*nftBatch{
+			"kill switch": killSwitchBatch("usque_tun0", "tun0", 0x100),
+			"gateway":     gatewayBatch("usque_gw_tun0", "tun0", subnets, 1280),
+		} {
+			if err := b.commit(); err != nil {
+				t.Errorf("kernel rejected the %s table: %v", name, err)
+			}
+		}
+	}()
+	<-done
+
+	select {
+	case err := <-unshareErr:
+		t.Skipf("failed to create a network namespace: %v", err)
+	default:
+	}
+}
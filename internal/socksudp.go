@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// DefaultUDPIdleTimeout is the default time after which an idle UDP association or session is closed.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// maxUDPPayload is the largest UDP payload we accept, which is also the largest datagram
+// the client can send us.
+const maxUDPPayload = 65535
+
+// maxUDPTargets is the number of destinations an association keeps sockets open to. Opening one
+// more closes the socket of the destination that has been idle the longest.
+const maxUDPTargets = 256
+
+// maxUDPNames is the number of domain names an association keeps resolved.
+const maxUDPNames = 256
+
+// SocksUDPRelay implements the SOCKS5 UDP ASSOCIATE command (RFC 1928, section 7) by relaying
+// datagrams through netstack UDP sockets inside the MASQUE tunnel.
+//
+// Fragmented datagrams (FRAG != 0) are dropped, as allowed by the RFC for implementations
+// that don't support fragmentation. An association is torn down once it has been idle for
+// IdleTimeout or when the client closes the TCP connection it was requested on. The socket of
+// a single destination is closed once it has been idle for IdleTimeout as well.
+type SocksUDPRelay struct {
+	// TunNet is the network stack of the tunnel the datagrams are relayed through.
+	TunNet *netstack.Net
+	// Resolver resolves the destinations clients address by domain name.
+	Resolver socks5.NameResolver
+	// IdleTimeout is the time after which an idle association is closed.
+	// If zero, DefaultUDPIdleTimeout is used.
+	IdleTimeout time.Duration
+	// Metrics records the destinations each association talks to, optional.
+	Metrics *ProxyMetrics
+}
+
+// udpAssociation is the state of a single UDP ASSOCIATE request.
+type udpAssociation struct {
+	relay    *SocksUDPRelay
+	bindConn *net.UDPConn
+	// clientIP is the only address datagrams are accepted from: the one the TCP connection came from.
+	clientIP netip.Addr
+	// clientPort is the port the client said it will send from, 0 if unknown.
+	clientPort uint16
+
+	mu sync.Mutex
+	// client is the address the first accepted datagram came from, replies go there.
+	client  netip.AddrPort
+	targets map[netip.AddrPort]*udpTarget
+	names   map[string]netip.Addr
+
+	lastActive atomic.Int64
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// udpTarget is the tunnel socket of a single destination of an association.
+type udpTarget struct {
+	net.Conn
+	lastActive atomic.Int64
+}
+
+// touch marks the target as active.
+func (t *udpTarget) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle returns how long the target has been idle.
+func (t *udpTarget) idle() time.Duration {
+	return time.Since(time.Unix(0, t.lastActive.Load()))
+}
+
+// Handle serves a UDP ASSOCIATE request. It matches the signature of socks5.WithAssociateHandle.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the request.
+//   - writer: io.Writer - The TCP connection the request was received on.
+//   - request: *socks5.Request - The parsed request.
+//
+// Returns:
+//   - error: An error if the association couldn't be set up or failed.
+func (r *SocksUDPRelay) Handle(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	clientTCP, ok := request.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("unexpected client address %v", request.RemoteAddr)
+	}
+	localTCP, ok := request.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("unexpected local address %v", request.LocalAddr)
+	}
+
+	// Datagrams are expected on the address the client reached us on
+	bindConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localTCP.IP, Zone: localTCP.Zone})
+	if err != nil {
+		socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("failed to listen for UDP: %v", err)
+	}
+
+	clientIP, _ := netip.AddrFromSlice(clientTCP.IP)
+	a := &udpAssociation{
+		relay:    r,
+		bindConn: bindConn,
+		clientIP: clientIP.Unmap(),
+		targets:  make(map[netip.AddrPort]*udpTarget),
+		names:    make(map[string]netip.Addr),
+		done:     make(chan struct{}),
+	}
+	if request.DestAddr != nil {
+		a.clientPort = uint16(request.DestAddr.Port)
+	}
+	a.touch()
+	defer a.close()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, bindConn.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	go a.readFromClient(ctx)
+	go a.expire()
+
+	// The association lives as long as the TCP connection it was requested on
+	go func() {
+		io.Copy(io.Discard, request.Reader)
+		a.close()
+	}()
+
+	<-a.done
+	return nil
+}
+
+// idleTimeout returns the configured idle timeout or the default one.
+func (r *SocksUDPRelay) idleTimeout() time.Duration {
+	if r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// touch marks the association as active.
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// close tears down the association and every socket it opened.
+func (a *udpAssociation) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.bindConn.Close()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, target := range a.targets {
+			target.Close()
+		}
+	})
+}
+
+// expire closes the association once it has been idle for longer than the idle timeout.
+func (a *udpAssociation) expire() {
+	timeout := a.relay.idleTimeout()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, a.lastActive.Load())) > timeout {
+				log.Printf("socks5: UDP association of %s idle for %s, closing", a.clientIP, timeout)
+				a.close()
+				return
+			}
+		}
+	}
+}
+
+// readFromClient relays the datagrams of the client to their destinations inside the tunnel.
+func (a *udpAssociation) readFromClient(ctx context.Context) {
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, src, err := a.bindConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("socks5: failed to read UDP datagram: %v", err)
+			}
+			a.close()
+			return
+		}
+
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if !a.acceptFrom(src) {
+			continue
+		}
+
+		datagram, err := statute.ParseDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		if datagram.Frag != 0 {
+			// We don't implement reassembly, so fragments must be dropped
+			continue
+		}
+
+		dest, err := a.resolve(ctx, datagram.DstAddr)
+		if err != nil {
+			log.Printf("socks5: failed to resolve UDP destination %s: %v", datagram.DstAddr.FQDN, err)
+			continue
+		}
+
+		target, err := a.target(dest)
+		if err != nil {
+			log.Printf("socks5: failed to open UDP socket to %s: %v", dest, err)
+			continue
+		}
+		if _, err := target.Write(datagram.Data); err != nil {
+			log.Printf("socks5: failed to send UDP datagram to %s: %v", dest, err)
+			continue
+		}
+		target.touch()
+		a.touch()
+	}
+}
+
+// acceptFrom reports whether a datagram from src belongs to this association. The first
+// accepted source becomes the only one accepted afterwards.
+func (a *udpAssociation) acceptFrom(src netip.AddrPort) bool {
+	if src.Addr() != a.clientIP {
+		return false
+	}
+	if a.clientPort != 0 && src.Port() != a.clientPort {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.client.IsValid() {
+		a.client = src
+	}
+	return a.client == src
+}
+
+// resolve turns the destination of a datagram into an address, resolving domain names
+// at most once per association as long as it doesn't use too many of them.
+func (a *udpAssociation) resolve(ctx context.Context, spec statute.AddrSpec) (netip.AddrPort, error) {
+	if spec.FQDN == "" {
+		addr, ok := netip.AddrFromSlice(spec.IP)
+		if !ok {
+			return netip.AddrPort{}, fmt.Errorf("invalid address %v", spec.IP)
+		}
+		return netip.AddrPortFrom(addr.Unmap(), uint16(spec.Port)), nil
+	}
+
+	a.mu.Lock()
+	addr, ok := a.names[spec.FQDN]
+	a.mu.Unlock()
+	if ok {
+		return netip.AddrPortFrom(addr, uint16(spec.Port)), nil
+	}
+
+	_, ip, err := a.relay.Resolver.Resolve(ctx, spec.FQDN)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, ok = netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %v", ip)
+	}
+	addr = addr.Unmap()
+
+	a.mu.Lock()
+	if len(a.names) >= maxUDPNames {
+		// Forget any one of them, it's resolved again if it's still used
+		for name := range a.names {
+			delete(a.names, name)
+			break
+		}
+	}
+	a.names[spec.FQDN] = addr
+	a.mu.Unlock()
+	return netip.AddrPortFrom(addr, uint16(spec.Port)), nil
+}
+
+// target returns the tunnel socket for dest, opening it and starting to relay its
+// replies to the client if needed.
+func (a *udpAssociation) target(dest netip.AddrPort) (*udpTarget, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if target, ok := a.targets[dest]; ok {
+		return target, nil
+	}
+
+	select {
+	case <-a.done:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	if len(a.targets) >= maxUDPTargets {
+		a.evictTarget()
+	}
+
+	conn, err := a.relay.TunNet.DialUDPAddrPort(netip.AddrPort{}, dest)
+	if err != nil {
+		return nil, err
+	}
+	target := &udpTarget{Conn: a.relay.Metrics.Track(conn)}
+	target.touch()
+	a.targets[dest] = target
+
+	go a.readFromTarget(dest, target)
+	return target, nil
+}
+
+// evictTarget closes the socket of the destination that has been idle the longest.
+// a.mu must be held.
+func (a *udpAssociation) evictTarget() {
+	var oldest netip.AddrPort
+	var oldestTarget *udpTarget
+	for dest, target := range a.targets {
+		if oldestTarget == nil || target.idle() > oldestTarget.idle() {
+			oldest, oldestTarget = dest, target
+		}
+	}
+	if oldestTarget != nil {
+		delete(a.targets, oldest)
+		oldestTarget.Close()
+	}
+}
+
+// readFromTarget relays the replies of a destination back to the client until the socket of the
+// destination fails or has been idle for the idle timeout.
+func (a *udpAssociation) readFromTarget(dest netip.AddrPort, target *udpTarget) {
+	// Whatever ends relaying, the next datagram to dest opens a fresh socket
+	defer func() {
+		a.mu.Lock()
+		if a.targets[dest] == target {
+			delete(a.targets, dest)
+		}
+		a.mu.Unlock()
+		target.Close()
+	}()
+
+	header, err := statute.NewDatagram(dest.String(), nil)
+	if err != nil {
+		log.Printf("socks5: invalid UDP destination %s: %v", dest, err)
+		return
+	}
+	prefix := header.Header()
+
+	timeout := a.relay.idleTimeout()
+	buf := make([]byte, len(prefix)+maxUDPPayload)
+	copy(buf, prefix)
+	for {
+		// The deadline only says nothing was received, datagrams may still have been sent
+		target.SetReadDeadline(time.Now().Add(timeout - target.idle()))
+		n, err := target.Read(buf[len(prefix):])
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && target.idle() < timeout {
+				continue
+			}
+			return
+		}
+		target.touch()
+
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+
+		if _, err := a.bindConn.WriteToUDPAddrPort(buf[:len(prefix)+n], client); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("socks5: failed to send UDP datagram to %s: %v", client, err)
+			}
+			return
+		}
+		a.touch()
+	}
+}
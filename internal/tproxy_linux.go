@@ -0,0 +1,362 @@
+//go:build linux
+
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST has the same value.
+const soOriginalDst = 80
+
+// OriginalDst returns the destination a connection had before an iptables or nftables REDIRECT
+// rule sent it to us, as recorded by conntrack.
+//
+// Parameters:
+//   - conn: *net.TCPConn - The redirected connection.
+//
+// Returns:
+//   - netip.AddrPort: The original destination.
+//   - error: An error if the connection wasn't redirected.
+func OriginalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	remote, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	level := unix.SOL_IP
+	if !remote.Addr().Unmap().Is4() {
+		level = unix.SOL_IPV6
+	}
+
+	var raw unix.RawSockaddrInet6 // Large enough for both families
+	size := uint32(unsafe.Sizeof(raw))
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0)
+	}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if errno != 0 {
+		return netip.AddrPort{}, fmt.Errorf("failed to get original destination: %v", errno)
+	}
+
+	return parseRawSockaddr((*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(&raw))[:size])
+}
+
+// parseRawSockaddr parses a struct sockaddr_in or sockaddr_in6.
+func parseRawSockaddr(b []byte) (netip.AddrPort, error) {
+	if len(b) < 2 {
+		return netip.AddrPort{}, errors.New("short socket address")
+	}
+	// The port is in network byte order, the family in host byte order
+	switch binary.NativeEndian.Uint16(b) {
+	case unix.AF_INET:
+		if len(b) < unix.SizeofSockaddrInet4 {
+			return netip.AddrPort{}, errors.New("short IPv4 socket address")
+		}
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[2:4])), nil
+	case unix.AF_INET6:
+		if len(b) < unix.SizeofSockaddrInet6 {
+			return netip.AddrPort{}, errors.New("short IPv6 socket address")
+		}
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[8:24])).Unmap(), binary.BigEndian.Uint16(b[2:4])), nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported address family %d", binary.NativeEndian.Uint16(b))
+	}
+}
+
+// transparentControl sets IP_TRANSPARENT on a socket, which lets it accept traffic sent to any
+// address by a TPROXY rule, or bind to a foreign address. UDP sockets are also told to report
+// the original destination of datagrams, and may share their address with the reply sockets of
+// TProxyUDPRelay. IPv6 sockets get the IPv4 options as well, they apply to the IPv4 traffic of
+// dual-stack sockets.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var opts [][2]int
+	if strings.HasPrefix(network, "udp") {
+		opts = append(opts, [2]int{unix.SOL_SOCKET, unix.SO_REUSEADDR})
+	}
+	if !strings.HasSuffix(network, "6") {
+		opts = append(opts, [2]int{unix.SOL_IP, unix.IP_TRANSPARENT})
+		if strings.HasPrefix(network, "udp") {
+			opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+		}
+	} else {
+		opts = append(opts, [2]int{unix.SOL_IP, unix.IP_TRANSPARENT}, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+		if strings.HasPrefix(network, "udp") {
+			opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR}, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+		}
+	}
+
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		for _, opt := range opts {
+			if err = unix.SetsockoptInt(int(fd), opt[0], opt[1], 1); err != nil {
+				err = fmt.Errorf("failed to make socket transparent: %v", err)
+				return
+			}
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// ListenTransparentTCP listens for TCP connections sent to us by a TPROXY rule. The local address
+// of an accepted connection is its original destination.
+//
+// Parameters:
+//   - address: string - The address to listen on.
+//
+// Returns:
+//   - net.Listener: The listener.
+//   - error: An error if the socket can't be opened, e.g. without CAP_NET_ADMIN.
+func ListenTransparentTCP(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// ListenTransparentUDP listens for UDP datagrams sent to us by a TPROXY rule, see TProxyUDPRelay.
+//
+// Parameters:
+//   - address: string - The address to listen on.
+//
+// Returns:
+//   - *net.UDPConn: The socket.
+//   - error: An error if the socket can't be opened, e.g. without CAP_NET_ADMIN.
+func ListenTransparentUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// originalDstFromOOB extracts the original destination of a datagram from its control messages.
+func originalDstFromOOB(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, msg := range msgs {
+		if (msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR) ||
+			(msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR) {
+			return parseRawSockaddr(msg.Data)
+		}
+	}
+	return netip.AddrPort{}, errors.New("datagram has no original destination")
+}
+
+// TProxyUDPRelay forwards the datagrams received on a transparent UDP socket to their original
+// destinations. Every pair of client and destination gets its own session with a dedicated
+// upstream socket. Replies are sent from a socket bound to the destination, so they look like
+// they came from it. Sessions are closed after being idle for IdleTimeout.
+type TProxyUDPRelay struct {
+	// Conn is the socket opened with ListenTransparentUDP.
+	Conn *net.UDPConn
+	// Dial opens the upstream socket of a new session to dst.
+	Dial func(dst netip.AddrPort) (net.Conn, error)
+	// IdleTimeout is the time after which an idle session is closed.
+	// If zero, DefaultUDPIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[tproxyUDPKey]*tproxyUDPSession
+}
+
+// tproxyUDPKey identifies a session.
+type tproxyUDPKey struct {
+	src, dst netip.AddrPort
+}
+
+// tproxyUDPSession is the upstream socket of a single client and destination, and the socket
+// replies are sent to the client from.
+type tproxyUDPSession struct {
+	udpSession
+	reply net.Conn
+}
+
+// close closes both sockets of the session.
+func (s *tproxyUDPSession) close() {
+	s.conn.Close()
+	s.reply.Close()
+}
+
+// Serve forwards datagrams until the socket is closed. Every session is closed before it returns.
+//
+// Returns:
+//   - error: The error that stopped the socket, nil if it was closed.
+func (r *TProxyUDPRelay) Serve() error {
+	r.mu.Lock()
+	r.sessions = make(map[tproxyUDPKey]*tproxyUDPSession)
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for key, session := range r.sessions {
+			session.close()
+			delete(r.sessions, key)
+		}
+	}()
+	go r.expire(done)
+
+	buf := make([]byte, maxUDPPayload)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := r.Conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		dst, err := originalDstFromOOB(oob[:oobn])
+		if err != nil {
+			log.Printf("Dropping UDP datagram from %s: %v", src, err)
+			continue
+		}
+
+		key := tproxyUDPKey{src: netip.AddrPortFrom(src.Addr().Unmap(), src.Port()), dst: dst}
+		session, err := r.session(key)
+		if err != nil {
+			log.Printf("Failed to open UDP session from %s to %s: %v", key.src, key.dst, err)
+			continue
+		}
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			log.Printf("Failed to forward UDP datagram from %s to %s: %v", key.src, key.dst, err)
+			continue
+		}
+		session.touch()
+	}
+}
+
+// session returns the session of key, opening a new one if needed. The sockets of a new session
+// are opened without holding the lock, dialing upstream may take a while.
+func (r *TProxyUDPRelay) session(key tproxyUDPKey) (*tproxyUDPSession, error) {
+	r.mu.Lock()
+	session, ok := r.sessions[key]
+	r.mu.Unlock()
+	if ok {
+		return session, nil
+	}
+
+	// Binding to the foreign destination address needs IP_TRANSPARENT as well
+	dialer := net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(key.dst),
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				if key.dst.Addr().Is4() {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				} else {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	reply, err := dialer.Dial("udp", key.src.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reply socket: %v", err)
+	}
+
+	conn, err := r.Dial(key.dst)
+	if err != nil {
+		reply.Close()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if existing, ok := r.sessions[key]; ok {
+		// Opened by someone else in the meantime
+		r.mu.Unlock()
+		conn.Close()
+		reply.Close()
+		return existing, nil
+	}
+	session = &tproxyUDPSession{udpSession: udpSession{conn: conn}, reply: reply}
+	session.touch()
+	r.sessions[key] = session
+	r.mu.Unlock()
+
+	go r.relayReplies(key, session)
+	return session, nil
+}
+
+// relayReplies relays the datagrams received on the upstream socket of a session back to its client.
+func (r *TProxyUDPRelay) relayReplies(key tproxyUDPKey, session *tproxyUDPSession) {
+	defer func() {
+		r.mu.Lock()
+		if r.sessions[key] == session {
+			delete(r.sessions, key)
+		}
+		r.mu.Unlock()
+		session.close()
+	}()
+
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := session.reply.Write(buf[:n]); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Failed to send UDP datagram to %s: %v", key.src, err)
+			}
+			return
+		}
+		session.touch()
+	}
+}
+
+// expire closes the sessions that have been idle for longer than the idle timeout until done is closed.
+func (r *TProxyUDPRelay) expire(done <-chan struct{}) {
+	timeout := r.IdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultUDPIdleTimeout
+	}
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			for key, session := range r.sessions {
+				if time.Since(time.Unix(0, session.lastActive.Load())) > timeout {
+					// Closing the sockets stops the reply goroutine of the session
+					session.close()
+					delete(r.sessions, key)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPForwarder forwards the datagrams received on a packet listener to a fixed destination.
+// Every source address gets its own session with a dedicated upstream socket, so that
+// replies are delivered back to the right client. Sessions are closed after being idle
+// for IdleTimeout.
+type UDPForwarder struct {
+	// Listener receives the datagrams of the clients.
+	Listener net.PacketConn
+	// Dial opens the upstream socket of a new session.
+	Dial func() (net.Conn, error)
+	// IdleTimeout is the time after which an idle session is closed.
+	// If zero, DefaultUDPIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// udpSession is the upstream socket of a single client.
+type udpSession struct {
+	conn       net.Conn
+	lastActive atomic.Int64
+}
+
+// touch marks the session as active.
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// Serve forwards datagrams until the listener is closed. Every session is closed before it returns.
+//
+// Returns:
+//   - error: The error that stopped the listener, nil if it was closed.
+func (f *UDPForwarder) Serve() error {
+	f.mu.Lock()
+	f.sessions = make(map[string]*udpSession)
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for key, session := range f.sessions {
+			session.conn.Close()
+			delete(f.sessions, key)
+		}
+	}()
+	go f.expire(done)
+
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, src, err := f.Listener.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		session, err := f.session(src)
+		if err != nil {
+			log.Printf("Failed to open UDP session for %s: %v", src, err)
+			continue
+		}
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			log.Printf("Failed to forward UDP datagram from %s: %v", src, err)
+			continue
+		}
+		session.touch()
+	}
+}
+
+// idleTimeout returns the configured idle timeout or the default one.
+func (f *UDPForwarder) idleTimeout() time.Duration {
+	if f.IdleTimeout > 0 {
+		return f.IdleTimeout
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// session returns the session of src, opening a new one if needed.
+func (f *UDPForwarder) session(src net.Addr) (*udpSession, error) {
+	key := src.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if session, ok := f.sessions[key]; ok {
+		return session, nil
+	}
+
+	conn, err := f.Dial()
+	if err != nil {
+		return nil, err
+	}
+	session := &udpSession{conn: conn}
+	session.touch()
+	f.sessions[key] = session
+
+	go f.reply(key, src, session)
+	return session, nil
+}
+
+// reply relays the datagrams received on the upstream socket of a session back to its client.
+func (f *UDPForwarder) reply(key string, src net.Addr, session *udpSession) {
+	defer func() {
+		f.mu.Lock()
+		if f.sessions[key] == session {
+			delete(f.sessions, key)
+		}
+		f.mu.Unlock()
+		session.conn.Close()
+	}()
+
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := f.Listener.WriteTo(buf[:n], src); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Failed to send UDP datagram to %s: %v", src, err)
+			}
+			return
+		}
+		session.touch()
+	}
+}
+
+// expire closes the sessions that have been idle for longer than the idle timeout until done is closed.
+func (f *UDPForwarder) expire(done <-chan struct{}) {
+	timeout := f.idleTimeout()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			for key, session := range f.sessions {
+				if time.Since(time.Unix(0, session.lastActive.Load())) > timeout {
+					// Closing the socket stops the reply goroutine of the session
+					session.conn.Close()
+					delete(f.sessions, key)
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
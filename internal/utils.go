@@ -20,6 +20,7 @@ import (
 
 // PortMapping represents a network port forwarding rule.
 type PortMapping struct {
+	Network     string // The protocol to forward, either "tcp" or "udp".
 	BindAddress string // The address to bind the local port.
 	LocalPort   int    // The local port number.
 	RemoteIP    string // The remote destination IP address.
@@ -146,13 +147,9 @@ func DefaultQuicConfig(keepalivePeriod time.Duration, initialPacketSize uint16)
 //   - int: The remote port.
 //   - error: An error if parsing fails.
 func parsePortMapping(port string) (bindAddress string, localPort int, remoteHost string, remotePort int, err error) {
-	parts := strings.Split(port, ":")
+	parts := splitPortMapping(port)
 
-	// Handle IPv6 addresses (which are enclosed in brackets)
-	if len(parts) >= 4 && strings.HasPrefix(parts[0], "[") && strings.Contains(parts[0], "]") {
-		bindAddress = parts[0]
-		parts = parts[1:] // Shift parts forward
-	} else if len(parts) == 3 {
+	if len(parts) == 3 {
 		bindAddress = "localhost" // Default to localhost
 	} else if len(parts) == 4 {
 		bindAddress = parts[0]
@@ -169,6 +166,9 @@ func parsePortMapping(port string) (bindAddress string, localPort int, remoteHos
 
 	// Validate remote host (allow both hostnames and IPs)
 	remoteHost = parts[1]
+	if strings.HasPrefix(remoteHost, "[") && strings.HasSuffix(remoteHost, "]") {
+		remoteHost = strings.Trim(remoteHost, "[]")
+	}
 	if net.ParseIP(remoteHost) == nil && !isValidHostname(remoteHost) {
 		return "", 0, "", 0, errors.New("invalid remote hostname/IP")
 	}
@@ -203,9 +203,37 @@ func parsePortMapping(port string) (bindAddress string, localPort int, remoteHos
 	return bindAddress, localPort, remoteHost, remotePort, nil
 }
 
+// splitPortMapping splits a port mapping string at its colons, except for those of IPv6 addresses
+// enclosed in brackets.
+//
+// Parameters:
+//   - port: string - The port mapping string.
+//
+// Returns:
+//   - []string: The fields of the port mapping.
+func splitPortMapping(port string) []string {
+	var parts []string
+	bracketed, start := false, 0
+	for i, c := range port {
+		switch c {
+		case '[':
+			bracketed = true
+		case ']':
+			bracketed = false
+		case ':':
+			if !bracketed {
+				parts = append(parts, port[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, port[start:])
+}
+
 // ParsePortMapping parses a port mapping string into a structured PortMapping.
 //
-// The expected format is: `[bind_address:]local_port:remote_host:remote_port`.
+// The expected format is: `[udp/|tcp/][bind_address:]local_port:remote_host:remote_port`.
+// Mappings without a protocol prefix forward TCP.
 //
 // Parameters:
 //   - port: string - The port mapping string.
@@ -214,12 +242,20 @@ func parsePortMapping(port string) (bindAddress string, localPort int, remoteHos
 //   - PortMapping: A structured representation of the parsed port mapping.
 //   - error:       An error if the parsing fails.
 func ParsePortMapping(port string) (PortMapping, error) {
+	network := "tcp"
+	if rest, ok := strings.CutPrefix(port, "udp/"); ok {
+		network, port = "udp", rest
+	} else if rest, ok := strings.CutPrefix(port, "tcp/"); ok {
+		port = rest
+	}
+
 	bindAddress, localPort, remoteHost, remotePort, err := parsePortMapping(port)
 	if err != nil {
 		return PortMapping{}, err
 	}
 
 	return PortMapping{
+		Network:     network,
 		BindAddress: bindAddress,
 		LocalPort:   localPort,
 		RemoteIP:    remoteHost,
@@ -227,6 +263,48 @@ func ParsePortMapping(port string) (PortMapping, error) {
 	}, nil
 }
 
+// ParseDynamicForward parses the address of a dynamic port forwarding listener.
+//
+// The expected format is: `[bind_address:]port`, like SSH's -D. Without a bind address
+// the listener is bound to localhost, "*" binds to all interfaces. IPv6 bind addresses have to be
+// enclosed in brackets.
+//
+// Parameters:
+//   - forward: string - The dynamic forwarding string.
+//
+// Returns:
+//   - string: The address to listen on.
+//   - error:  An error if the parsing fails.
+func ParseDynamicForward(forward string) (string, error) {
+	bindAddress, port := "localhost", forward
+	if i := strings.LastIndex(forward, ":"); i >= 0 {
+		bindAddress, port = forward[:i], forward[i+1:]
+	}
+
+	localPort, err := strconv.Atoi(port)
+	if err != nil || localPort <= 0 || localPort > 65535 {
+		return "", errors.New("invalid local port")
+	}
+
+	// If bindAddress is an IPv6 address, remove brackets for proper binding
+	if strings.HasPrefix(bindAddress, "[") && strings.HasSuffix(bindAddress, "]") {
+		bindAddress = strings.Trim(bindAddress, "[]")
+	} else if strings.Contains(bindAddress, ":") {
+		// Otherwise where the address ends and the port starts is ambiguous
+		return "", errors.New("invalid local address: IPv6 addresses have to be enclosed in brackets")
+	}
+	if bindAddress == "*" {
+		bindAddress = "0.0.0.0" // Allow all interfaces
+	}
+
+	bindAddress, err = resolveBindAddress(bindAddress)
+	if err != nil {
+		return "", errors.New("invalid local address: " + err.Error())
+	}
+
+	return net.JoinHostPort(bindAddress, strconv.Itoa(localPort)), nil
+}
+
 // resolveBindAddress resolves a hostname or IP to its string representation.
 //
 // Parameters:
@@ -236,7 +314,10 @@ func ParsePortMapping(port string) (PortMapping, error) {
 //   - string: The resolved IP address.
 //   - error:  An error if resolution fails.
 func resolveBindAddress(addr string) (string, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr+":0") // Resolve the address
+	if addr == "" {
+		return "", errors.New("missing address")
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(addr, "0")) // Resolve the address
 	if err != nil {
 		return "", err
 	}
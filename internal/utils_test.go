@@ -0,0 +1,111 @@
+package internal
+
+import "testing"
+
+// TestParsePortMapping checks the protocol prefixes, the bind address defaults, IPv6 addresses in
+// brackets and the rejection of malformed mappings and out of range ports.
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    PortMapping
+		// wantErr is set if the mapping has to be rejected
+		wantErr bool
+	}{
+		{mapping: "8080:1.1.1.1:80", want: PortMapping{"tcp", "127.0.0.1", 8080, "1.1.1.1", 80}},
+		{mapping: "tcp/8080:1.1.1.1:80", want: PortMapping{"tcp", "127.0.0.1", 8080, "1.1.1.1", 80}},
+		{mapping: "udp/5353:1.1.1.1:53", want: PortMapping{"udp", "127.0.0.1", 5353, "1.1.1.1", 53}},
+		{mapping: "udp/0.0.0.0:5353:1.1.1.1:53", want: PortMapping{"udp", "0.0.0.0", 5353, "1.1.1.1", 53}},
+		{mapping: "*:8080:1.1.1.1:80", want: PortMapping{"tcp", "0.0.0.0", 8080, "1.1.1.1", 80}},
+		{mapping: "localhost:8080:localhost:80", want: PortMapping{"tcp", "127.0.0.1", 8080, "127.0.0.1", 80}},
+		{mapping: "[::1]:8080:1.1.1.1:80", want: PortMapping{"tcp", "::1", 8080, "1.1.1.1", 80}},
+		{mapping: "udp/[::]:5353:[2606:4700:4700::1111]:53", want: PortMapping{"udp", "::", 5353, "2606:4700:4700::1111", 53}},
+		{mapping: "8080:2606:4700:4700::1111:80", wantErr: true},
+		{mapping: "1:1.1.1.1:1", want: PortMapping{"tcp", "127.0.0.1", 1, "1.1.1.1", 1}},
+		{mapping: "65535:1.1.1.1:65535", want: PortMapping{"tcp", "127.0.0.1", 65535, "1.1.1.1", 65535}},
+		{mapping: "0:1.1.1.1:80", wantErr: true},
+		{mapping: "65536:1.1.1.1:80", wantErr: true},
+		{mapping: "-1:1.1.1.1:80", wantErr: true},
+		{mapping: "8080:1.1.1.1:0", wantErr: true},
+		{mapping: "8080:1.1.1.1:65536", wantErr: true},
+		{mapping: "http:1.1.1.1:80", wantErr: true},
+		{mapping: "8080:1.1.1.1:http", wantErr: true},
+		{mapping: "8080:1.1.1.1:", wantErr: true},
+		{mapping: "8080:intranet:80", wantErr: true},
+		{mapping: "8080::80", wantErr: true},
+		{mapping: ":8080:1.1.1.1:80", wantErr: true},
+		{mapping: "[::1:8080:1.1.1.1:80", wantErr: true},
+		{mapping: "8080:1.1.1.1", wantErr: true},
+		{mapping: "1.2.3.4:8080:1.1.1.1:80:1", wantErr: true},
+		{mapping: "", wantErr: true},
+		{mapping: "udp/", wantErr: true},
+		{mapping: "UDP/5353:1.1.1.1:53", wantErr: true},
+		{mapping: "sctp/8080:1.1.1.1:80", wantErr: true},
+		{mapping: "udp/tcp/8080:1.1.1.1:80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mapping, func(t *testing.T) {
+			got, err := ParsePortMapping(tt.mapping)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePortMapping returned %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePortMapping returned %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseDynamicForward checks the bind address defaults, IPv6 addresses in brackets and the
+// rejection of malformed addresses and out of range ports.
+func TestParseDynamicForward(t *testing.T) {
+	tests := []struct {
+		forward string
+		// want is the address to listen on, empty if the forward has to be rejected
+		want string
+	}{
+		{forward: "1080", want: "127.0.0.1:1080"},
+		{forward: "localhost:1080", want: "127.0.0.1:1080"},
+		{forward: "*:1080", want: "0.0.0.0:1080"},
+		{forward: "192.168.1.2:1080", want: "192.168.1.2:1080"},
+		{forward: "[::1]:1080", want: "[::1]:1080"},
+		{forward: "[::]:1080", want: "[::]:1080"},
+		{forward: "1", want: "127.0.0.1:1"},
+		{forward: "65535", want: "127.0.0.1:65535"},
+		{forward: "0"},
+		{forward: "65536"},
+		{forward: "-1"},
+		{forward: "socks"},
+		{forward: ""},
+		{forward: ":1080"},
+		{forward: "localhost:"},
+		{forward: "::1:1080"},
+		{forward: "[::1]"},
+		{forward: "[::1:1080"},
+		{forward: "1.2.3.4:1080:1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.forward, func(t *testing.T) {
+			got, err := ParseDynamicForward(tt.forward)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("ParseDynamicForward returned %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDynamicForward returned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -36,6 +36,20 @@ func SetIPv6Address(ifaceName, ipAddr, mask string) error {
 	return nil
 }
 
+func DeleteIPv6Address(ifaceName, ipAddr string) error {
+	cmd := exec.Command("netsh", "interface", "ipv6", "delete", "address",
+		fmt.Sprintf("interface=\"%s\"", ifaceName),
+		ipAddr)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", output)
+	}
+
+	log.Println("IPv6 address deleted successfully:", ipAddr)
+	return nil
+}
+
 func SetIPv4MTU(ifaceName string, mtu int) error {
 	cmd := exec.Command("netsh", "interface", "ipv4", "set", "subinterface",
 		fmt.Sprintf("\"%s\"", ifaceName),